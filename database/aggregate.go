@@ -0,0 +1,349 @@
+package database
+
+import (
+	"fmt"
+)
+
+var aggregateFuncs = map[string]bool{"count": true, "sum": true, "min": true, "max": true, "avg": true}
+
+func (s *SelectStmt) isAggregate() bool {
+	if len(s.GroupBy) > 0 || s.Having != nil {
+		return true
+	}
+	found := false
+	for _, item := range s.Items {
+		walkExpr(item.Expr, func(e Expr) {
+			if _, ok := e.(*AggregateCall); ok {
+				found = true
+			}
+		})
+	}
+	return found
+}
+
+// the running state of an aggregate function over a group
+type aggState struct {
+	call  *AggregateCall
+	count int64
+	sum   Value // int until a float is added
+	best  Value // for min & max
+}
+
+func (a *aggState) add(row []Value) error {
+	if a.call.Arg == nil {
+		a.count++ // count(*)
+		return nil
+	}
+	v, err := a.call.Arg.Eval(row)
+	if err != nil {
+		return err
+	}
+	if v.Type == TYPE_NULL {
+		return nil // ignored by all aggregates
+	}
+	switch a.call.Func {
+	case "sum", "avg":
+		if !isNumber(v) {
+			return fmt.Errorf("%s: %w, expected a number", a.call, ErrTypeMismatch)
+		}
+		if a.count == 0 {
+			a.sum = v
+		} else if a.sum.Type == TYPE_INT64 && v.Type == TYPE_INT64 {
+			a.sum.I64 += v.I64
+		} else {
+			a.sum = Value{Type: TYPE_FLOAT64, F64: toFloat(a.sum) + toFloat(v)}
+		}
+	case "min", "max":
+		if a.count == 0 {
+			a.best = v
+			break
+		}
+		c, err := cmpValues(v, a.best)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.call, err)
+		}
+		if (a.call.Func == "min" && c < 0) || (a.call.Func == "max" && c > 0) {
+			a.best = v
+		}
+	}
+	a.count++
+	return nil
+}
+
+// aggregates over no values are NULL, except for count
+func (a *aggState) result() Value {
+	switch a.call.Func {
+	case "count":
+		return Value{Type: TYPE_INT64, I64: a.count}
+	}
+	if a.count == 0 {
+		return Value{Type: TYPE_NULL}
+	}
+	switch a.call.Func {
+	case "sum":
+		return a.sum
+	case "avg":
+		return Value{Type: TYPE_FLOAT64, F64: toFloat(a.sum) / float64(a.count)}
+	default:
+		return a.best
+	}
+}
+
+type group struct {
+	keys []Value
+	aggs []aggState
+}
+
+func (q *query) runAggregate(fn func(rec *Record) error) error {
+	s, sch := q.stmt, q.sch
+	if rec, ok, err := q.minMaxBySeek(); ok || err != nil {
+		if err != nil {
+			return err
+		}
+		return fn(rec)
+	}
+
+	groupBy := make([]Expr, len(s.GroupBy))
+	for i, e := range s.GroupBy {
+		bound, err := bindExpr(e, sch)
+		if err != nil {
+			return err
+		}
+		groupBy[i] = bound
+	}
+
+	// every distinct aggregate is computed once, items refer to its slot
+	var calls []*AggregateCall
+	seen := map[string]bool{}
+	collect := func(e Expr) {
+		walkExpr(e, func(e Expr) {
+			if call, ok := e.(*AggregateCall); ok && !seen[call.String()] {
+				seen[call.String()] = true
+				calls = append(calls, call)
+			}
+		})
+	}
+	for _, item := range s.Items {
+		if item.Expr == nil {
+			return fmt.Errorf("SELECT * cannot be used with aggregates")
+		}
+		collect(item.Expr)
+	}
+	collect(s.Having)
+	for _, item := range s.OrderBy {
+		collect(item.Expr)
+	}
+	for i, call := range calls {
+		if !aggregateFuncs[call.Func] {
+			return fmt.Errorf("unknown aggregate function %s", call.Func)
+		}
+		var nested error
+		walkExpr(call.Arg, func(e Expr) {
+			if _, ok := e.(*AggregateCall); ok {
+				nested = fmt.Errorf("aggregate calls cannot be nested: %s", call)
+			}
+		})
+		if nested != nil {
+			return nested
+		}
+		bound, err := bindExpr(call, sch)
+		if err != nil {
+			return err
+		}
+		calls[i] = bound.(*AggregateCall)
+	}
+
+	// items & HAVING are evaluated on rows of [group keys..., aggregates...]
+	names := make([]string, len(s.Items))
+	exprs := make([]Expr, len(s.Items))
+	for i, item := range s.Items {
+		e, err := groupedExpr(item.Expr, s.GroupBy, calls)
+		if err != nil {
+			return err
+		}
+		names[i], exprs[i] = item.name(), e
+	}
+	keys, err := bindOrder(s.OrderBy, func(e Expr) (Expr, error) {
+		if i := s.aliasOf(e); i >= 0 {
+			return exprs[i], nil
+		}
+		return groupedExpr(e, s.GroupBy, calls)
+	})
+	if err != nil {
+		return err
+	}
+	out := newOrderedOutput(q.db, s.OrderBy, keys, fn)
+	defer out.close()
+
+	var having Expr
+	if s.Having != nil {
+		var err error
+		if having, err = groupedExpr(s.Having, s.GroupBy, calls); err != nil {
+			return err
+		}
+	}
+
+	q.useKeyOnly()
+	rows, err := q.open()
+	if err != nil {
+		return err
+	}
+	groups := map[string]*group{}
+	var order []*group // in the order of the first row
+	for {
+		row, err := rows.next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		if ok, err := matches(q.where, row); err != nil || !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		keys := make([]Value, len(groupBy))
+		for i, e := range groupBy {
+			if keys[i], err = e.Eval(row); err != nil {
+				return err
+			}
+		}
+		k := valuesKey(keys)
+		g := groups[k]
+		if g == nil {
+			g = newGroup(keys, calls)
+			groups[k] = g
+			order = append(order, g)
+		}
+		for i := range g.aggs {
+			if err := g.aggs[i].add(row); err != nil {
+				return err
+			}
+		}
+	}
+	if len(groupBy) == 0 && len(order) == 0 {
+		// aggregates without GROUP BY always produce a row
+		order = append(order, newGroup(nil, calls))
+	}
+
+	for _, g := range order {
+		row := append([]Value{}, g.keys...)
+		for i := range g.aggs {
+			row = append(row, g.aggs[i].result())
+		}
+		ok, err := matches(having, row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		rec, err := project(names, exprs, row)
+		if err != nil {
+			return err
+		}
+		if err := out.add(row, rec); err != nil {
+			return err
+		}
+	}
+	return out.finish()
+}
+
+func newGroup(keys []Value, calls []*AggregateCall) *group {
+	g := &group{keys: keys, aggs: make([]aggState, len(calls))}
+	for i, call := range calls {
+		g.aggs[i].call = call
+	}
+	return g
+}
+
+// rewrite an expression over the rows of the table into one over the
+// groups, a column may only be used through GROUP BY or an aggregate
+func groupedExpr(e Expr, groupBy []Expr, calls []*AggregateCall) (Expr, error) {
+	for i, g := range groupBy {
+		if g.String() == e.String() {
+			return &slotRef{idx: i, name: e.String()}, nil
+		}
+	}
+	switch e := e.(type) {
+	case *AggregateCall:
+		for i, call := range calls {
+			if call.String() == e.String() {
+				return &slotRef{idx: len(groupBy) + i, name: e.String()}, nil
+			}
+		}
+		return nil, fmt.Errorf("aggregate %s not found", e)
+	case *ColumnRef:
+		return nil, fmt.Errorf("column %s must appear in the GROUP BY clause or be used in an aggregate function", e)
+	default:
+		return mapChildren(e, func(e Expr) (Expr, error) { return groupedExpr(e, groupBy, calls) })
+	}
+}
+
+// answer `SELECT min(col), max(col) ...` from the ends of the key range
+// when `col` leads the primary key or an index & WHERE only bounds `col`.
+// reports false when the query does not qualify.
+func (q *query) minMaxBySeek() (*Record, bool, error) {
+	s, tdef := q.stmt, q.tables[0]
+	if len(s.GroupBy) > 0 || s.Having != nil || len(s.Joins) > 0 {
+		return nil, false, nil
+	}
+	// the rows of a system table are not in the tree
+	if systemTableOf(tdef) != nil {
+		return nil, false, nil
+	}
+	col := ""
+	for _, item := range s.Items {
+		call, ok := item.Expr.(*AggregateCall)
+		if !ok || (call.Func != "min" && call.Func != "max") {
+			return nil, false, nil
+		}
+		ref, ok := call.Arg.(*ColumnRef)
+		if !ok || ColIndex(tdef, ref.Name) < 0 || !leadsKey(tdef, ref.Name) {
+			return nil, false, nil
+		}
+		if col != "" && col != ref.Name {
+			return nil, false, nil
+		}
+		col = ref.Name
+	}
+	conds := splitAnd(q.where)
+	for _, cond := range conds {
+		if c, _, val, ok := rangeTerm(cond); !ok || baseColumn(tdef, c) != col ||
+			val.Type != tdef.Types[ColIndex(tdef, col)] {
+			return nil, false, nil
+		}
+	}
+	ranges, _ := columnRanges(tdef, conds, col)
+
+	rec := &Record{}
+	for _, item := range s.Items {
+		call := item.Expr.(*AggregateCall)
+		v := Value{Type: TYPE_NULL}
+		if len(ranges) > 0 { // none when the bounds contradict
+			r := ranges[0]
+			r.desc = call.Func == "max"
+			sc, err := rangeScanner(q.db, tdef, &q.reader.Tree, r)
+			if err != nil {
+				return nil, false, err
+			}
+			if sc.Valid() {
+				v = scanLeadingValue(sc, tdef.Types[ColIndex(tdef, col)])
+			}
+		}
+		rec.Cols = append(rec.Cols, item.name())
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, true, nil
+}
+
+// the leading key column at the scanner position, decoded from the key
+// without reading the row
+func scanLeadingValue(sc *Scanner, typ uint32) Value {
+	key, _ := sc.iter.Deref()
+	vals := []Value{{Type: typ}}
+	decodeValues(key[4:], vals)
+	return copyValues(vals)[0]
+}
@@ -29,6 +29,14 @@ type BTree struct {
 	get func(uint64) BNode // dereference the page number (pointer)
 	new func(BNode) uint64 // create a new page
 	del func(uint64)       // de-allocate the page
+	// optional, reports the key range a scan is about to read
+	onRead func(start, end []byte)
+}
+
+func (tree *BTree) trackRead(start, end []byte) {
+	if tree.onRead != nil {
+		tree.onRead(start, end)
+	}
 }
 
 func (tree *BTree) Insert(key, val []byte) error {
@@ -279,19 +287,38 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	right := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(left, right, old)
 	if left.nbytes() <= BTREE_PAGE_SIZE {
+		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right}
 	}
 	leftLeft := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(leftLeft, middle, left)
 	assertWithSrc(leftLeft.nbytes() <= BTREE_PAGE_SIZE, "Failed in nodeSplit3")
-	return 3, [3]BNode{left, middle, right}
+	return 3, [3]BNode{leftLeft, middle, right}
 }
 
+// split an oversized node in 2, the right half always fits in a page
 func nodeSplit2(left, right, old BNode) {
-	midIndex := old.nKeys() / 2
-	nodeAppendRange(left, old, 0, 0, midIndex)
-	nodeAppendRange(right, old, 0, midIndex, old.nKeys()-1)
+	nleft := old.nKeys() / 2
+	leftBytes := func() uint16 {
+		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+	}
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	for nleft > 1 && leftBytes() > BTREE_PAGE_SIZE {
+		nleft--
+	}
+	for rightBytes() > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	assertWithSrc(nleft >= 1 && nleft < old.nKeys(), "Failed in nodeSplit2")
+	nright := old.nKeys() - nleft
+
+	left.setHeader(old.bNodeType(), nleft)
+	right.setHeader(old.bNodeType(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
 }
 
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
@@ -408,7 +435,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: // right
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
+		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0:
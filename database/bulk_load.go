@@ -0,0 +1,342 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bulk Loading
+// the rows of an empty table & the entries of its indexes are sorted by key
+// & packed into leaves from left to right, each level of internal nodes is
+// made of the first keys of the level below. the keys of the table & of
+// each index fall between two adjacent keys of the tree, so only the nodes
+// on the path to that spot are rewritten around them, without the per key
+// lookups & path copies of `Insert`.
+
+// the share of a page filled by a bulk load, the rest is left for updates
+const DEFAULT_FILL_FACTOR = 0.9
+
+var ErrTableNotEmpty = errors.New("bulk load requires an empty table")
+
+// load the rows into the empty table `table` in a single commit. the rows
+// are sorted by primary key first if needed. `fill` is the share of each
+// page to fill, between 0.5 & 1, 0 for DEFAULT_FILL_FACTOR.
+func (db *DB) BulkLoad(table string, rows []Record, fill float64) error {
+	if fill == 0 {
+		fill = DEFAULT_FILL_FACTOR
+	}
+	if fill < 0.5 || fill > 1 {
+		return fmt.Errorf("fill factor must be between 0.5 and 1, got %g", fill)
+	}
+	if err := writableTableCheck(table); err != nil {
+		return err
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	tdef := GetTableDef(db, table, &reader.Tree)
+	db.kv.EndRead(&reader)
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	entries, err := bulkEntries(tdef, rows)
+	if err != nil {
+		return err
+	}
+	// the key ranges of the table & of its indexes
+	var ranges []keyRange
+	for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefix...) {
+		ranges = append(ranges, keyRange{
+			start: encodeKey(nil, prefix, nil),
+			end:   encodeKey(nil, prefix+1, nil),
+		})
+	}
+	return db.kv.bulkLoad(entries, ranges, fill)
+}
+
+// the KV pairs of the rows & of their index entries, in key order
+func bulkEntries(tdef *TableDef, rows []Record) ([]kvWrite, error) {
+	type row struct {
+		key  []byte
+		vals []Value
+	}
+	sorted := make([]row, len(rows))
+	for i, rec := range rows {
+		vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		for j, v := range vals {
+			if err := checkColumnValue(tdef, j, v); err != nil {
+				return nil, fmt.Errorf("row %d: %w", i+1, err)
+			}
+		}
+		sorted[i] = row{key: encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys]), vals: vals}
+	}
+	less := func(i, j int) bool { return bytes.Compare(sorted[i].key, sorted[j].key) < 0 }
+	if !sort.SliceIsSorted(sorted, less) {
+		sort.SliceStable(sorted, less)
+	}
+
+	var entries []kvWrite
+	for i, r := range sorted {
+		if i > 0 && bytes.Equal(sorted[i-1].key, r.key) {
+			return nil, fmt.Errorf("duplicate primary key %s", formatValues(r.vals[:tdef.PKeys]))
+		}
+		val := encodeValues(nil, r.vals[tdef.PKeys:])
+		if len(r.key) > BTREE_MAX_KEY_SIZE || len(val) > BTREE_MAX_VAL_SIZE {
+			return nil, fmt.Errorf("row %s is too large", formatValues(r.vals[:tdef.PKeys]))
+		}
+		entries = append(entries, kvWrite{key: r.key, val: val})
+	}
+	// the index entries include the primary key, so they are unique
+	for i := range tdef.Indexes {
+		keys := make([][]byte, len(sorted))
+		for j, r := range sorted {
+			keys[j] = indexKey(tdef, i, r.vals)
+			if len(keys[j]) > BTREE_MAX_KEY_SIZE {
+				return nil, fmt.Errorf("index key of row %s is too large", formatValues(r.vals[:tdef.PKeys]))
+			}
+		}
+		sort.Slice(keys, func(a, b int) bool { return bytes.Compare(keys[a], keys[b]) < 0 })
+		for _, key := range keys {
+			entries = append(entries, kvWrite{key: key})
+		}
+	}
+	// each run has its own prefix, ordering them orders all the keys
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key[:4], entries[j].key[:4]) < 0
+	})
+	return entries, nil
+}
+
+func formatValues(vals []Value) string {
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		out[i] = formatValue(v)
+	}
+	return "(" + strings.Join(out, ", ") + ")"
+}
+
+// add the sorted `entries` to the latest tree, which has no keys in
+// `ranges`. each range of entries is spliced in on its own.
+func (kv *KV) bulkLoad(entries []kvWrite, ranges []keyRange, fill float64) (err error) {
+	start := time.Now()
+	defer func() { kv.metrics.commit(start, err) }()
+	kv.lockWriter()
+	defer kv.writer.Unlock()
+	tx := &KVTX{kv: kv}
+	kv.beginApply(tx)
+	if tx.Tree.root != 0 {
+		for _, r := range ranges {
+			iter := tx.Tree.Seek(r.start, CMP_GE)
+			if !iter.Valid() {
+				continue
+			}
+			key, _ := iter.Deref()
+			if bytes.Compare(key, r.start) >= 0 && bytes.Compare(key, r.end) <= 0 {
+				return ErrTableNotEmpty
+			}
+		}
+	}
+
+	limit := int(fill * BTREE_PAGE_SIZE)
+	if tx.Tree.root == 0 {
+		b := &treeBuilder{tree: &tx.Tree, limit: limit}
+		b.add(0, nil, nil, 0) // the dummy key that makes the tree cover the key space
+		for _, e := range entries {
+			b.add(0, e.key, e.val, 0)
+		}
+		tx.Tree.root = b.finish()
+		return kv.publish(tx, commitRecord{ranges: ranges})
+	}
+	for _, r := range ranges {
+		lo := sort.Search(len(entries), func(i int) bool { return bytes.Compare(entries[i].key, r.start) >= 0 })
+		hi := sort.Search(len(entries), func(i int) bool { return bytes.Compare(entries[i].key, r.end) >= 0 })
+		if lo < hi {
+			spliceRun(&tx.Tree, entries[lo:hi], limit)
+		}
+	}
+	return kv.publish(tx, commitRecord{ranges: ranges})
+}
+
+// insert the sorted `entries`, which all go between the same two adjacent
+// keys of the tree. the nodes on the path to them are replaced by nodes
+// holding their keys before & after the entries, the rest is kept.
+func spliceRun(tree *BTree, entries []kvWrite, limit int) {
+	// the path from the root, with the position of the child or key
+	// preceding the entries in each node
+	var path []BNode
+	var ptrs []uint64
+	var pos []uint16
+	for ptr := tree.root; ; {
+		node := tree.get(ptr)
+		i := nodeLookupLE(node, entries[0].key)
+		path, ptrs, pos = append(path, node), append(ptrs, ptr), append(pos, i)
+		if node.bNodeType() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(i)
+	}
+
+	// the node at level `h` of the builder is path[top-h]
+	top := len(path) - 1
+	b := &treeBuilder{tree: tree, limit: limit, levels: make([]builderLevel, top+1)}
+	for h := top; h >= 0; h-- {
+		b.levels[h].size = HEADER
+		node, end := path[top-h], pos[top-h]
+		if h == 0 {
+			end++ // the key itself stays on the left
+		}
+		for i := uint16(0); i < end; i++ {
+			b.add(h, node.getKey(i), node.getVal(i), node.getPtr(i))
+		}
+	}
+	for _, e := range entries {
+		b.add(0, e.key, e.val, 0)
+	}
+	for h := 0; h <= top; h++ {
+		node := path[top-h]
+		for i := pos[top-h] + 1; i < node.nKeys(); i++ {
+			b.add(h, node.getKey(i), node.getVal(i), node.getPtr(i))
+		}
+		if h < top {
+			b.flush(h)
+		}
+	}
+	for _, ptr := range ptrs {
+		tree.del(ptr)
+	}
+	tree.root = b.finish()
+}
+
+// builds a tree bottom-up from keys added in order
+type treeBuilder struct {
+	tree   *BTree
+	limit  int            // the bytes a node is filled up to
+	levels []builderLevel // the node being filled at each level, leaves first
+}
+
+type builderLevel struct {
+	keys [][]byte
+	vals [][]byte
+	ptrs []uint64
+	size int // the bytes of the node
+}
+
+func (b *treeBuilder) add(level int, key, val []byte, ptr uint64) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, builderLevel{size: HEADER})
+	}
+	// pointer, offset, klen & vlen, then the pair
+	n := 8 + 2 + 4 + len(key) + len(val)
+	if lv := &b.levels[level]; len(lv.keys) > 0 && lv.size+n > b.limit {
+		b.flush(level)
+	}
+	lv := &b.levels[level]
+	lv.keys = append(lv.keys, key)
+	lv.vals = append(lv.vals, val)
+	lv.ptrs = append(lv.ptrs, ptr)
+	lv.size += n
+}
+
+// write the node of the level & add it to its parent
+func (b *treeBuilder) flush(level int) {
+	lv := &b.levels[level]
+	typ := uint16(BNODE_LEAF)
+	if level > 0 {
+		typ = BNODE_INODE
+	}
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(typ, uint16(len(lv.keys)))
+	for i := range lv.keys {
+		nodeAppendKV(node, uint16(i), lv.ptrs[i], lv.keys[i], lv.vals[i])
+	}
+	first := lv.keys[0]
+	*lv = builderLevel{size: HEADER}
+	b.add(level+1, first, nil, b.tree.new(node))
+}
+
+// write the remaining nodes, returns the root
+func (b *treeBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		lv := b.levels[level]
+		if level > 0 && level == len(b.levels)-1 && len(lv.keys) == 1 {
+			return lv.ptrs[0]
+		}
+		if len(lv.keys) > 0 {
+			b.flush(level)
+		}
+	}
+}
+
+// LOAD table FROM 'file' [FILLFACTOR percent]
+// each line of the file holds the values of a row in column order, as in
+// the VALUES of INSERT
+type LoadStmt struct {
+	Table      string
+	File       string
+	FillFactor int // percent, 0 for the default
+}
+
+func (s *LoadStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if tx != nil {
+		return nil, fmt.Errorf("LOAD cannot run inside a transaction")
+	}
+	rows, err := readLoadFile(db, s.Table, s.File)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.BulkLoad(s.Table, rows, float64(s.FillFactor)/100); err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: rowsMessage(len(rows), "loaded"), RowsAffected: len(rows)}, nil
+}
+
+func readLoadFile(db *DB, table, path string) ([]Record, error) {
+	if err := writableTableCheck(table); err != nil {
+		return nil, err
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	tdef := GetTableDef(db, table, &reader.Tree)
+	db.kv.EndRead(&reader)
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LOAD: %w", err)
+	}
+	defer f.Close()
+
+	var rows []Record
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		vals, err := parseValues(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if len(vals) != len(tdef.Cols) {
+			return nil, fmt.Errorf("%s:%d: expected %d values, got %d", path, line, len(tdef.Cols), len(vals))
+		}
+		rows = append(rows, Record{Cols: tdef.Cols, Vals: vals})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("LOAD: %w", err)
+	}
+	return rows, nil
+}
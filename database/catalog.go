@@ -0,0 +1,202 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// System Tables
+// read-only views of the catalog, queried like any other table. their rows
+// are made from the table definitions of the snapshot being read, in
+// primary key order.
+//
+//	@tables   name, columns, primary_key, indexes, prefix
+//	@columns  table_name, position, name, type, primary_key
+//	@indexes  table_name, position, columns, prefix (position 0 is the primary key)
+
+type systemTable struct {
+	def  *TableDef
+	rows func(tables []*TableDef) [][]Value
+}
+
+var systemTables = map[string]*systemTable{
+	"@tables": {
+		def: &TableDef{
+			Name:  "@tables",
+			Types: []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_INT64},
+			Cols:  []string{"name", "columns", "primary_key", "indexes", "prefix"},
+			PKeys: 1,
+		},
+		rows: tablesRows,
+	},
+	"@columns": {
+		def: &TableDef{
+			Name:  "@columns",
+			Types: []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+			Cols:  []string{"table_name", "position", "name", "type", "primary_key"},
+			PKeys: 2,
+		},
+		rows: columnsRows,
+	},
+	"@indexes": {
+		def: &TableDef{
+			Name:  "@indexes",
+			Types: []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+			Cols:  []string{"table_name", "position", "columns", "prefix"},
+			PKeys: 2,
+		},
+		rows: indexesRows,
+	},
+}
+
+// the system table `tdef` is the definition of, nil for the other tables
+func systemTableOf(tdef *TableDef) *systemTable {
+	if sys := systemTables[tdef.Name]; sys != nil && sys.def == tdef {
+		return sys
+	}
+	return nil
+}
+
+// a stored table or a system table, nil if there is neither
+func lookupTable(db *DB, name string, tree *BTree) *TableDef {
+	if sys := systemTables[name]; sys != nil {
+		return sys.def
+	}
+	return GetTableDef(db, name, tree)
+}
+
+func bytesValue(s string) Value {
+	return Value{Type: TYPE_BYTES, Str: []byte(s)}
+}
+
+func intValue(n int) Value {
+	return Value{Type: TYPE_INT64, I64: int64(n)}
+}
+
+func tablesRows(tables []*TableDef) [][]Value {
+	var rows [][]Value
+	for _, tdef := range tables {
+		rows = append(rows, []Value{
+			bytesValue(tdef.Name),
+			intValue(len(tdef.Cols)),
+			bytesValue(strings.Join(tdef.Cols[:tdef.PKeys], ", ")),
+			intValue(len(tdef.Indexes)),
+			intValue(int(tdef.Prefix)),
+		})
+	}
+	return rows
+}
+
+func columnsRows(tables []*TableDef) [][]Value {
+	var rows [][]Value
+	for _, tdef := range tables {
+		for i, col := range tdef.Cols {
+			pk := 0
+			if i < tdef.PKeys {
+				pk = i + 1
+			}
+			rows = append(rows, []Value{
+				bytesValue(tdef.Name), intValue(i + 1), bytesValue(col), bytesValue(typeNames[tdef.Types[i]]), intValue(pk),
+			})
+		}
+	}
+	return rows
+}
+
+func indexesRows(tables []*TableDef) [][]Value {
+	var rows [][]Value
+	for _, tdef := range tables {
+		rows = append(rows, []Value{
+			bytesValue(tdef.Name), intValue(0), bytesValue(strings.Join(tdef.Cols[:tdef.PKeys], ", ")), intValue(int(tdef.Prefix)),
+		})
+		for i, index := range tdef.Indexes {
+			rows = append(rows, []Value{
+				bytesValue(tdef.Name), intValue(i + 1), bytesValue(strings.Join(index, ", ")), intValue(int(tdef.IndexPrefix[i])),
+			})
+		}
+	}
+	return rows
+}
+
+// the rows of a system table as of the snapshot
+func (sys *systemTable) read(db *DB, tree *BTree) ([][]Value, error) {
+	tables, err := listTables(db, tree)
+	if err != nil {
+		return nil, err
+	}
+	return sys.rows(tables), nil
+}
+
+// the rows of a system table, made when the query opens it
+type valuesSource struct {
+	rows [][]Value
+}
+
+func (src *valuesSource) next() ([]Value, error) {
+	if len(src.rows) == 0 {
+		return nil, nil
+	}
+	row := src.rows[0]
+	src.rows = src.rows[1:]
+	return row, nil
+}
+
+// SHOW TABLES | SHOW INDEXES [FROM table] | DESCRIBE table | SHOW CONFIG
+type ShowStmt struct {
+	What  string // "tables", "indexes", "describe" or "config"
+	Table string
+}
+
+func (s *ShowStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if s.What == "config" {
+		return showConfig(db), nil
+	}
+	res := &StatementResult{Records: []*Record{}}
+	err := withReader(db, tx, func(reader *KVReader) error {
+		tables, err := listTables(db, &reader.Tree)
+		if err != nil {
+			return err
+		}
+		if s.Table != "" {
+			tdef := GetTableDef(db, s.Table, &reader.Tree)
+			if tdef == nil || strings.HasPrefix(tdef.Name, "@") {
+				return fmt.Errorf("table not found: %s", s.Table)
+			}
+			tables = []*TableDef{tdef}
+		}
+		switch s.What {
+		case "tables":
+			addRecords(res, systemTables["@tables"], tablesRows(tables), "name", "columns", "primary_key", "indexes")
+		case "indexes":
+			addRecords(res, systemTables["@indexes"], indexesRows(tables), "table_name", "position", "columns", "prefix")
+		case "describe":
+			addRecords(res, systemTables["@columns"], columnsRows(tables), "name", "type", "primary_key")
+			var lines []string
+			for _, row := range indexesRows(tables) {
+				kind := "primary key"
+				if row[1].I64 > 0 {
+					kind = fmt.Sprintf("index %d", row[1].I64)
+				}
+				lines = append(lines, fmt.Sprintf("%s: (%s), prefix %d", kind, row[2].Str, row[3].I64))
+			}
+			res.Message = strings.Join(lines, "\n")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// the records of the rows, with the columns `cols` of the system table
+func addRecords(res *StatementResult, sys *systemTable, rows [][]Value, cols ...string) {
+	for _, row := range rows {
+		rec := &Record{}
+		for _, col := range cols {
+			rec.Cols = append(rec.Cols, col)
+			rec.Vals = append(rec.Vals, row[ColIndex(sys.def, col)])
+		}
+		res.Records = append(res.Records, rec)
+	}
+}
@@ -0,0 +1,288 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// exit codes of the process
+const (
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1 // a statement failed
+	EXIT_USAGE   = 2 // bad flags or the database could not be opened
+)
+
+type Options struct {
+	Path   string // the database file, the config's when empty
+	Config string // -config, the config file, DEFAULT_CONFIG_FILE if it exists
+	// -read-only, share the file with other read-only processes
+	ReadOnly bool
+	Command  string // -c, statements to run instead of reading stdin
+	File     string // -f, a script to run instead of reading stdin, "-" for stdin
+	Format   string // -format, the output format, tsv or table by default
+	Metrics  string // -metrics, the address to serve the metrics on
+	// -log-level, -log-format & -log-file, the logs go to stderr by default
+	LogLevel  slog.Level
+	LogFormat string
+	LogFile   string
+	SlowQuery time.Duration // -slow-query, the threshold of the slow query log
+	// -slow-query was given, so that 0 turns off the log of the config too
+	SlowQuerySet bool
+	// prompts & the welcome message, when false the first error ends the run
+	Interactive bool
+}
+
+// parse the command line, `atomixdb [-db file] [-config file] [-c statements | -f script] [file]`.
+// the errors are printed with the usage.
+func ParseFlags(args []string) (Options, error) {
+	opts := Options{}
+	fs := flag.NewFlagSet("atomixdb", flag.ContinueOnError)
+	fs.StringVar(&opts.Path, "db", "", "the database `file` (default "+fileName+")")
+	fs.StringVar(&opts.Config, "config", "", "read the settings from the JSON `file` (default "+DEFAULT_CONFIG_FILE+")")
+	fs.BoolVar(&opts.ReadOnly, "read-only", false, "open the database without writing, alongside other read-only processes")
+	fs.StringVar(&opts.Command, "c", "", "run the `statements`, separated by ;, and exit")
+	fs.StringVar(&opts.File, "f", "", "run the statements of the `script` and exit, - for stdin")
+	fs.StringVar(&opts.Metrics, "metrics", "", "serve Prometheus metrics at http://`addr`/metrics")
+	fs.StringVar(&opts.Format, "format", "", "the output `format`: "+strings.Join(outputFormats, ", "))
+	opts.LogLevel = slog.LevelWarn
+	fs.TextVar(&opts.LogLevel, "log-level", opts.LogLevel, "log at this `level` & above: debug, info, warn, error")
+	fs.StringVar(&opts.LogFormat, "log-format", "text", "the log `format`: text or json")
+	fs.StringVar(&opts.LogFile, "log-file", "", "append the logs to `file` instead of stderr")
+	fs.DurationVar(&opts.SlowQuery, "slow-query", 0, "log the statements taking at least `duration`, 0 for none")
+	// the flag errors & -h are reported by fs
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "slow-query" {
+			opts.SlowQuerySet = true
+		}
+	})
+	var err error
+	switch {
+	case fs.NArg() > 1:
+		err = fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args()[1:], " "))
+	case opts.Command != "" && opts.File != "":
+		err = errors.New("-c and -f cannot be used together")
+	case opts.LogFormat != "text" && opts.LogFormat != "json":
+		err = fmt.Errorf("unknown log format %q, expected text or json", opts.LogFormat)
+	case opts.Format != "":
+		err = checkOutputFormat(opts.Format)
+	}
+	if err == nil && fs.NArg() == 1 {
+		opts.Path = fs.Arg(0)
+	}
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return opts, err
+	}
+	opts.Interactive = opts.Command == "" && opts.File == "" && isTerminal(os.Stdin)
+	if opts.Format == "" {
+		opts.Format = OUTPUT_TSV
+		if opts.Interactive {
+			opts.Format = OUTPUT_TABLE
+		}
+	}
+	return opts, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// the statements of a terminal, a script or -c
+type session struct {
+	db          *DB
+	tx          *DBTX
+	commands    map[string]Command
+	in          *bufio.Reader
+	out         io.Writer // the results
+	errOut      io.Writer // the errors when not interactive
+	output      OutputOptions
+	interactive bool
+	name        string // the input, for the errors
+	line        int
+}
+
+func newSession(db *DB, in io.Reader, name string, interactive bool) *session {
+	format := OUTPUT_TSV
+	if interactive {
+		format = OUTPUT_TABLE
+	}
+	return &session{
+		db:          db,
+		commands:    RegisterCommands(),
+		in:          bufio.NewReader(in),
+		out:         os.Stdout,
+		errOut:      os.Stderr,
+		output:      OutputOptions{Format: format, Binary: BINARY_HEX},
+		interactive: interactive,
+		name:        name,
+	}
+}
+
+var errExit = errors.New("exit")
+
+// run the statements of the input until its end or `exit`, a transaction
+// left open is aborted. returns the exit code.
+func (s *session) run() int {
+	defer func() {
+		if s.tx != nil {
+			s.db.Abort(s.tx)
+			s.tx = nil
+		}
+	}()
+	for {
+		if s.interactive {
+			fmt.Fprint(s.out, "> ")
+		}
+		line, err := s.in.ReadString('\n')
+		if line == "" && err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Fprintln(s.errOut, "Error reading input:", err)
+				return EXIT_FAILURE
+			}
+			return EXIT_OK
+		}
+		s.line++
+		for _, stmt := range splitStatements(line) {
+			err := s.exec(stmt)
+			if errors.Is(err, errExit) {
+				return EXIT_OK
+			}
+			if err == nil {
+				continue
+			}
+			if s.interactive {
+				if errors.Is(err, ErrUnknownStatement) {
+					fmt.Fprintln(s.out, "Unknown command:", stmt)
+				} else {
+					fmt.Fprintln(s.out, "Error:", err)
+				}
+				continue
+			}
+			fmt.Fprintf(s.errOut, "%s:%d: %v\n", s.name, s.line, err)
+			return EXIT_FAILURE
+		}
+	}
+}
+
+// run a single statement or command
+func (s *session) exec(line string) error {
+	// a transaction aborted by a timeout is reported on the next command
+	tx := s.tx
+	if tx != nil {
+		if err := tx.StatementStart(); err != nil {
+			s.tx = nil
+			return err
+		}
+	}
+	err := s.dispatch(line)
+	if tx != nil && s.tx == tx {
+		if endErr := tx.StatementEnd(); endErr != nil {
+			s.tx = nil
+			if err == nil {
+				err = endErr
+			}
+		}
+	}
+	return err
+}
+
+func (s *session) dispatch(line string) error {
+	command := strings.ToLower(line)
+	var err error
+	switch command {
+	case "exit":
+		return errExit
+	case "begin":
+		s.tx, err = HandleBegin(s.db, s.tx)
+	case "begin read only":
+		s.tx, err = HandleBeginReadOnly(s.db, s.tx)
+	case "commit":
+		s.tx, err = HandleCommit(s.db, s.tx)
+	case "abort":
+		s.tx, err = HandleAbort(s.db, s.tx)
+	default:
+		if handler, ok := s.commands[command]; ok {
+			err := handler(s.in, s.db, s.tx)
+			if err != nil {
+				s.db.log().Info("command failed", "command", command, "err", err)
+			}
+			return err
+		}
+		return s.statement(line)
+	}
+	if err == nil && s.interactive {
+		fmt.Fprintln(s.out, transactionMessages[command])
+	}
+	return err
+}
+
+var transactionMessages = map[string]string{
+	"begin":           "Transaction started.",
+	"begin read only": "Read-only transaction started.",
+	"commit":          "Transaction committed successfully.",
+	"abort":           "Transaction aborted.",
+}
+
+func (s *session) statement(line string) error {
+	stmt, err := parseStatement(line)
+	if err != nil {
+		return err
+	}
+	if set, ok := stmt.(*SetStmt); ok {
+		if handled, err := s.set(set); handled {
+			return err
+		}
+	}
+	start := time.Now()
+	res, err := s.db.execStatement(stmt, line, s.tx)
+	if err != nil {
+		return err
+	}
+	writeResult(s.out, res, s.output, time.Since(start))
+	return nil
+}
+
+// the settings of the session, the others are the database's
+func (s *session) set(stmt *SetStmt) (bool, error) {
+	value := strings.ToLower(stmt.Value)
+	switch stmt.Name {
+	case "output":
+		if err := checkOutputFormat(value); err != nil {
+			return true, err
+		}
+		s.output.Format = value
+	case "footer":
+		switch value {
+		case "on", "true", "1":
+			s.output.Footer = true
+		case "off", "false", "0":
+			s.output.Footer = false
+		default:
+			return true, fmt.Errorf("footer must be on or off, got %q", stmt.Value)
+		}
+	case "binary_output":
+		if value != BINARY_HEX && value != BINARY_BASE64 {
+			return true, fmt.Errorf("binary_output must be %s or %s, got %q", BINARY_HEX, BINARY_BASE64, stmt.Value)
+		}
+		s.output.Binary = value
+	default:
+		return false, nil
+	}
+	// the output of a script is left to its results
+	if s.interactive {
+		fmt.Fprintf(s.out, "%s set to %s.\n", stmt.Name, value)
+	}
+	return true, nil
+}
@@ -3,11 +3,14 @@ package database
 import (
 	"atomixDB/database/helper"
 	"bufio"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 )
 
-type Command func(scanner *bufio.Reader, db *DB, currentTX *DBTX)
+type Command func(scanner *bufio.Reader, db *DB, currentTX *DBTX) error
 
 type QueryType int
 
@@ -24,6 +27,8 @@ type QueryRequest struct {
 	endVals   []string
 	queryType QueryType
 	response  chan GetResponse
+	// snapshot to read from, a fresh one is taken when nil
+	reader *KVReader
 }
 
 type GetResponse struct {
@@ -39,16 +44,14 @@ func RegisterCommands() map[string]Command {
 		"delete": HandleDelete,
 		"get":    HandleGet,
 		"update": HandleUpdate,
-		"begin":  func(scanner *bufio.Reader, db *DB, currentTX *DBTX) {},
-		"abort":  func(scanner *bufio.Reader, db *DB, currentTX *DBTX) {},
-		"commit": func(scanner *bufio.Reader, db *DB, currentTX *DBTX) {},
-		"help": func(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+		"help": func(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 			helper.PrintWelcomeMessage(false)
+			return nil
 		},
 	}
 }
 
-func HandleCreate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+func HandleCreate(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 	td := helper.GetTableInput(scanner)
 	var writer KVTX
 	tdef := &TableDef{
@@ -60,24 +63,24 @@ func HandleCreate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 		IndexPrefix: make([]uint32, 0),
 	}
 	if currentTX != nil {
-		if err := db.TableNew(tdef, &writer); err != nil {
-			fmt.Println("Error creating table: ", err)
-		} else {
-			fmt.Printf("Table '%s' created successfully.\n", td.Name)
+		if err := currentTX.TableNew(tdef); err != nil {
+			return fmt.Errorf("create table: %w", err)
 		}
 	} else {
 		db.kv.Begin(&writer)
 		if err := db.TableNew(tdef, &writer); err != nil {
 			db.kv.Abort(&writer)
-			fmt.Println("Error creating table: ", err)
-		} else {
-			db.kv.Commit(&writer)
-			fmt.Printf("Table '%s' created successfully.\n", td.Name)
+			return fmt.Errorf("create table: %w", err)
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			return fmt.Errorf("create table: %w", err)
 		}
 	}
+	fmt.Printf("Table '%s' created successfully.\n", td.Name)
+	return nil
 }
 
-func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 	tableName := helper.GetTableName(scanner)
 
 	rec := Record{
@@ -86,13 +89,9 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	var writer KVTX
-	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	tdef := getTableDefTX(db, tableName, currentTX)
 	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
-		return
+		return fmt.Errorf("table not found: %s", tableName)
 	}
 
 	for i, col := range tdef.Cols {
@@ -124,32 +123,42 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	if currentTX != nil {
-		if inserted, err := currentTX.Set(tableName, rec, MODE_INSERT_ONLY); err != nil {
-			fmt.Println("Failed to insert: ", err.Error())
-		} else if inserted {
-			fmt.Println("Record inserted successfully.")
-		} else {
-			fmt.Println("Failed to insert record.")
+		inserted, err := currentTX.Set(tableName, rec, MODE_INSERT_ONLY)
+		if err != nil {
+			return fmt.Errorf("insert: %w", err)
+		}
+		if !inserted {
+			return fmt.Errorf("insert: %w", ErrRecordExists)
 		}
 	} else {
 		db.kv.Begin(&writer)
-		if inserted, err := db.Insert(tableName, rec, &writer); err != nil {
-			db.kv.Abort(&writer)
-			fmt.Println("Failed to insert: ", err.Error())
-		} else if inserted {
-			db.kv.Commit(&writer)
-			fmt.Println("Record inserted successfully.")
-		} else {
+		inserted, err := db.Insert(tableName, rec, &writer)
+		if err != nil || !inserted {
 			db.kv.Abort(&writer)
-			fmt.Println("Failed to insert record.")
+			if err == nil {
+				err = ErrRecordExists
+			}
+			return fmt.Errorf("insert: %w", err)
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			return fmt.Errorf("insert: %w", err)
 		}
 	}
+	fmt.Println("Record inserted successfully.")
+	return nil
 }
 
-func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 	responseChan := make(chan GetResponse, 1)
 	tableName := helper.GetTableName(scanner)
 
+	// inside a transaction read its working tree, so uncommitted
+	// writes of the same transaction are visible
+	var reader *KVReader
+	if currentTX != nil {
+		reader = &currentTX.kv.KVReader
+	}
+
 	fmt.Println("\nSelect query type:")
 	fmt.Println("1. Index lookup (primary/secondary index)")
 	fmt.Println("2. Range query")
@@ -199,6 +208,7 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				endVals:   endVals,
 				queryType: queryType,
 				response:  responseChan,
+				reader:    reader,
 			}, db)
 		})
 	case SingleRecord:
@@ -223,6 +233,7 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				startVals: startVals,
 				queryType: queryType,
 				response:  responseChan,
+				reader:    reader,
 			}, db)
 		})
 	default:
@@ -245,45 +256,39 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				startVals: startVals,
 				queryType: queryType,
 				response:  responseChan,
+				reader:    reader,
 			}, db)
 		})
 	}
 
 	response := <-responseChan
 	if response.err != nil {
-		fmt.Println("\nError:", response.err)
-		return
+		return fmt.Errorf("query: %w", response.err)
 	}
 	if !response.found {
 		fmt.Println("\nNo records found")
-		return
+		return nil
 	}
 	printRecords(response.records)
+	return nil
 }
 
-func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 	tableName := helper.GetTableName(scanner)
-	rec := Record{
-		Cols: []string{},
-		Vals: []Value{},
-	}
 
-	var writer KVTX
-	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	tdef := getTableDefTX(db, tableName, currentTX)
 	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
-		return
+		return fmt.Errorf("table not found: %s", tableName)
 	}
 
-	for i, col := range tdef.Cols {
+	// the row is found by its primary key alone
+	var pk []Value
+	for i, col := range tdef.Cols[:tdef.PKeys] {
 		var val Value
 		isValidInput := false
 
 		for !isValidInput {
-			fmt.Printf("Enter value for %s: ", col)
+			fmt.Printf("Enter primary key for %s: ", col)
 			valStr, _ := scanner.ReadString('\n')
 			valStr = strings.TrimSpace(valStr)
 
@@ -301,34 +306,25 @@ func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				}
 			}
 		}
-
-		rec.Cols = append(rec.Cols, col)
-		rec.Vals = append(rec.Vals, val)
+		pk = append(pk, val)
 	}
 
+	var old *Record
+	var err error
 	if currentTX != nil {
-		if deleted, err := currentTX.Delete(tableName, rec); err != nil {
-			fmt.Println("Failed to delete: ", err.Error())
-		} else if deleted {
-			fmt.Println("Record deleted successfully.")
-		} else {
-			fmt.Println("Failed to delete record.")
-		}
+		old, err = currentTX.DeleteByKey(tableName, pk...)
 	} else {
-		db.kv.Begin(&writer)
-		if deleted, err := db.Delete(tableName, rec, &writer); err != nil {
-			fmt.Println("Failed to delete: ", err.Error())
-		} else if deleted {
-			db.kv.Commit(&writer)
-			fmt.Println("Record deleted successfully.")
-		} else {
-			db.kv.Abort(&writer)
-			fmt.Println("Failed to delete record.")
-		}
+		old, err = db.DeleteByKey(tableName, pk...)
+	}
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
 	}
+	fmt.Println("Record deleted successfully.")
+	printRecord(*old)
+	return nil
 }
 
-func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) error {
 	tableName := helper.GetTableName(scanner)
 
 	rec := Record{
@@ -337,27 +333,28 @@ func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	var writer KVTX
-	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	tdef := getTableDefTX(db, tableName, currentTX)
 
 	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
-		return
+		return fmt.Errorf("table not found: %s", tableName)
 	}
 	for i, col := range tdef.Cols {
 		if i == 0 {
 			fmt.Printf("Enter primary key for %s: ", col)
 		} else {
-			fmt.Printf("Enter value for %s: ", col)
+			fmt.Printf("Enter value for %s (empty to keep): ", col)
 		}
 		var val Value
 		isValidInput := false
+		keep := false
 
 		for !isValidInput {
 			valStr, _ := scanner.ReadString('\n')
 			valStr = strings.TrimSpace(valStr)
+			if valStr == "" && i >= tdef.PKeys {
+				keep = true
+				break
+			}
 
 			if tdef.Types[i] == TYPE_BYTES {
 				val = Value{Type: TYPE_BYTES, Str: []byte(valStr)}
@@ -373,76 +370,89 @@ func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				}
 			}
 		}
+		if keep {
+			continue
+		}
 
 		rec.Cols = append(rec.Cols, col)
 		rec.Vals = append(rec.Vals, val)
 	}
+	// the whole row is printed after the update
+	row := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: append([]Value{}, rec.Vals[:tdef.PKeys]...)}
 
 	if currentTX != nil {
-		if updated, err := currentTX.Set(tableName, rec, MODE_UPDATE_ONLY); err != nil {
-			fmt.Println("Error while updating: ", err.Error())
-		} else if updated {
-			printRecord(rec)
-		} else {
-			fmt.Println("Failed to update record.")
+		updated, err := currentTX.Set(tableName, rec, MODE_UPDATE_ONLY)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
 		}
+		if !updated {
+			return fmt.Errorf("update: %w", ErrRecordNotFound)
+		}
+		currentTX.Get(tableName, &row)
 	} else {
 		db.kv.Begin(&writer)
-		if updated, err := db.Update(tableName, rec, &writer); err != nil {
-			db.kv.Abort(&writer)
-			fmt.Println("Error while updating: ", err.Error())
-		} else if updated {
-			db.kv.Commit(&writer)
-			printRecord(rec)
-		} else {
+		updated, err := db.Update(tableName, rec, &writer)
+		if err != nil || !updated {
 			db.kv.Abort(&writer)
-			fmt.Println("Failed to update record.")
+			if err == nil {
+				err = ErrRecordNotFound
+			}
+			return fmt.Errorf("update: %w", err)
+		}
+		db.Get(tableName, &row, &writer.KVReader)
+		if err := db.kv.Commit(&writer); err != nil {
+			return fmt.Errorf("update: %w", err)
 		}
 	}
+	printRecord(row)
+	return nil
 }
 
-func HandleBegin(scanner *bufio.Reader, db *DB, currentTX *DBTX) *DBTX {
+var ErrTXInProgress = errors.New("transaction already in progress, commit or abort the current transaction before starting a new one")
+var ErrNoTX = errors.New("no active transaction")
+
+func HandleBegin(db *DB, currentTX *DBTX) (*DBTX, error) {
 	if currentTX != nil {
-		fmt.Println("Transaction already in progress. Commit or abort the current transaction before starting a new one.")
-		return currentTX
+		return currentTX, ErrTXInProgress
 	}
-
 	tx := &DBTX{}
 	db.Begin(tx)
-	fmt.Println("Transaction started.")
-	return tx
+	return tx, nil
 }
 
-func HandleCommit(scanner *bufio.Reader, db *DB, currentTX *DBTX) *DBTX {
-	if currentTX == nil {
-		fmt.Println("No active transaction to commit.")
-		return nil
+func HandleBeginReadOnly(db *DB, currentTX *DBTX) (*DBTX, error) {
+	if currentTX != nil {
+		return currentTX, ErrTXInProgress
 	}
+	return db.BeginReadOnly(), nil
+}
 
+// the transaction is over even when the commit fails
+func HandleCommit(db *DB, currentTX *DBTX) (*DBTX, error) {
+	if currentTX == nil {
+		return nil, fmt.Errorf("commit: %w", ErrNoTX)
+	}
 	if err := db.Commit(currentTX); err != nil {
-		fmt.Printf("Failed to commit transaction: %v\n", err)
-		return currentTX
+		return nil, fmt.Errorf("failed to commit transaction, transaction aborted: %w", err)
 	}
-
-	fmt.Println("Transaction committed successfully.")
-	return nil
+	return nil, nil
 }
 
-func HandleAbort(scanner *bufio.Reader, db *DB, currentTX *DBTX) *DBTX {
+func HandleAbort(db *DB, currentTX *DBTX) (*DBTX, error) {
 	if currentTX == nil {
-		fmt.Println("No active transaction to abort.")
-		return nil
+		return nil, fmt.Errorf("abort: %w", ErrNoTX)
 	}
-
 	db.Abort(currentTX)
-	fmt.Println("Transaction aborted.")
-	return nil
+	return nil, nil
 }
 
 func processQueryRequest(req QueryRequest, db *DB) {
-	var reader KVReader
-	db.kv.BeginRead(&reader)
-	defer db.kv.EndRead(&reader)
+	reader := req.reader
+	if reader == nil {
+		reader = &KVReader{}
+		db.kv.BeginRead(reader)
+		defer db.kv.EndRead(reader)
+	}
 
 	tdef := GetTableDef(db, req.tableName, &reader.Tree)
 	if tdef == nil {
@@ -481,7 +491,7 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 
 	if req.queryType == SingleRecord {
-		found, err := db.Get(req.tableName, &startRecord, &reader)
+		found, err := db.Get(req.tableName, &startRecord, reader)
 		req.response <- GetResponse{
 			records: []*Record{&startRecord},
 			found:   found,
@@ -491,14 +501,14 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 
 	if req.queryType == TableScan {
-		results, err := db.QueryWithFilter(req.tableName, tdef, &startRecord)
+		results, err := db.QueryWithFilter(req.tableName, tdef, &startRecord, reader)
 		if err != nil {
 			req.response <- GetResponse{
 				records: nil,
 				found:   false,
 				err:     err,
 			}
-
+			return
 		}
 
 		req.response <- GetResponse{
@@ -525,7 +535,7 @@ func processQueryRequest(req QueryRequest, db *DB) {
 		endRecord.Cols[i] = col
 	}
 
-	records, err := db.GetRange(req.tableName, &startRecord, &endRecord, &reader)
+	records, err := db.GetRange(req.tableName, &startRecord, &endRecord, reader)
 	req.response <- GetResponse{
 		records: records,
 		found:   len(records) > 0,
@@ -533,6 +543,17 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 }
 
+// table definition as seen by the current transaction, if any
+func getTableDefTX(db *DB, tableName string, currentTX *DBTX) *TableDef {
+	if currentTX != nil {
+		return currentTX.tableDef(tableName)
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	return GetTableDef(db, tableName, &reader.Tree)
+}
+
 func verifyColumns(tdef *TableDef, cols []string) error {
 	for _, col := range cols {
 		found := false
@@ -555,11 +576,16 @@ func formatValue(v Value) string {
 		return fmt.Sprintf("%d", v.I64)
 	case 2:
 		return string(v.Str)
+	case TYPE_NULL:
+		return "NULL"
+	case TYPE_FLOAT64:
+		return strconv.FormatFloat(v.F64, 'f', -1, 64)
 	default:
 		return "Unknown"
 	}
 }
 
+// report the failure of an interactive command & log it
 func printRecord(record Record) {
 	if len(record.Cols) == 0 || len(record.Vals) == 0 {
 		fmt.Println("Empty record")
@@ -569,7 +595,7 @@ func printRecord(record Record) {
 	colWidths := make([]int, len(record.Cols))
 	for i, col := range record.Cols {
 		colWidths[i] = len(col)
-		valWidth := len(formatValue(record.Vals[i]))
+		valWidth := len(displayValue(record.Vals[i], BINARY_HEX))
 		if valWidth > colWidths[i] {
 			colWidths[i] = valWidth
 		}
@@ -583,7 +609,7 @@ func printRecord(record Record) {
 	fmt.Println(strings.Repeat("-", calculateTotalWidth(colWidths)))
 
 	for i, val := range record.Vals {
-		fmt.Printf("| %-*s ", colWidths[i], formatValue(val))
+		fmt.Printf("| %-*s ", colWidths[i], displayValue(val, BINARY_HEX))
 	}
 	fmt.Println("|")
 	fmt.Println(strings.Repeat("-", calculateTotalWidth(colWidths)))
@@ -598,43 +624,7 @@ func calculateTotalWidth(colWidths []int) int {
 }
 
 func printRecords(records []*Record) {
-	if len(records) == 0 {
-		fmt.Println("No records found")
-		return
-	}
-
-	colWidths := make([]int, len(records[0].Cols))
-	for _, record := range records {
-		for i, col := range record.Cols {
-
-			colWidths[i] = max(colWidths[i], len(col))
-
-			valWidth := len(formatValue(record.Vals[i]))
-			colWidths[i] = max(colWidths[i], valWidth)
-		}
-	}
-
-	border := "+"
-	for _, width := range colWidths {
-		border += strings.Repeat("-", width+2) + "+"
-	}
-
-	fmt.Println(border)
-	fmt.Print("|")
-	for i, col := range records[0].Cols {
-		fmt.Printf(" %-*s |", colWidths[i], col)
-	}
-	fmt.Println()
-	fmt.Println(border)
-
-	for _, record := range records {
-		fmt.Print("|")
-		for i, val := range record.Vals {
-			fmt.Printf(" %-*s |", colWidths[i], formatValue(val))
-		}
-		fmt.Println()
-	}
-	fmt.Println(border)
+	writeTable(os.Stdout, records, BINARY_HEX)
 }
 
 func max(a, b int) int {
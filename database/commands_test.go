@@ -1,12 +1,22 @@
 package database
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreate(t *testing.T) {
@@ -527,3 +537,2689 @@ func insertTestRecord(t *testing.T, db *DB, id int64) {
 func isEqual(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
+
+func TestReadOnlyTransaction(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+
+	tx := db.BeginReadOnly()
+	// committed after the snapshot was taken, must not be visible
+	insertTestRecord(t, db, 2)
+
+	rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 1}}}
+	if found, err := tx.Get("users", &rec); err != nil || !found {
+		t.Errorf("expected record 1 in snapshot, found=%v err=%v", found, err)
+	}
+	rec = Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 2}}}
+	if found, err := tx.Get("users", &rec); err != nil || found {
+		t.Errorf("expected record 2 to be invisible, found=%v err=%v", found, err)
+	}
+
+	scanner, err := tx.TableScanner("users")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	scanner.Start()
+	count := 0
+	for {
+		_, ok, recOK := scanner.Next()
+		if recOK {
+			count++
+		}
+		if !ok {
+			break
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 1 row in snapshot scan, got %d", count)
+	}
+
+	record := Record{
+		Cols: []string{"id", "name", "email"},
+		Vals: []Value{
+			{Type: TYPE_INT64, I64: 3},
+			{Type: TYPE_BYTES, Str: []byte("Jane")},
+			{Type: TYPE_BYTES, Str: []byte("jane@example.com")},
+		},
+	}
+	if _, err := tx.Set("users", record, MODE_INSERT_ONLY); !errors.Is(err, ErrReadOnlyTX) {
+		t.Errorf("expected ErrReadOnlyTX, got %v", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(db.kv.readers) != 0 {
+		t.Errorf("expected reader to be released, got %d readers", len(db.kv.readers))
+	}
+}
+
+func TestReadYourOwnWrites(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"id", "name", "email"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("failed to create test table: %v", err)
+	}
+	db.kv.Commit(&writer)
+
+	tx := &DBTX{}
+	db.Begin(tx)
+	defer db.Abort(tx)
+
+	record := Record{
+		Cols: []string{"id", "name", "email"},
+		Vals: []Value{
+			{Type: TYPE_INT64, I64: 7},
+			{Type: TYPE_BYTES, Str: []byte("Jane")},
+			{Type: TYPE_BYTES, Str: []byte("jane@example.com")},
+		},
+	}
+	if _, err := tx.Set("users", record, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  Record
+	}{
+		{
+			name: "primary key",
+			key:  Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 7}}},
+		},
+		{
+			name: "secondary index",
+			key:  Record{Cols: []string{"name"}, Vals: []Value{{Type: TYPE_BYTES, Str: []byte("Jane")}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := tx.Get("users", &tt.key)
+			if err != nil || !found {
+				t.Fatalf("expected uncommitted record, found=%v err=%v", found, err)
+			}
+			if email := tt.key.Get("email"); email == nil || string(email.Str) != "jane@example.com" {
+				t.Errorf("unexpected record: %+v", tt.key)
+			}
+		})
+	}
+
+	records, err := db.QueryWithFilter("users", tdef, &Record{
+		Cols: []string{"name"},
+		Vals: []Value{{Type: TYPE_BYTES, Str: []byte("Jane")}},
+	}, &tx.kv.KVReader)
+	if err != nil || len(records) != 1 {
+		t.Errorf("expected 1 filtered record, got %d err=%v", len(records), err)
+	}
+}
+
+func TestUncommittedTableDefs(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	ghost := func() *TableDef {
+		return &TableDef{Name: "ghost", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1}
+	}
+	row := *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("boo"))
+	tests := []struct {
+		name string
+		undo func(tx *DBTX)
+	}{
+		{"abort", func(tx *DBTX) { db.Abort(tx) }},
+		{"rollback to savepoint", func(tx *DBTX) {
+			if err := tx.RollbackTo("before"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Set("ghost", row, MODE_INSERT_ONLY); err == nil {
+				t.Error("expected the rolled back table to be gone in the transaction")
+			}
+			db.Abort(tx)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &DBTX{}
+			db.Begin(tx)
+			if err := tx.Savepoint("before"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.TableNew(ghost()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Set("ghost", row, MODE_INSERT_ONLY); err != nil {
+				t.Fatal(err)
+			}
+			tt.undo(tx)
+			if tdef := getTableDefTX(db, "ghost", nil); tdef != nil {
+				t.Errorf("expected no table after the rollback, got %+v", tdef)
+			}
+			if _, err := db.Exec("SELECT * FROM ghost", nil); err == nil {
+				t.Error("expected SELECT on the rolled back table to fail")
+			}
+		})
+	}
+
+	// committed, the definition is shared
+	tx := &DBTX{}
+	db.Begin(tx)
+	if err := tx.TableNew(ghost()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	cached := db.tables["ghost"]
+	db.mu.Unlock()
+	if cached == nil {
+		t.Error("expected the committed table in the cache")
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	setupTestTable(t, db)
+
+	tx := &DBTX{}
+	db.Begin(tx)
+	insert := func(id int64) {
+		record := Record{
+			Cols: []string{"id", "name", "email"},
+			Vals: []Value{
+				{Type: TYPE_INT64, I64: id},
+				{Type: TYPE_BYTES, Str: []byte("John")},
+				{Type: TYPE_BYTES, Str: []byte("john@example.com")},
+			},
+		}
+		if _, err := tx.Set("users", record, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("failed to insert %d: %v", id, err)
+		}
+	}
+
+	insert(1)
+	if err := tx.Savepoint("batch"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	insert(2)
+	insert(3)
+	if err := tx.RollbackTo("batch"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	insert(4)
+	if err := tx.Release("batch"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.RollbackTo("batch"); !errors.Is(err, ErrNoSavepoint) {
+		t.Errorf("expected ErrNoSavepoint, got %v", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for id, expected := range map[int64]bool{1: true, 2: false, 3: false, 4: true} {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		found, err := db.Get("users", &rec, &reader)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if found != expected {
+			t.Errorf("record %d: expected found=%v, got %v", id, expected, found)
+		}
+	}
+}
+
+func TestParseStatement(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    Statement
+		expectError bool
+	}{
+		{input: "SAVEPOINT sp1", expected: &SavepointStmt{Name: "sp1"}},
+		{input: "rollback to savepoint sp1;", expected: &RollbackToStmt{Name: "sp1"}},
+		{input: "RELEASE sp1", expected: &ReleaseStmt{Name: "sp1"}},
+		{input: "ROLLBACK sp1", expectError: true},
+		{input: "SAVEPOINT sp1 sp2", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			stmt, err := parseStatement(tt.input)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", stmt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprintf("%#v", stmt) != fmt.Sprintf("%#v", tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, stmt)
+			}
+		})
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+
+	record := func(id int64, name string) Record {
+		return Record{
+			Cols: []string{"id", "name", "email"},
+			Vals: []Value{
+				{Type: TYPE_INT64, I64: id},
+				{Type: TYPE_BYTES, Str: []byte(name)},
+				{Type: TYPE_BYTES, Str: []byte(name + "@example.com")},
+			},
+		}
+	}
+
+	t.Run("disjoint writes", func(t *testing.T) {
+		tx1, tx2 := &DBTX{}, &DBTX{}
+		db.Begin(tx1)
+		db.Begin(tx2)
+		if _, err := tx1.Set("users", record(20, "a"), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx2.Set("users", record(21, "b"), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx1); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx2); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("write-write conflict", func(t *testing.T) {
+		tx1, tx2 := &DBTX{}, &DBTX{}
+		db.Begin(tx1)
+		db.Begin(tx2)
+		if _, err := tx1.Set("users", record(30, "a"), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx2.Set("users", record(30, "b"), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx1); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx2); !errors.Is(err, ErrSerialization) {
+			t.Errorf("expected ErrSerialization, got %v", err)
+		}
+	})
+
+	t.Run("read-write conflict", func(t *testing.T) {
+		tx1, tx2 := &DBTX{}, &DBTX{}
+		db.Begin(tx1)
+		db.Begin(tx2)
+		key := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 1}}}
+		if found, err := tx1.Get("users", &key); err != nil || !found {
+			t.Fatalf("expected record, found=%v err=%v", found, err)
+		}
+		if _, err := tx2.Set("users", record(1, "changed"), MODE_UPDATE_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx2); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := tx1.Set("users", record(40, "a"), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Commit(tx1); !errors.Is(err, ErrSerialization) {
+			t.Errorf("expected ErrSerialization, got %v", err)
+		}
+	})
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for id, expected := range map[int64]string{1: "changed", 20: "a", 21: "b", 30: "a"} {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		found, err := db.Get("users", &rec, &reader)
+		if err != nil || !found {
+			t.Errorf("record %d: found=%v err=%v", id, found, err)
+			continue
+		}
+		if name := string(rec.Get("name").Str); name != expected {
+			t.Errorf("record %d: expected name %q, got %q", id, expected, name)
+		}
+	}
+	rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 40}}}
+	if found, _ := db.Get("users", &rec, &reader); found {
+		t.Error("expected the aborted insert to be rolled back")
+	}
+}
+
+func TestReopenAfterPageReuse(t *testing.T) {
+	db := setupTestDB(t)
+	setupTestTable(t, db)
+	for id := int64(1); id <= 50; id++ {
+		insertTestRecord(t, db, id)
+	}
+	for id := int64(1); id <= 50; id += 2 {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		if _, err := db.Delete("users", rec, &writer); err != nil {
+			t.Fatalf("failed to delete %d: %v", id, err)
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+	if db.kv.free.Total() == 0 {
+		t.Error("expected freed pages in the free list")
+	}
+	db.kv.Close()
+
+	db = setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	// reuse the free pages after reopening
+	for id := int64(100); id < 120; id++ {
+		insertTestRecord(t, db, id)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for id := int64(1); id < 120; id++ {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		found, err := db.Get("users", &rec, &reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := (id <= 50 && id%2 == 0) || id >= 100
+		if found != expected {
+			t.Errorf("record %d: expected found=%v, got %v", id, expected, found)
+		}
+	}
+}
+
+func TestFreeList(t *testing.T) {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	writes := 0
+	data := FreeListData{}
+	commit := func(version, minReader uint64, pop int, freed []uint64) []uint64 {
+		writes = 0
+		fl := FreeList{FreeListData: data, version: version, minReader: minReader}
+		fl.get = func(ptr uint64) BNode { return BNode{pages[ptr]} }
+		fl.new = func(node BNode) uint64 {
+			writes++
+			next++
+			pages[next-1] = node.data
+			return next - 1
+		}
+		fl.use = func(ptr uint64, node BNode) {
+			writes++
+			pages[ptr] = node.data
+		}
+		var popped []uint64
+		for i := 0; i < pop; i++ {
+			if ptr := fl.Pop(); ptr != 0 {
+				popped = append(popped, ptr)
+			}
+		}
+		fl.freed = append(fl.freed, freed...)
+		fl.addFreed()
+		data = fl.FreeListData
+		return popped
+	}
+
+	// more pages than a node holds, freed one commit at a time while an
+	// old reader keeps them from being reused
+	total := 3 * FREE_LIST_CAP
+	for i := 0; i < total; i++ {
+		commit(uint64(i+1), 0, 0, []uint64{uint64(10000 + i)})
+		if writes > 2 {
+			t.Fatalf("commit %d wrote %d free list pages", i, writes)
+		}
+	}
+	if data.Total() != total {
+		t.Fatalf("expected %d free pages, got %d", total, data.Total())
+	}
+
+	// the oldest first, the used up nodes are freed in turn
+	version := uint64(total + 1)
+	var popped []uint64
+	for len(popped) < total {
+		got := commit(version, version-1, 10, nil)
+		if len(got) == 0 {
+			t.Fatalf("no page popped after %d", len(popped))
+		}
+		if writes > 2 {
+			t.Fatalf("popping wrote %d free list pages", writes)
+		}
+		popped = append(popped, got...)
+		version++
+	}
+	for i, ptr := range popped[:total] {
+		if ptr != uint64(10000+i) {
+			t.Fatalf("pop %d: expected page %d, got %d", i, 10000+i, ptr)
+		}
+	}
+	// the nodes follow, freed after the pages they held
+	if len(popped) > total && popped[total] >= 10000 {
+		t.Errorf("expected a free list node, got page %d", popped[total])
+	}
+
+	// a freed page is not reused while a reader of an older version is open
+	commit(version, version-1, 0, []uint64{20000})
+	version++
+	for _, ptr := range commit(version, version-2, FREE_LIST_CAP, nil) {
+		if ptr == 20000 {
+			t.Error("reused a page visible to an open reader")
+		}
+	}
+	version++
+	got := commit(version, version-1, FREE_LIST_CAP, nil)
+	if len(got) == 0 || got[len(got)-1] != 20000 {
+		t.Errorf("expected page 20000 to be reused, got %v", got)
+	}
+}
+
+func TestOldFileFormat(t *testing.T) {
+	db := setupTestDB(t)
+	setupTestTable(t, db)
+	for id := int64(1); id <= 50; id++ {
+		insertTestRecord(t, db, id)
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	reachable := 0
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		reachable++
+		node := reader.Tree.get(ptr)
+		if node.bNodeType() == BNODE_INODE {
+			for i := uint16(0); i < node.nKeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	walk(reader.Tree.root)
+	db.kv.EndRead(&reader)
+	used := int(db.kv.page.flushed)
+	db.kv.Close()
+
+	setFormat := func(format uint64) {
+		fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		// the master page of an older format ends with the version
+		var tail [32]byte
+		binary.LittleEndian.PutUint64(tail[:8], format)
+		if _, err := fp.WriteAt(tail[:], 40); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setFormat(MASTER_FORMAT + 1)
+	kv := newKV(db.Path)
+	if err := kv.Open(); err == nil || !strings.Contains(err.Error(), "unsupported file format") {
+		t.Errorf("expected a newer format to be rejected, got %v", err)
+		kv.Close()
+	}
+
+	setFormat(0)
+	db = setupTestDB(t)
+	if free := db.kv.free.Total(); free != used-1-reachable {
+		t.Errorf("expected %d free pages, got %d", used-1-reachable, free)
+	}
+	insertTestRecord(t, db, 100)
+	if len(db.kv.free.unlisted) != 0 {
+		t.Error("expected the free pages to be listed by the commit")
+	}
+	db.kv.Close()
+
+	db = setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	if db.kv.free.Total() == 0 {
+		t.Error("expected the free list to be kept after reopening")
+	}
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for _, id := range []int64{1, 50, 100} {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		if found, err := db.Get("users", &rec, &reader); err != nil || !found {
+			t.Errorf("record %d: found=%v err=%v", id, found, err)
+		}
+	}
+}
+
+func TestTransactionTimeouts(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+
+	t.Run("Idle transaction is reaped", func(t *testing.T) {
+		db.SetTimeouts(TXTimeouts{Idle: 20 * time.Millisecond})
+		tx := &DBTX{}
+		db.Begin(tx)
+		time.Sleep(100 * time.Millisecond)
+
+		db.kv.mu.Lock()
+		readers := len(db.kv.readers)
+		db.kv.mu.Unlock()
+		if readers != 0 {
+			t.Errorf("expected the snapshot to be released, got %d readers", readers)
+		}
+		if err := tx.StatementStart(); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected ErrIdleTimeout, got %v", err)
+		}
+		// the snapshot is gone, the operations fail without a statement
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 1}}}
+		if _, err := tx.Get("users", &rec); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected ErrIdleTimeout on get, got %v", err)
+		}
+		if err := tx.Savepoint("s"); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected ErrIdleTimeout on savepoint, got %v", err)
+		}
+		if err := db.Commit(tx); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected ErrIdleTimeout on commit, got %v", err)
+		}
+	})
+
+	t.Run("Statements outside of a transaction are not reaped", func(t *testing.T) {
+		db.SetTimeouts(TXTimeouts{Idle: time.Nanosecond})
+		defer db.SetTimeouts(DefaultTXTimeouts)
+		err := inWriteTX(db, nil, func(tx *DBTX) error {
+			time.Sleep(20 * time.Millisecond)
+			rec := (&Record{}).AddInt64("id", 1001).AddStr("name", []byte("a")).AddStr("email", []byte("b"))
+			_, err := tx.Set("users", *rec, MODE_INSERT_ONLY)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := db.DeleteByKey("users", Value{Type: TYPE_INT64, I64: 1001}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Negative timeouts are rejected", func(t *testing.T) {
+		for _, text := range []string{"SET statement_timeout = '-5'", "SET idle_in_transaction_timeout = '-1s'"} {
+			if _, err := db.Exec(text, nil); err == nil || !strings.Contains(err.Error(), "invalid timeout") {
+				t.Errorf("%s: expected an invalid timeout, got %v", text, err)
+			}
+		}
+	})
+
+	t.Run("Active transaction is not reaped", func(t *testing.T) {
+		db.SetTimeouts(TXTimeouts{Idle: 50 * time.Millisecond})
+		tx := db.BeginReadOnly()
+		for i := 0; i < 4; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if err := tx.StatementStart(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := tx.StatementEnd(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := db.Commit(tx); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Statement timeout aborts", func(t *testing.T) {
+		db.SetTimeouts(TXTimeouts{Statement: 10 * time.Millisecond})
+		tx := &DBTX{}
+		db.Begin(tx)
+		if err := tx.StatementStart(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		record := Record{
+			Cols: []string{"id", "name", "email"},
+			Vals: []Value{
+				{Type: TYPE_INT64, I64: 1},
+				{Type: TYPE_BYTES, Str: []byte("John")},
+				{Type: TYPE_BYTES, Str: []byte("john@example.com")},
+			},
+		}
+		if _, err := tx.Set("users", record, MODE_INSERT_ONLY); !errors.Is(err, ErrStatementTimeout) {
+			t.Errorf("expected ErrStatementTimeout, got %v", err)
+		}
+		if err := tx.StatementEnd(); !errors.Is(err, ErrStatementTimeout) {
+			t.Errorf("expected ErrStatementTimeout, got %v", err)
+		}
+		db.Abort(tx)
+	})
+}
+
+func setupOrdersTable(t *testing.T, db *DB) {
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "orders",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "customer", "amount"},
+		PKeys:   1,
+		Indexes: [][]string{{"amount"}},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("failed to create orders table: %v", err)
+	}
+	rows := []struct {
+		customer string
+		amount   int64
+	}{{"ann", 30}, {"bob", 10}, {"ann", 50}, {"cid", 5}, {"bob", 40}}
+	for i, r := range rows {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("customer", []byte(r.customer)).AddInt64("amount", r.amount)
+		if _, err := db.Insert("orders", *rec, &writer); err != nil {
+			t.Fatalf("failed to insert order: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+}
+
+// runs a statement & formats the rows as "v1|v2|..."
+func queryRows(t *testing.T, db *DB, tx *DBTX, query string) []string {
+	t.Helper()
+	stmt, err := parseStatement(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	res, err := stmt.Exec(db, tx)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	rows := []string{}
+	for _, rec := range res.Records {
+		vals := make([]string, len(rec.Vals))
+		for i, v := range rec.Vals {
+			vals[i] = formatValue(v)
+		}
+		rows = append(rows, strings.Join(vals, "|"))
+	}
+	return rows
+}
+
+func TestAggregates(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"SELECT count(*), sum(amount), min(amount), max(amount), avg(amount) FROM orders", []string{"5|135|5|50|27"}},
+		{"SELECT customer, count(*), sum(amount) FROM orders GROUP BY customer", []string{"ann|2|80", "bob|2|50", "cid|1|5"}},
+		{"SELECT customer, sum(amount) FROM orders GROUP BY customer HAVING sum(amount) > 40", []string{"ann|80", "bob|50"}},
+		{"SELECT count(*) FROM orders WHERE amount >= 10 AND amount < 50", []string{"3"}},
+		{"SELECT max(amount) FROM orders WHERE amount < 40", []string{"30"}},
+		{"SELECT min(amount) FROM orders WHERE amount > 100", []string{"NULL"}},
+		{"SELECT avg(amount) FROM orders WHERE customer = 'bob'", []string{"25"}},
+		{"SELECT count(*) FROM orders WHERE id > 3", []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rows := queryRows(t, db, nil, tt.query)
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	t.Run("MIN/MAX by seek", func(t *testing.T) {
+		stmt, _ := parseStatement("SELECT min(amount), max(amount) FROM orders WHERE amount > 5")
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		q, err := stmt.(*SelectStmt).prepare(db, nil, &reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rec, ok, err := q.minMaxBySeek()
+		if err != nil || !ok {
+			t.Fatalf("expected the seek path, ok=%v err=%v", ok, err)
+		}
+		if got := formatValue(rec.Vals[0]) + "|" + formatValue(rec.Vals[1]); got != "10|50" {
+			t.Errorf("expected 10|50, got %s", got)
+		}
+		if fmt.Sprint(rec.Cols) != "[min(amount) max(amount)]" {
+			t.Errorf("unexpected columns %v", rec.Cols)
+		}
+		// the aliases name the columns as on the scan path
+		stmt, _ = parseStatement("SELECT max(amount) AS top FROM orders")
+		if q, err = stmt.(*SelectStmt).prepare(db, nil, &reader); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rec, ok, err = q.minMaxBySeek()
+		if err != nil || !ok {
+			t.Fatalf("expected the seek path, ok=%v err=%v", ok, err)
+		}
+		if fmt.Sprint(rec.Cols) != "[top]" || formatValue(rec.Vals[0]) != "50" {
+			t.Errorf("expected top = 50, got %v %v", rec.Cols, rec.Vals)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, query := range []string{
+			"SELECT customer, count(*) FROM orders",
+			"SELECT sum(customer) FROM orders",
+			"SELECT * FROM orders WHERE count(*) > 1",
+		} {
+			stmt, err := parseStatement(query)
+			if err == nil {
+				_, err = stmt.Exec(db, nil)
+			}
+			if err == nil {
+				t.Errorf("%s: expected an error", query)
+			}
+		}
+	})
+}
+
+func TestJoins(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	setupOrdersTable(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "payments",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64},
+		Cols:    []string{"id", "user_id", "amount"},
+		PKeys:   1,
+		Indexes: [][]string{{"user_id"}},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("failed to create payments table: %v", err)
+	}
+	for i, name := range []string{"ann", "bob", "dan"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("name", []byte(name)).AddStr("email", []byte(name+"@example.com"))
+		if _, err := db.Insert("users", *rec, &writer); err != nil {
+			t.Fatalf("failed to insert user: %v", err)
+		}
+	}
+	for i, p := range [][2]int64{{1, 100}, {1, 20}, {2, 7}} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddInt64("user_id", p[0]).AddInt64("amount", p[1])
+		if _, err := db.Insert("payments", *rec, &writer); err != nil {
+			t.Fatalf("failed to insert payment: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		// probes payments through the user_id index
+		{"SELECT u.name, p.amount FROM users u JOIN payments p ON p.user_id = u.id", []string{"ann|100", "ann|20", "bob|7"}},
+		{"SELECT u.name, p.amount FROM users AS u LEFT JOIN payments AS p ON u.id = p.user_id AND p.amount > 50",
+			[]string{"ann|100", "bob|NULL", "dan|NULL"}},
+		// customer & name are not indexed, hash join. orders are read in amount order.
+		{"SELECT o.id, u.email FROM orders o INNER JOIN users u ON u.name = o.customer WHERE o.amount > 20",
+			[]string{"1|ann@example.com", "5|bob@example.com", "3|ann@example.com"}},
+		{"SELECT u.name, count(p.id), sum(p.amount) FROM users u LEFT OUTER JOIN payments p ON p.user_id = u.id GROUP BY u.name",
+			[]string{"ann|2|120", "bob|1|7", "dan|0|NULL"}},
+		{"SELECT users.name, orders.amount FROM users JOIN orders ON orders.customer = users.name JOIN payments ON payments.amount = orders.amount",
+			[]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rows := queryRows(t, db, nil, tt.query)
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	stmt, _ := parseStatement("SELECT id FROM users u JOIN payments p ON p.user_id = u.id")
+	if _, err := stmt.Exec(db, nil); err == nil || !isEqual(err.Error(), "ambiguous") {
+		t.Errorf("expected an ambiguous column error, got %v", err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"SELECT id, amount FROM orders ORDER BY amount DESC", []string{"3|50", "5|40", "1|30", "2|10", "4|5"}},
+		{"SELECT id FROM orders WHERE id > 2 ORDER BY id DESC", []string{"5", "4", "3"}},
+		{"SELECT customer, amount FROM orders ORDER BY customer, amount DESC",
+			[]string{"ann|50", "ann|30", "bob|40", "bob|10", "cid|5"}},
+		{"SELECT customer, sum(amount) FROM orders GROUP BY customer ORDER BY sum(amount) DESC",
+			[]string{"ann|80", "bob|50", "cid|5"}},
+		{"SELECT id FROM orders WHERE amount < 35 ORDER BY customer DESC, id", []string{"4", "2", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rows := queryRows(t, db, nil, tt.query)
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	t.Run("Index order", func(t *testing.T) {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		for query, expected := range map[string]bool{
+			"SELECT id FROM orders ORDER BY amount DESC":                  true,
+			"SELECT id FROM orders WHERE amount > 10 ORDER BY amount, id": true,
+			"SELECT id FROM orders ORDER BY customer":                     false,
+			"SELECT id FROM orders WHERE id = 1 ORDER BY amount":          false,
+		} {
+			stmt, _ := parseStatement(query)
+			sel := stmt.(*SelectStmt)
+			q, err := sel.prepare(db, nil, &reader)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			keys, _ := bindOrder(sel.OrderBy, func(e Expr) (Expr, error) { return bindExpr(e, q.sch) })
+			if got := q.useIndexOrder(keys); got != expected {
+				t.Errorf("%s: expected index order %v, got %v", query, expected, got)
+			}
+		}
+	})
+
+	t.Run("External sort", func(t *testing.T) {
+		s := &externalSorter{desc: []bool{true}, budget: 4096}
+		defer s.close()
+		for i := 0; i < 1000; i++ {
+			key := []Value{{Type: TYPE_INT64, I64: int64(i % 100)}}
+			vals := []Value{{Type: TYPE_INT64, I64: int64(i)}, {Type: TYPE_BYTES, Str: []byte(fmt.Sprint("row", i))}}
+			if err := s.add(key, vals); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if len(s.runs) == 0 {
+			t.Fatal("expected the sort to spill runs")
+		}
+		names := []string{}
+		for _, f := range s.runs {
+			names = append(names, f.Name())
+		}
+		var got []int64
+		err := s.merge(func(vals []Value) error {
+			got = append(got, vals[0].I64)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != 1000 {
+			t.Fatalf("expected 1000 rows, got %d", len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			a, b := got[i-1], got[i]
+			// descending by key, stable within a key
+			if a%100 < b%100 || (a%100 == b%100 && a > b) {
+				t.Fatalf("rows out of order at %d: %d, %d", i, a, b)
+			}
+		}
+		s.close()
+		for _, name := range names {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed", name)
+			}
+		}
+	})
+
+	t.Run("Spilling query", func(t *testing.T) {
+		db.SetSortMemory(1024)
+		defer db.SetSortMemory(0)
+		rows := queryRows(t, db, nil, "SELECT id FROM orders ORDER BY customer DESC, amount")
+		if fmt.Sprint(rows) != "[4 2 5 1 3]" {
+			t.Errorf("unexpected order %v", rows)
+		}
+	})
+}
+
+func TestWhereExpressions(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tests := []struct {
+		where    string
+		expected []string
+	}{
+		{"amount >= 30 AND (customer = 'bob' OR customer != 'ann')", []string{"5"}},
+		{"customer LIKE 'a%'", []string{"1", "3"}},
+		{"customer LIKE '_o_'", []string{"2", "5"}},
+		{"customer NOT LIKE '%n'", []string{"2", "4", "5"}},
+		{"id IN (1, 4, 9)", []string{"1", "4"}},
+		{"customer NOT IN ('ann', 'bob')", []string{"4"}},
+		{"NOT amount > 10", []string{"2", "4"}},
+		{"amount < 10 OR amount > 45", []string{"4", "3"}},
+		{"id <> 2 AND id <= 3", []string{"1", "3"}},
+		{"amount > 40 AND amount < 20", []string{}},
+		{"NULL OR id = 1", []string{"1"}},
+		{"NOT (NULL AND id = 1)", []string{"2", "3", "4", "5"}},
+		{"id IN (1, NULL)", []string{"1"}},
+		{"id NOT IN (1, NULL)", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			rows := queryRows(t, db, nil, "SELECT id FROM orders WHERE "+tt.where)
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	t.Run("QueryWhere", func(t *testing.T) {
+		where, err := ParseExpr("customer = 'ann' OR amount <= 5")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		records, err := db.QueryWhere("orders", where, &reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(records) != 3 || records[2].Get("customer") == nil || string(records[2].Get("customer").Str) != "cid" {
+			t.Errorf("unexpected records %v", records)
+		}
+	})
+
+	t.Run("Type mismatch", func(t *testing.T) {
+		stmt, _ := parseStatement("SELECT id FROM orders WHERE customer LIKE 1")
+		if _, err := stmt.Exec(db, nil); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+	})
+}
+
+func TestLikeMatch(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		expected   bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "ab", false},
+		{"abc", "a%", true},
+		{"abc", "%c", true},
+		{"abc", "%b%", true},
+		{"abc", "a_c", true},
+		{"abc", "a__c", false},
+		{"", "%", true},
+		{"aXbXc", "a%b%c", true},
+		{"abcbd", "a%b_", true},
+		{"abcbd", "a%bc", false},
+	}
+	for _, tt := range tests {
+		if got := likeMatch([]byte(tt.s), []byte(tt.pattern)); got != tt.expected {
+			t.Errorf("%q LIKE %q: expected %v, got %v", tt.s, tt.pattern, tt.expected, got)
+		}
+	}
+}
+
+func TestPlanRange(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "events",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"id", "kind", "ts", "page"},
+		PKeys:   1,
+		Indexes: [][]string{{"kind", "ts"}},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("failed to create events table: %v", err)
+	}
+	kinds := []string{"click", "view", "buy"}
+	for i := 1; i <= 30; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("kind", []byte(kinds[i%3])).AddInt64("ts", int64(i*10)).AddStr("page", []byte("home"))
+		if _, err := db.Insert("events", *rec, &writer); err != nil {
+			t.Fatalf("failed to insert event: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	tests := []struct {
+		where  string
+		key    string // the key columns of the ranges
+		ranges int
+		rows   int
+	}{
+		{"id = 7", "[id]", 1, 1},
+		{"id IN (3, 1, 3, 40)", "[id]", 3, 2},
+		{"id < 5 OR id > 25 OR id = 2", "[id]", 2, 9},
+		{"kind = 'view' AND ts > 200", "[kind ts]", 1, 3},
+		{"kind IN ('buy', 'view') AND ts >= 100 AND ts < 150", "[kind ts]", 2, 4},
+		{"kind LIKE 'vi%'", "[kind]", 1, 10},
+		{"kind = 'buy' OR id = 1", "[]", 1, 11}, // a full scan
+		{"id > 10 AND id < 5", "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			stmt, err := parseStatement("SELECT * FROM events WHERE " + tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var reader KVReader
+			db.kv.BeginRead(&reader)
+			defer db.kv.EndRead(&reader)
+			q, err := stmt.(*SelectStmt).prepare(db, nil, &reader)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(q.scan) != tt.ranges {
+				t.Errorf("expected %d ranges, got %d", tt.ranges, len(q.scan))
+			}
+			if len(q.scan) > 0 && fmt.Sprint(q.scan[0].key) != tt.key {
+				t.Errorf("expected key %s, got %v", tt.key, q.scan[0].key)
+			}
+			if rows := queryRows(t, db, nil, "SELECT * FROM events WHERE "+tt.where); len(rows) != tt.rows {
+				t.Errorf("expected %d rows, got %d", tt.rows, len(rows))
+			}
+		})
+	}
+
+	// the ranges are read in index order
+	rows := queryRows(t, db, nil, "SELECT ts FROM events WHERE kind = 'view' AND ts < 150 ORDER BY ts DESC")
+	if fmt.Sprint(rows) != "[130 100 70 40 10]" {
+		t.Errorf("unexpected order %v", rows)
+	}
+	rows = queryRows(t, db, nil, "SELECT id FROM events WHERE id IN (9, 2, 5) ORDER BY id DESC")
+	if fmt.Sprint(rows) != "[9 5 2]" {
+		t.Errorf("unexpected order %v", rows)
+	}
+}
+
+func TestProjections(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"SELECT id, amount * 2 AS double FROM orders WHERE id <= 2", []string{"1|60", "2|20"}},
+		{"SELECT upper(customer) || '-' || id FROM orders WHERE id = 1", []string{"ANN-1"}},
+		{"SELECT amount / 4, amount / 4.0, amount % 7, -amount, 1 + 2 * 3 FROM orders WHERE id = 1",
+			[]string{"7|7.5|2|-30|7"}},
+		{"SELECT id, amount - 10 AS net FROM orders ORDER BY net DESC",
+			[]string{"3|40", "5|30", "1|20", "2|0", "4|-5"}},
+		{"SELECT customer c, sum(amount) AS total FROM orders GROUP BY customer ORDER BY total",
+			[]string{"cid|5", "bob|50", "ann|80"}},
+		{"SELECT length(customer), abs(-3), coalesce(NULL, 'x'), lower('AB') FROM orders WHERE id = 4",
+			[]string{"3|3|x|ab"}},
+		{"SELECT id FROM orders WHERE amount * 2 > 70", []string{"3", "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rows := queryRows(t, db, nil, tt.query)
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	t.Run("Column names", func(t *testing.T) {
+		stmt, _ := parseStatement("SELECT id AS key, amount*2, upper(customer) FROM orders WHERE id = 1")
+		res, err := stmt.Exec(db, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []string{"key", "amount * 2", "upper(customer)"}
+		if fmt.Sprint(res.Records[0].Cols) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, res.Records[0].Cols)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for query, target := range map[string]error{
+			"SELECT amount / 0 FROM orders":          ErrDivisionByZero,
+			"SELECT upper(amount) FROM orders":       ErrTypeMismatch,
+			"SELECT customer * 2 FROM orders":        ErrTypeMismatch,
+			"SELECT -customer FROM orders":           ErrTypeMismatch,
+			"SELECT id FROM orders WHERE id % 0 = 1": ErrDivisionByZero,
+		} {
+			stmt, err := parseStatement(query)
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			if _, err := stmt.Exec(db, nil); !errors.Is(err, target) {
+				t.Errorf("%s: expected %v, got %v", query, target, err)
+			}
+		}
+		for _, query := range []string{"SELECT upper(customer, id) FROM orders", "SELECT foo(id) FROM orders"} {
+			if _, err := parseStatement(query); err == nil {
+				t.Errorf("%s: expected a parse error", query)
+			}
+		}
+	})
+
+	t.Run("Index only", func(t *testing.T) {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		for query, expected := range map[string]bool{
+			"SELECT amount, id FROM orders WHERE amount > 20":    true,
+			"SELECT count(*) FROM orders WHERE amount > 20":      true,
+			"SELECT amount + 1 FROM orders ORDER BY amount DESC": true,
+			"SELECT customer FROM orders WHERE amount > 20":      false,
+			"SELECT * FROM orders WHERE amount > 20":             false,
+			"SELECT id FROM orders WHERE id > 2":                 false,
+		} {
+			stmt, _ := parseStatement(query)
+			sel := stmt.(*SelectStmt)
+			q, err := sel.prepare(db, nil, &reader)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			keys, _ := bindOrder(sel.OrderBy, func(e Expr) (Expr, error) { return bindExpr(e, q.sch) })
+			q.useIndexOrder(keys)
+			q.useKeyOnly()
+			if got := len(q.scan) > 0 && q.scan[0].keyOnly; got != expected {
+				t.Errorf("%s: expected key only %v, got %v", query, expected, got)
+			}
+		}
+		rows := queryRows(t, db, nil, "SELECT amount, id FROM orders WHERE amount > 20")
+		if fmt.Sprint(rows) != "[30|1 40|5 50|3]" {
+			t.Errorf("unexpected rows %v", rows)
+		}
+		rows = queryRows(t, db, nil, "SELECT count(*), sum(amount) FROM orders WHERE amount > 20")
+		if fmt.Sprint(rows) != "[3|120]" {
+			t.Errorf("unexpected rows %v", rows)
+		}
+	})
+}
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	exec := func(tx *DBTX, query string) (*StatementResult, error) {
+		stmt, err := parseStatement(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return stmt.Exec(db, tx)
+	}
+	// the amount index holds exactly the rows of the table
+	checkIndex := func(tx *DBTX) {
+		t.Helper()
+		byIndex := queryRows(t, db, tx, "SELECT amount, id FROM orders WHERE amount > -1000 ORDER BY amount")
+		byKey := queryRows(t, db, tx, "SELECT amount, id FROM orders ORDER BY customer, amount")
+		sort.Strings(byKey)
+		sorted := append([]string{}, byIndex...)
+		sort.Strings(sorted)
+		if fmt.Sprint(sorted) != fmt.Sprint(byKey) {
+			t.Errorf("index %v does not match the rows %v", byIndex, byKey)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		affected int
+		check    string
+		expected []string
+	}{
+		{"UPDATE orders SET amount = amount + 1 WHERE customer = 'ann'", 2,
+			"SELECT id FROM orders WHERE amount IN (30, 31, 50, 51)", []string{"1", "3"}},
+		{"UPDATE orders SET amount = 7, customer = upper(customer) WHERE id IN (2, 5)", 2,
+			"SELECT id, customer FROM orders WHERE amount = 7", []string{"2|BOB", "5|BOB"}},
+		{"UPDATE orders SET id = id + 10 WHERE id = 4", 1,
+			"SELECT id FROM orders WHERE amount = 5", []string{"14"}},
+		{"UPDATE orders SET amount = 0 WHERE id = 99", 0,
+			"SELECT count(*) FROM orders WHERE amount = 0", []string{"0"}},
+		{"DELETE FROM orders WHERE amount < 10 OR customer LIKE 'a%'", 5,
+			"SELECT id FROM orders", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			res, err := exec(nil, tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.RowsAffected != tt.affected {
+				t.Errorf("expected %d rows affected, got %d", tt.affected, res.RowsAffected)
+			}
+			if rows := queryRows(t, db, nil, tt.check); fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+			checkIndex(nil)
+		})
+	}
+
+	t.Run("Statement atomicity", func(t *testing.T) {
+		// the table is empty after the tests above
+		tx := &DBTX{}
+		db.Begin(tx)
+		defer db.Abort(tx)
+		for i, amount := range []int64{10, 20, 30} {
+			rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("customer", []byte("x")).AddInt64("amount", amount)
+			if _, err := tx.Set("orders", *rec, MODE_INSERT_ONLY); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		// moving 1 to 3 collides after 1 was already removed
+		if _, err := exec(tx, "UPDATE orders SET id = 3 WHERE id = 1"); err == nil {
+			t.Fatal("expected a duplicate key error")
+		}
+		if rows := queryRows(t, db, tx, "SELECT id, amount FROM orders"); fmt.Sprint(rows) != "[1|10 2|20 3|30]" {
+			t.Errorf("expected the rows to be unchanged, got %v", rows)
+		}
+		checkIndex(tx)
+		if _, err := exec(tx, "UPDATE orders SET amount = 'x'"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+		if _, err := exec(tx, "UPDATE orders SET nope = 1"); err == nil {
+			t.Error("expected an unknown column error")
+		}
+	})
+
+	t.Run("Read only", func(t *testing.T) {
+		tx := db.BeginReadOnly()
+		defer db.Abort(tx)
+		if _, err := exec(tx, "DELETE FROM orders"); !errors.Is(err, ErrReadOnlyTX) {
+			t.Errorf("expected ErrReadOnlyTX, got %v", err)
+		}
+	})
+
+	t.Run("Internal tables", func(t *testing.T) {
+		for _, query := range []string{
+			"UPDATE @table SET def = 'garbage' WHERE name = 'orders'",
+			"DELETE FROM @meta",
+			"INSERT INTO @table (name, def) VALUES ('x', 'y')",
+			"UPDATE @tables SET name = 'x'",
+			"LOAD @table FROM 'x'",
+			"IMPORT @table FROM 'x'",
+		} {
+			if _, err := exec(nil, query); err == nil || !strings.Contains(err.Error(), "internal table") {
+				t.Errorf("%s: expected an internal table error, got %v", query, err)
+			}
+		}
+		// the definition of orders is intact, the table is empty after the tests above
+		if rows := queryRows(t, db, nil, "SELECT count(*) FROM orders"); fmt.Sprint(rows) != "[0]" {
+			t.Errorf("expected an empty table, got %v", rows)
+		}
+	})
+}
+
+func TestPartialUpdate(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	tx := &DBTX{}
+	db.Begin(tx)
+	defer db.Abort(tx)
+	tdef := &TableDef{
+		Name:    "people",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "city", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}, {"city"}},
+	}
+	if err := tx.TableNew(tdef); err != nil {
+		t.Fatalf("failed to create people table: %v", err)
+	}
+	rec := (&Record{}).AddInt64("id", 1).AddStr("name", []byte("ann")).AddStr("city", []byte("oslo")).AddInt64("age", 30)
+	if _, err := tx.Set("people", *rec, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		rec      *Record
+		writes   int // the row & the index entries written
+		expected string
+	}{
+		{"unindexed column", (&Record{}).AddInt64("id", 1).AddInt64("age", 31), 1, "1|ann|oslo|31"},
+		{"one index", (&Record{}).AddInt64("id", 1).AddStr("city", []byte("rome")), 3, "1|ann|rome|31"},
+		{"unchanged value", (&Record{}).AddStr("name", []byte("ann")).AddInt64("id", 1), 1, "1|ann|rome|31"},
+		{"both indexes", (&Record{}).AddInt64("id", 1).AddStr("name", []byte("bea")).AddStr("city", []byte("oslo")), 5, "1|bea|oslo|31"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(tx.kv.writes)
+			if _, err := tx.Set("people", *tt.rec, MODE_UPDATE_ONLY); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := len(tx.kv.writes) - before; n != tt.writes {
+				t.Errorf("expected %d writes, got %d", tt.writes, n)
+			}
+			rows := queryRows(t, db, tx, "SELECT * FROM people")
+			if fmt.Sprint(rows) != "["+tt.expected+"]" {
+				t.Errorf("expected %s, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	// the indexes follow the new values
+	for query, expected := range map[string]string{
+		"SELECT id FROM people WHERE name = 'bea'":  "[1]",
+		"SELECT id FROM people WHERE name = 'ann'":  "[]",
+		"SELECT id FROM people WHERE city = 'oslo'": "[1]",
+		"SELECT id FROM people WHERE city = 'rome'": "[]",
+	} {
+		if rows := queryRows(t, db, tx, query); fmt.Sprint(rows) != expected {
+			t.Errorf("%s: expected %s, got %v", query, expected, rows)
+		}
+	}
+
+	errorTests := []*Record{
+		(&Record{}).AddInt64("id", 2).AddInt64("age", 1),
+		(&Record{}).AddInt64("id", 1).AddInt64("height", 1),
+		(&Record{}).AddInt64("id", 1).AddStr("age", []byte("old")),
+		(&Record{}).AddInt64("age", 1),
+	}
+	for _, rec := range errorTests {
+		if _, err := tx.Set("people", *rec, MODE_UPDATE_ONLY); err == nil {
+			t.Errorf("expected an error for %v", rec)
+		}
+	}
+	rec = (&Record{}).AddInt64("id", 1).AddStr("age", []byte("old"))
+	if _, err := tx.Set("people", *rec, MODE_UPDATE_ONLY); !errors.Is(err, ErrTypeMismatch) || !strings.Contains(err.Error(), "column age") {
+		t.Errorf("expected a type mismatch of column age, got %v", err)
+	}
+}
+
+func TestDeleteByKey(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	old, err := db.DeleteByKey("orders", Value{Type: TYPE_INT64, I64: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(old.Cols) != "[id customer amount]" || string(old.Get("customer").Str) != "ann" || old.Get("amount").I64 != 50 {
+		t.Errorf("unexpected deleted row %v", old)
+	}
+	if rows := queryRows(t, db, nil, "SELECT id FROM orders WHERE amount = 50 OR id = 3"); len(rows) != 0 {
+		t.Errorf("expected the row & its index entry to be gone, got %v", rows)
+	}
+
+	tests := []struct {
+		name string
+		pk   []Value
+		err  error
+	}{
+		{"missing row", []Value{{Type: TYPE_INT64, I64: 3}}, ErrRecordNotFound},
+		{"wrong type", []Value{{Type: TYPE_BYTES, Str: []byte("3")}}, ErrTypeMismatch},
+		{"no key", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.DeleteByKey("orders", tt.pk...)
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("In a transaction", func(t *testing.T) {
+		tx := &DBTX{}
+		db.Begin(tx)
+		old, err := tx.DeleteByKey("orders", Value{Type: TYPE_INT64, I64: 1})
+		if err != nil || old.Get("amount").I64 != 30 {
+			t.Fatalf("unexpected result %v, %v", old, err)
+		}
+		db.Abort(tx)
+		if rows := queryRows(t, db, nil, "SELECT id FROM orders WHERE amount = 30"); fmt.Sprint(rows) != "[1]" {
+			t.Errorf("expected the aborted delete to be undone, got %v", rows)
+		}
+	})
+}
+
+func TestInsertOnConflictReturning(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tests := []struct {
+		query    string
+		affected int
+		expected []string // the RETURNING rows
+		err      error
+	}{
+		{"INSERT INTO orders VALUES (6, 'dan', 20), (7, 'eve', 60) RETURNING *", 2,
+			[]string{"6|dan|20", "7|eve|60"}, nil},
+		{"INSERT INTO orders (amount, id, customer) VALUES (2 * 5, 8, 'fay') RETURNING id, amount + 1 AS next", 1,
+			[]string{"8|11"}, nil},
+		{"INSERT INTO orders VALUES (1, 'zed', 1)", 0, nil, ErrRecordExists},
+		{"INSERT INTO orders VALUES (1, 'zed', 1), (9, 'gus', 15) ON CONFLICT (id) DO NOTHING RETURNING id", 1,
+			[]string{"9"}, nil},
+		{"INSERT INTO orders VALUES (2, 'bob', 5), (10, 'hal', 25) ON CONFLICT DO UPDATE " +
+			"SET amount = amount + excluded.amount RETURNING id, amount", 2,
+			[]string{"2|15", "10|25"}, nil},
+		{"INSERT INTO orders VALUES (3, 'ann', 1) ON CONFLICT (id) DO UPDATE SET amount = 0 " +
+			"WHERE orders.amount < excluded.amount RETURNING id", 0, []string{}, nil},
+		{"UPDATE orders SET amount = amount * 2 WHERE customer = 'ann' RETURNING id, amount", 2,
+			[]string{"1|60", "3|100"}, nil},
+		{"DELETE FROM orders WHERE amount >= 60 RETURNING *", 3,
+			[]string{"1|ann|60", "7|eve|60", "3|ann|100"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			stmt, err := parseStatement(tt.query)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			res, err := stmt.Exec(db, nil)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.RowsAffected != tt.affected {
+				t.Errorf("expected %d rows affected, got %d", tt.affected, res.RowsAffected)
+			}
+			var rows []string
+			for _, rec := range res.Records {
+				vals := make([]string, len(rec.Vals))
+				for i, v := range rec.Vals {
+					vals[i] = formatValue(v)
+				}
+				rows = append(rows, strings.Join(vals, "|"))
+			}
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, rows)
+			}
+		})
+	}
+
+	// the index follows the inserted & updated rows
+	expected := "[4|5 8|10 2|15 9|15 6|20 10|25 5|40]"
+	if rows := queryRows(t, db, nil, "SELECT id, amount FROM orders WHERE amount > 0 ORDER BY amount"); fmt.Sprint(rows) != expected {
+		t.Errorf("expected %s, got %v", expected, rows)
+	}
+
+	invalid := []string{
+		"INSERT INTO orders (id, amount) VALUES (20, 1)",
+		"INSERT INTO orders VALUES (20, 'x')",
+		"INSERT INTO orders VALUES (id, 'x', 1)",
+		"INSERT INTO orders VALUES (20, 'x', 1) ON CONFLICT (amount) DO NOTHING",
+		"INSERT INTO orders VALUES (20, 'x', 1) ON CONFLICT DO UPDATE SET nope = 1",
+		"INSERT INTO orders VALUES (20, 'x', 1) RETURNING count(*)",
+	}
+	for _, query := range invalid {
+		stmt, err := parseStatement(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if _, err := stmt.Exec(db, nil); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tx := &DBTX{}
+	db.Begin(tx)
+	items := &TableDef{
+		Name:    "items",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "qty"},
+		PKeys:   1,
+		Indexes: [][]string{{"qty"}},
+	}
+	if err := tx.TableNew(items); err != nil {
+		t.Fatalf("failed to create items table: %v", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	// a transaction that saw the table empty cannot write to it afterwards
+	stale := &DBTX{}
+	db.Begin(stale)
+	defer db.Abort(stale)
+	queryRows(t, db, stale, "SELECT count(*) FROM items")
+
+	const n = 5000
+	rows := make([]Record, n)
+	for i := range rows {
+		id := int64((i * 7919) % n) // not in key order
+		rows[i] = *(&Record{}).AddInt64("id", id).
+			AddStr("name", []byte(fmt.Sprintf("item-%04d", id))).AddInt64("qty", id%10)
+	}
+	if err := db.BulkLoad("items", rows, 0.7); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		tests := []struct {
+			query    string
+			expected []string
+		}{
+			{"SELECT count(*), min(id), max(id) FROM items", []string{"5000|0|4999"}},
+			{"SELECT name FROM items WHERE id = 1234", []string{"item-1234"}},
+			{"SELECT count(*) FROM items WHERE qty = 3", []string{"500"}},
+			{"SELECT id FROM items WHERE qty = 9 AND id > 4970", []string{"4979", "4989", "4999"}},
+			{"SELECT id, amount FROM orders WHERE amount > 30", []string{"5|40", "3|50"}},
+		}
+		for _, tt := range tests {
+			if rows := queryRows(t, db, nil, tt.query); fmt.Sprint(rows) != fmt.Sprint(tt.expected) {
+				t.Errorf("%s: expected %v, got %v", tt.query, tt.expected, rows)
+			}
+		}
+	}
+	check(t)
+
+	if _, err := stale.Set("items", *(&Record{}).AddInt64("id", -1).AddStr("name", []byte("x")).AddInt64("qty", 1), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Commit(stale); !errors.Is(err, ErrSerialization) {
+		t.Errorf("expected ErrSerialization, got %v", err)
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		db.kv.Close()
+		db.kv = *newKV(db.Path)
+		if err := db.kv.Open(); err != nil {
+			t.Fatalf("failed to reopen: %v", err)
+		}
+		check(t)
+	})
+
+	t.Run("Writes after the load", func(t *testing.T) {
+		stmt, err := parseStatement("DELETE FROM items WHERE id < 2500 OR qty = 0")
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		res, err := stmt.Exec(db, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.RowsAffected != 2750 {
+			t.Errorf("expected 2750 rows deleted, got %d", res.RowsAffected)
+		}
+		expected := "[2250 2250]"
+		counts := []string{
+			queryRows(t, db, nil, "SELECT count(*) FROM items")[0],
+			queryRows(t, db, nil, "SELECT count(*) FROM items WHERE qty >= 0")[0],
+		}
+		if fmt.Sprint(counts) != expected {
+			t.Errorf("expected %s, got %v", expected, counts)
+		}
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		row := func(id int64) Record {
+			return *(&Record{}).AddInt64("id", id).AddStr("customer", []byte("x")).AddInt64("amount", 1)
+		}
+		if err := db.BulkLoad("orders", []Record{row(100)}, 0); !errors.Is(err, ErrTableNotEmpty) {
+			t.Errorf("expected ErrTableNotEmpty, got %v", err)
+		}
+		queryRows(t, db, nil, "DELETE FROM orders")
+		if err := db.BulkLoad("orders", []Record{row(1), row(2), row(1)}, 0); err == nil {
+			t.Error("expected a duplicate key error")
+		}
+		if err := db.BulkLoad("orders", []Record{row(1)}, 0.2); err == nil {
+			t.Error("expected a fill factor error")
+		}
+		if err := db.BulkLoad("nope", []Record{row(1)}, 0); err == nil {
+			t.Error("expected a table not found error")
+		}
+	})
+
+	t.Run("LOAD", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "orders.txt")
+		data := "3, 'cid', 7\n\n1, 'ann', 2 * 10\n2, 'bob', 5\n"
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stmt, err := parseStatement(fmt.Sprintf("LOAD orders FROM '%s' FILLFACTOR 100", path))
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if _, err := stmt.Exec(db, &DBTX{}); err == nil {
+			t.Error("expected LOAD to be rejected inside a transaction")
+		}
+		res, err := stmt.Exec(db, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Message != "3 rows loaded." {
+			t.Errorf("unexpected message %q", res.Message)
+		}
+		expected := "[2|bob|5 3|cid|7 1|ann|20]"
+		if rows := queryRows(t, db, nil, "SELECT * FROM orders WHERE amount > 0 ORDER BY amount"); fmt.Sprint(rows) != expected {
+			t.Errorf("expected %s, got %v", expected, rows)
+		}
+		for _, query := range []string{"LOAD orders FROM 'x' FILLFACTOR 20", "LOAD orders 'x'"} {
+			if _, err := parseStatement(query); err == nil {
+				t.Errorf("%s: expected a parse error", query)
+			}
+		}
+	})
+
+	t.Run("Only the path to the table is rewritten", func(t *testing.T) {
+		queryRows(t, db, nil, "DELETE FROM orders")
+		pages := func() float64 { return db.Metrics().PagesPerCommit.Sum }
+		before := pages()
+		if err := db.BulkLoad("orders", []Record{*(&Record{}).AddInt64("id", 1).AddStr("customer", []byte("a")).AddInt64("amount", 1)}, 0); err != nil {
+			t.Fatalf("bulk load failed: %v", err)
+		}
+		// the leaf & its parents, for the table & its index, with the free list
+		if written := pages() - before; written > 12 {
+			t.Errorf("expected a few pages written, got %v", written)
+		}
+
+		queryRows(t, db, nil, "DELETE FROM orders")
+		rows := make([]Record, 3000)
+		for i := range rows {
+			rows[i] = *(&Record{}).AddInt64("id", int64(i)).AddStr("customer", []byte("c")).AddInt64("amount", int64(i%7))
+		}
+		if err := db.BulkLoad("orders", rows, 0); err != nil {
+			t.Fatalf("bulk load failed: %v", err)
+		}
+		tests := []struct {
+			query    string
+			expected string
+		}{
+			{"SELECT count(*), min(id), max(id) FROM orders", "[3000|0|2999]"},
+			{"SELECT count(*) FROM orders WHERE amount = 6", "[428]"},
+			{"SELECT count(*) FROM items", "[2250]"},
+			{"SELECT count(*) FROM items WHERE qty >= 0", "[2250]"},
+		}
+		for _, tt := range tests {
+			if rows := queryRows(t, db, nil, tt.query); fmt.Sprint(rows) != tt.expected {
+				t.Errorf("%s: expected %s, got %v", tt.query, tt.expected, rows)
+			}
+		}
+	})
+}
+
+func TestCSVImportExport(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+	dir := t.TempDir()
+
+	exec := func(query string, tx *DBTX) (*StatementResult, error) {
+		t.Helper()
+		stmt, err := parseStatement(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return stmt.Exec(db, tx)
+	}
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// the columns in another order, quoting, CRLF & blank lines
+	path := writeFile("in.csv", "customer;id;amount\r\n"+
+		"'dan; jr';6;20\r\n"+
+		"\r\n"+
+		"'it''s\nme';7;1\n"+
+		"eve;x;3\n"+
+		"fay;1;4\n"+
+		"gus;8;9\n")
+	res, err := exec(fmt.Sprintf("IMPORT orders FROM '%s' DELIMITER ';' QUOTE '''' ON ERROR SKIP BATCH 2", path), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "line 6: column id: invalid integer \"x\"\nline 7: record already exists\n3 rows imported. 2 rows rejected."
+	if res.Message != expected {
+		t.Errorf("expected message %q, got %q", expected, res.Message)
+	}
+	rows := queryRows(t, db, nil, "SELECT id, customer FROM orders WHERE id > 5")
+	if fmt.Sprint(rows) != fmt.Sprint([]string{"6|dan; jr", "7|it's\nme", "8|gus"}) {
+		t.Errorf("unexpected rows %q", rows)
+	}
+
+	t.Run("Export", func(t *testing.T) {
+		path := filepath.Join(dir, "out.csv")
+		res, err := exec(fmt.Sprintf("EXPORT orders TO '%s' DELIMITER ';'", path), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.RowsAffected != 8 {
+			t.Errorf("expected 8 rows exported, got %d", res.RowsAffected)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "id;customer;amount\n1;ann;30\n2;bob;10\n3;ann;50\n4;cid;5\n5;bob;40\n" +
+			"6;\"dan; jr\";20\n7;\"it's\nme\";1\n8;gus;9\n"
+		if string(data) != expected {
+			t.Errorf("expected %q, got %q", expected, data)
+		}
+
+		// the export reads back into the same rows
+		queryRows(t, db, nil, "DELETE FROM orders")
+		if _, err := exec(fmt.Sprintf("IMPORT orders FROM '%s' DELIMITER ';'", path), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := queryRows(t, db, nil, "SELECT count(*) FROM orders WHERE amount >= 0"); n[0] != "8" {
+			t.Errorf("expected 8 rows, got %v", n)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		path := writeFile("abort.csv", "id,customer,amount\n20,a,1\n21,b,2\n22,c,3\n23,d\n24,e,5\n")
+		_, err := exec(fmt.Sprintf("IMPORT orders FROM '%s' BATCH 2", path), nil)
+		if err == nil || !strings.Contains(err.Error(), "line 5: expected 3 fields, got 2") ||
+			!strings.Contains(err.Error(), "2 rows imported before the error") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// the first batch is committed, the second is not
+		if rows := queryRows(t, db, nil, "SELECT id FROM orders WHERE id >= 20"); fmt.Sprint(rows) != "[20 21]" {
+			t.Errorf("unexpected rows %v", rows)
+		}
+
+		// inside a transaction nothing of the statement is kept
+		tx := &DBTX{}
+		db.Begin(tx)
+		defer db.Abort(tx)
+		if _, err := exec(fmt.Sprintf("IMPORT orders FROM '%s' BATCH 1", path), tx); err == nil {
+			t.Error("expected an error")
+		}
+		if rows := queryRows(t, db, tx, "SELECT id FROM orders WHERE id >= 20"); fmt.Sprint(rows) != "[20 21]" {
+			t.Errorf("unexpected rows %v", rows)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			name, data string
+		}{
+			{"header.csv", "id,customer\n1,a\n"},
+			{"unknown.csv", "id,customer,amount,extra\n"},
+			{"quote.csv", "id,customer,amount\n30,\"open,1\n"},
+			{"empty.csv", ""},
+		}
+		for _, tt := range tests {
+			path := writeFile(tt.name, tt.data)
+			if _, err := exec(fmt.Sprintf("IMPORT orders FROM '%s' ON ERROR SKIP", path), nil); err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+		}
+		for _, query := range []string{
+			"IMPORT orders FROM 'x' DELIMITER ',,'",
+			"IMPORT orders FROM 'x' DELIMITER '\"'",
+			"IMPORT orders FROM 'x' BATCH 0",
+			"EXPORT orders TO 'x' BATCH 10",
+		} {
+			if _, err := parseStatement(query); err == nil {
+				t.Errorf("%s: expected a parse error", query)
+			}
+		}
+	})
+}
+
+func TestDumpRestore(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+	tx := &DBTX{}
+	db.Begin(tx)
+	blobs := &TableDef{
+		Name:  "blobs",
+		Types: []uint32{TYPE_BYTES, TYPE_BYTES},
+		Cols:  []string{"k", "v"},
+		PKeys: 1,
+	}
+	if err := tx.TableNew(blobs); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"a", "plain \"text\""}, {"b", "\xff\x00"}, {"c", ""}} {
+		rec := (&Record{}).AddStr("k", []byte(kv[0])).AddStr("v", []byte(kv[1]))
+		if _, err := tx.Set("blobs", *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.jsonl")
+	stmt, err := parseStatement(fmt.Sprintf("DUMP TO '%s'", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stmt.Exec(db, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Message != "2 tables and 8 rows dumped." {
+		t.Errorf("unexpected message %q", res.Message)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	expected := []string{
+		`{"format":"atomixdb-dump","version":1}`,
+		`{"type":"table","name":"blobs","columns":[{"name":"k","type":"bytes"},{"name":"v","type":"bytes"}],"primary_key":["k"]}`,
+		`{"type":"row","table":"blobs","values":["a","plain \"text\""]}`,
+		`{"type":"row","table":"blobs","values":["b",{"base64":"/wA="}]}`,
+		`{"type":"row","table":"blobs","values":["c",""]}`,
+		`{"type":"table","name":"orders","columns":[{"name":"id","type":"int64"},{"name":"customer","type":"bytes"},{"name":"amount","type":"int64"}],"primary_key":["id"],"indexes":[["amount","id"]]}`,
+		`{"type":"row","table":"orders","values":[1,"ann",30]}`,
+	}
+	for i, line := range expected {
+		if i >= len(lines) || lines[i] != line {
+			t.Errorf("line %d: expected %s, got %q", i+1, line, lines[i])
+		}
+	}
+
+	restored := &DB{
+		Path:   filepath.Join(dir, "restored.db"),
+		tables: make(map[string]*TableDef),
+		pool:   NewPool(1),
+	}
+	restored.kv = *newKV(restored.Path)
+	if err := restored.kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.kv.Close()
+	if err := initializeInternalTables(restored); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err = parseStatement(fmt.Sprintf("RESTORE FROM '%s'", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(restored, &DBTX{}); err == nil {
+		t.Error("expected RESTORE to be rejected inside a transaction")
+	}
+	if res, err = stmt.Exec(restored, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Message != "2 tables and 8 rows restored." {
+		t.Errorf("unexpected message %q", res.Message)
+	}
+	for _, query := range []string{
+		"SELECT * FROM orders ORDER BY amount",
+		"SELECT id FROM orders WHERE amount > 20",
+		"SELECT * FROM blobs",
+	} {
+		want, got := queryRows(t, db, nil, query), queryRows(t, restored, nil, query)
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("%s: expected %v, got %v", query, want, got)
+		}
+	}
+	// the tables exist now
+	if _, err := stmt.Exec(restored, nil); !errors.Is(err, ErrTableAlreadyExists) {
+		t.Errorf("expected ErrTableAlreadyExists, got %v", err)
+	}
+	if _, err := restored.Restore(strings.NewReader(`{"format":"other"}`)); err == nil {
+		t.Error("expected an error for a file that is not a dump")
+	}
+	if _, err := restored.Restore(strings.NewReader(`{"format":"atomixdb-dump","version":1}` + "\n" +
+		`{"type":"row","table":"x","values":[1]}`)); err == nil {
+		t.Error("expected an error for rows without a table")
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+	// in order, the keys must sort the same way
+	values := []string{"", "\x00", "\x01a", "a", "\xfd", "\xfe", "\xfe\x00", "\xfeabc", "\xff", "\xffa"}
+	var prev []byte
+	for i, s := range values {
+		key := encodeValues(nil, []Value{{Type: TYPE_BYTES, Str: []byte(s)}})
+		out := []Value{{Type: TYPE_BYTES}}
+		decodeValues(key, out)
+		if string(out[0].Str) != s {
+			t.Errorf("%q: decoded as %q", s, out[0].Str)
+		}
+		if i > 0 && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("%q: the key %q does not sort after %q", s, key, prev)
+		}
+		prev = key
+	}
+}
+
+func TestScriptSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		code     int
+		expected string
+		errors   string
+	}{
+		{
+			name:     "results are tab separated",
+			script:   "SELECT id, customer FROM orders WHERE amount > 35 ORDER BY id\n",
+			code:     EXIT_OK,
+			expected: "id\tcustomer\n3\tann\n5\tbob\n",
+		},
+		{
+			name:     "several statements on a line",
+			script:   "UPDATE orders SET customer = 'a;b\tc' WHERE id = 1; SELECT customer FROM orders WHERE id = 1",
+			code:     EXIT_OK,
+			expected: "1 row updated.\ncustomer\na;b\\tc\n",
+		},
+		{
+			name:     "blank lines and comments",
+			script:   "\n-- a comment\nSELECT id FROM orders WHERE id = 2 -- trailing\n\n",
+			code:     EXIT_OK,
+			expected: "id\n2\n",
+		},
+		{
+			name:     "the first error stops the script",
+			script:   "SELECT id FROM orders WHERE id = 4\nSELECT nope FROM orders\nDELETE FROM orders\n",
+			code:     EXIT_FAILURE,
+			expected: "id\n4\n",
+			errors:   "script.sql:2: column nope not found\n",
+		},
+		{
+			name:   "a failing command stops the script",
+			script: "delete\norders\n99\nDELETE FROM orders\n",
+			code:   EXIT_FAILURE,
+			errors: "script.sql:1: delete: record not found\n",
+		},
+		{
+			name:   "unknown statement",
+			script: "frobnicate\n",
+			code:   EXIT_FAILURE,
+			errors: "script.sql:1: unknown statement\n",
+		},
+		{
+			name:   "commit without a transaction",
+			script: "begin\ncommit\ncommit\n",
+			code:   EXIT_FAILURE,
+			errors: "script.sql:3: commit: no active transaction\n",
+		},
+		{
+			name:     "an open transaction is aborted",
+			script:   "begin\nDELETE FROM orders\n",
+			code:     EXIT_OK,
+			expected: "5 rows deleted.\n",
+		},
+		{
+			name:     "exit",
+			script:   "SELECT id FROM orders WHERE id = 5\nexit\nDELETE FROM orders\n",
+			code:     EXIT_OK,
+			expected: "id\n5\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			defer cleanupTestDB(t, db)
+			setupOrdersTable(t, db)
+
+			var out, errOut strings.Builder
+			s := newSession(db, strings.NewReader(tt.script), "script.sql", false)
+			s.out, s.errOut = &out, &errOut
+			if code := s.run(); code != tt.code {
+				t.Errorf("expected exit code %d, got %d", tt.code, code)
+			}
+			if out.String() != tt.expected {
+				t.Errorf("expected output %q, got %q", tt.expected, out.String())
+			}
+			if errOut.String() != tt.errors {
+				t.Errorf("expected errors %q, got %q", tt.errors, errOut.String())
+			}
+			// nothing after an error or exit runs, nothing left open is kept
+			if rows := queryRows(t, db, nil, "SELECT id FROM orders"); len(rows) != 5 {
+				t.Errorf("expected the 5 orders to be kept, got %v", rows)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{" SELECT 1 ; SELECT 2; ", []string{"SELECT 1", "SELECT 2"}},
+		{"INSERT INTO t VALUES ('a;''b'); SELECT \"x;y\" FROM t", []string{"INSERT INTO t VALUES ('a;''b')", "SELECT \"x;y\" FROM t"}},
+		{"SELECT 1 -- no; split", []string{"SELECT 1 -- no; split"}},
+		{"-- only a comment", nil},
+		{";;", nil},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.input); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected Options
+	}{
+		{nil, Options{LogLevel: slog.LevelWarn, LogFormat: "text", Interactive: isTerminal(os.Stdin)}},
+		{[]string{"-db", "a.db", "-c", "SELECT 1"}, Options{
+			Path: "a.db", Command: "SELECT 1", Format: OUTPUT_TSV, LogLevel: slog.LevelWarn, LogFormat: "text",
+		}},
+		{[]string{"-f", "s.sql", "-format", "json", "b.db"}, Options{
+			Path: "b.db", File: "s.sql", Format: OUTPUT_JSON, LogLevel: slog.LevelWarn, LogFormat: "text",
+		}},
+		{[]string{"-config", "tuned.json", "-c", "SELECT 1"}, Options{
+			Config: "tuned.json", Command: "SELECT 1", Format: OUTPUT_TSV, LogLevel: slog.LevelWarn, LogFormat: "text",
+		}},
+		{[]string{"-c", "SELECT 1", "-log-level", "debug", "-log-format", "json", "-slow-query", "50ms"}, Options{
+			Command: "SELECT 1", Format: OUTPUT_TSV, LogLevel: slog.LevelDebug, LogFormat: "json",
+			SlowQuery: 50 * time.Millisecond, SlowQuerySet: true,
+		}},
+		{[]string{"-c", "SELECT 1", "-slow-query", "0"}, Options{
+			Command: "SELECT 1", Format: OUTPUT_TSV, LogLevel: slog.LevelWarn, LogFormat: "text", SlowQuerySet: true,
+		}},
+	}
+	// a terminal gets tables
+	if tests[0].expected.Format = OUTPUT_TSV; tests[0].expected.Interactive {
+		tests[0].expected.Format = OUTPUT_TABLE
+	}
+	for _, tt := range tests {
+		opts, err := ParseFlags(tt.args)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.args, err)
+		} else if opts != tt.expected {
+			t.Errorf("%v: expected %+v, got %+v", tt.args, tt.expected, opts)
+		}
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	records := []*Record{
+		{Cols: []string{"id", "name", "score"}, Vals: []Value{
+			{Type: TYPE_INT64, I64: 1}, {Type: TYPE_BYTES, Str: []byte("a,\"b\"\tc")}, {Type: TYPE_FLOAT64, F64: 1.5},
+		}},
+		{Cols: []string{"id", "name", "score"}, Vals: []Value{
+			{Type: TYPE_INT64, I64: 2}, {Type: TYPE_BYTES, Str: []byte{0xff, 0x00}}, {Type: TYPE_NULL},
+		}},
+	}
+	tests := []struct {
+		opts     OutputOptions
+		expected string
+	}{
+		{OutputOptions{Format: OUTPUT_TABLE, Binary: BINARY_HEX}, "" +
+			"+----+---------+-------+\n" +
+			"| id | name    | score |\n" +
+			"+----+---------+-------+\n" +
+			"| 1  | a,\"b\"\tc | 1.5   |\n" +
+			"| 2  | \\xff00  | NULL  |\n" +
+			"+----+---------+-------+\n"},
+		{OutputOptions{Format: OUTPUT_CSV, Binary: BINARY_BASE64}, "" +
+			"id,name,score\n" +
+			"1,\"a,\"\"b\"\"\tc\",1.5\n" +
+			"2,/wA=,NULL\n"},
+		{OutputOptions{Format: OUTPUT_TSV, Binary: BINARY_HEX}, "" +
+			"id\tname\tscore\n" +
+			"1\ta,\"b\"\\tc\t1.5\n" +
+			"2\t\\\\xff00\tNULL\n"},
+		{OutputOptions{Format: OUTPUT_JSON, Binary: BINARY_HEX}, "" +
+			"[\n" +
+			"  {\"id\":1,\"name\":\"a,\\\"b\\\"\\tc\",\"score\":1.5},\n" +
+			"  {\"id\":2,\"name\":\"\\\\xff00\",\"score\":null}\n" +
+			"]\n"},
+		{OutputOptions{Format: OUTPUT_JSONL, Binary: BINARY_BASE64}, "" +
+			"{\"id\":1,\"name\":\"a,\\\"b\\\"\\tc\",\"score\":1.5}\n" +
+			"{\"id\":2,\"name\":\"/wA=\",\"score\":null}\n"},
+		{OutputOptions{Format: OUTPUT_VERTICAL, Binary: BINARY_HEX, Footer: true}, "" +
+			"-[ RECORD 1 ]---\n" +
+			"id    | 1\n" +
+			"name  | a,\"b\"\tc\n" +
+			"score | 1.5\n" +
+			"-[ RECORD 2 ]---\n" +
+			"id    | 2\n" +
+			"name  | \\xff00\n" +
+			"score | NULL\n" +
+			"(2 rows, 1.5ms)\n"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		writeResult(&out, &StatementResult{Records: records}, tt.opts, 1500*time.Microsecond)
+		if out.String() != tt.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.opts.Format, tt.expected, out.String())
+		}
+	}
+
+	// the settings of a session
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+	var out, errOut strings.Builder
+	script := "SET output = jsonl; SELECT id FROM orders WHERE id < 3 ORDER BY id\n" +
+		"SET output = csv\nSELECT customer FROM orders WHERE id = 1\n" +
+		"SET output = xml\n"
+	s := newSession(db, strings.NewReader(script), "script.sql", false)
+	s.out, s.errOut = &out, &errOut
+	if code := s.run(); code != EXIT_FAILURE {
+		t.Errorf("expected exit code %d, got %d", EXIT_FAILURE, code)
+	}
+	if expected := "{\"id\":1}\n{\"id\":2}\ncustomer\nann\n"; out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+	if !strings.HasPrefix(errOut.String(), "script.sql:4: unknown output format \"xml\"") {
+		t.Errorf("unexpected errors %q", errOut.String())
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	// a table created in a transaction is only seen by it
+	tx := &DBTX{}
+	db.Begin(tx)
+	defer db.Abort(tx)
+	items := &TableDef{
+		Name:    "items",
+		Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"sku", "qty", "label", "note"},
+		PKeys:   1,
+		Indexes: [][]string{{"qty"}, {"label", "qty"}},
+	}
+	if err := tx.TableNew(items); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		tx       *DBTX
+		expected []string
+	}{
+		{"SHOW TABLES", nil, []string{"orders|3|id|1"}},
+		{"SHOW TABLES", tx, []string{"items|4|sku|2", "orders|3|id|1"}},
+		{"DESCRIBE orders", nil, []string{"id|int64|1", "customer|bytes|0", "amount|int64|0"}},
+		{"SHOW INDEXES FROM orders", nil, []string{"orders|0|id|3", "orders|1|amount, id|4"}},
+		{"SHOW INDEXES", tx, []string{
+			"items|0|sku|5", "items|1|qty, sku|6", "items|2|label, qty, sku|7", "orders|0|id|3", "orders|1|amount, id|4",
+		}},
+		{"SELECT name, prefix FROM @tables", tx, []string{"items|5", "orders|3"}},
+		{"SELECT min(name), max(name) FROM @tables", tx, []string{"items|orders"}},
+		{"SELECT name, type FROM @columns WHERE table_name = 'items' AND primary_key = 0 ORDER BY position DESC", tx,
+			[]string{"note|bytes", "label|bytes", "qty|int64"}},
+		{"SELECT table_name, count(*) FROM @columns GROUP BY table_name", tx, []string{"items|4", "orders|3"}},
+		{"SELECT t.name, i.columns FROM @tables t JOIN @indexes i ON i.table_name = t.name WHERE i.position > 1", tx,
+			[]string{"items|label, qty, sku"}},
+		{"SELECT o.id FROM orders o JOIN @tables t ON t.name = 'orders' AND t.columns = o.id", nil, []string{"3"}},
+	}
+	for _, tt := range tests {
+		if got := queryRows(t, db, tt.tx, tt.query); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.expected, got)
+		}
+	}
+
+	stmt, err := parseStatement("DESCRIBE orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stmt.Exec(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "primary key: (id), prefix 3\nindex 1: (amount, id), prefix 4"; res.Message != expected {
+		t.Errorf("expected message %q, got %q", expected, res.Message)
+	}
+
+	for _, query := range []string{"DESCRIBE missing", "DESCRIBE @table", "SHOW INDEXES FROM items", "SHOW COLUMNS"} {
+		stmt, err := parseStatement(query)
+		if err == nil {
+			_, err = stmt.Exec(db, nil)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+	if err := tx.TableNew(&TableDef{Name: "@tables", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}); err == nil {
+		t.Error("expected an error creating a table named after a system table")
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+
+	tdef := &TableDef{
+		Name:    "wide",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "pad", "n"},
+		PKeys:   1,
+		Indexes: [][]string{{"pad"}},
+	}
+	tx := &DBTX{}
+	db.Begin(tx)
+	if err := tx.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	pad := []byte(strings.Repeat("x", 100))
+	var rows []Record
+	for i := 0; i < 2000; i++ {
+		rows = append(rows, *(&Record{}).AddInt64("id", int64(i)).AddStr("pad", pad).AddInt64("n", 0))
+	}
+	if err := db.BulkLoad("wide", rows, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Pages != db.kv.page.flushed || stats.FileSize < int(stats.Pages)*BTREE_PAGE_SIZE {
+		t.Errorf("unexpected file stats %+v", stats)
+	}
+	if stats.Height < 2 || stats.InternalPages == 0 {
+		t.Errorf("expected a tree of several levels, got height %d with %d internal pages", stats.Height, stats.InternalPages)
+	}
+	if len(stats.Tables) != 2 || stats.Tables[0].Name != "orders" || stats.Tables[1].Name != "wide" {
+		t.Fatalf("unexpected tables %+v", stats.Tables)
+	}
+	orders, wide := stats.Tables[0], stats.Tables[1]
+	if orders.Rows != 5 || orders.LeafPages != 1 || len(orders.Indexes) != 1 || orders.Indexes[0].Entries != 5 {
+		t.Errorf("unexpected orders stats %+v", orders)
+	}
+	keySize := len(encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_INT64, I64: 1}}))
+	valSize := len(encodeValues(nil, []Value{{Type: TYPE_BYTES, Str: pad}, {Type: TYPE_INT64}}))
+	if wide.Rows != 2000 || wide.AvgKeySize != float64(keySize) || wide.AvgValSize != float64(valSize) {
+		t.Errorf("unexpected wide stats %+v, expected keys of %d & values of %d bytes", wide, keySize, valSize)
+	}
+	// the rows take at least the pages their bytes fill
+	if min := 2000 * (keySize + valSize) / BTREE_PAGE_SIZE; wide.LeafPages < min || wide.InternalPages == 0 {
+		t.Errorf("expected at least %d leaf pages & some internal ones, got %+v", min, wide)
+	}
+	if idx := wide.Indexes[0]; idx.Entries != 2000 || idx.LeafPages < 2000*100/BTREE_PAGE_SIZE {
+		t.Errorf("unexpected index stats %+v", idx)
+	}
+	leaves := 0
+	for _, ts := range stats.Tables {
+		leaves += ts.LeafPages
+		for _, is := range ts.Indexes {
+			leaves += is.LeafPages
+		}
+	}
+	// the pages shared by two prefixes are counted twice, the catalog's are missing
+	if leaves < stats.LeafPages-2 || leaves > stats.LeafPages+4 {
+		t.Errorf("the leaves of the tables add up to %d, the tree has %d", leaves, stats.LeafPages)
+	}
+
+	stmt, err := parseStatement("STATS orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stmt.Exec(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Records) != 2 || !strings.HasPrefix(res.Message, "File ") {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if _, err := db.Stats("missing"); err == nil {
+		t.Error("expected an error for a missing table")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+	before := db.Metrics()
+
+	// a commit, an abort & a commit failing on a conflict
+	tx1, tx2, tx3 := &DBTX{}, &DBTX{}, &DBTX{}
+	db.Begin(tx1)
+	db.Begin(tx2)
+	db.Begin(tx3)
+	for _, tx := range []*DBTX{tx1, tx2} {
+		if _, err := tx.Set("orders", *(&Record{}).AddInt64("id", 9).AddStr("customer", []byte("x")).AddInt64("amount", 1), MODE_UPSERT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := db.BeginReadOnly()
+	if got := db.Metrics().ActiveReaders; got != 4 {
+		t.Errorf("expected 4 active readers, got %d", got)
+	}
+	if err := db.Commit(tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(tx2); !errors.Is(err, ErrSerialization) {
+		t.Fatalf("expected a serialization error, got %v", err)
+	}
+	db.Abort(tx3)
+	db.Commit(reader)
+	// a transaction without writes is not a commit
+	tx4 := &DBTX{}
+	db.Begin(tx4)
+	if _, err := tx4.Get("orders", (&Record{}).AddInt64("id", 9)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(tx4); err != nil {
+		t.Fatal(err)
+	}
+
+	m := db.Metrics()
+	if m.Commits-before.Commits != 1 || m.Aborts-before.Aborts != 2 {
+		t.Errorf("expected 1 commit & 2 aborts, got %d & %d", m.Commits-before.Commits, m.Aborts-before.Aborts)
+	}
+	if m.ActiveReaders != 0 {
+		t.Errorf("expected no active readers, got %d", m.ActiveReaders)
+	}
+	if m.CommitLatency.Count != m.Commits || m.PagesPerCommit.Count == 0 || m.FsyncLatency.Count < 2*m.PagesPerCommit.Count {
+		t.Errorf("unexpected histograms %+v %+v %+v", m.CommitLatency, m.PagesPerCommit, m.FsyncLatency)
+	}
+	if last := m.PagesPerCommit.Counts[len(m.PagesPerCommit.Counts)-1]; last != m.PagesPerCommit.Count {
+		t.Errorf("the last bucket holds %d values, expected %d", last, m.PagesPerCommit.Count)
+	}
+	if m.FreePages != db.kv.free.Total() {
+		t.Errorf("expected %d free pages, got %d", db.kv.free.Total(), m.FreePages)
+	}
+
+	srv := httptest.NewServer(db.MetricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE atomixdb_commits_total counter",
+		fmt.Sprintf("atomixdb_commits_total %d", m.Commits),
+		fmt.Sprintf("atomixdb_aborts_total %d", m.Aborts),
+		"# TYPE atomixdb_commit_duration_seconds histogram",
+		fmt.Sprintf("atomixdb_commit_duration_seconds_bucket{le=\"+Inf\"} %d", m.Commits),
+		fmt.Sprintf("atomixdb_commit_pages_count %d", m.PagesPerCommit.Count),
+		"atomixdb_active_readers 0",
+		"atomixdb_worker_queue_depth 0",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected the line %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupOrdersTable(t, db)
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, slog.LevelDebug, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetLogger(logger)
+
+	// off by default
+	if _, err := db.Exec("SELECT * FROM orders", nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "slow query") {
+		t.Fatalf("unexpected slow query log:\n%s", buf.String())
+	}
+	if _, err := db.Exec("SET slow_query_threshold = '1ns'", nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.SlowQueryThreshold() != time.Nanosecond {
+		t.Fatalf("expected a threshold of 1ns, got %v", db.SlowQueryThreshold())
+	}
+
+	tests := []struct {
+		query   string
+		path    string
+		scanned int
+	}{
+		{"SELECT * FROM orders", "full scan", 5},
+		{"SELECT customer FROM orders WHERE id = 2", "lookup on primary key", 1},
+		{"SELECT id FROM orders WHERE amount > 20", "range of index (amount, id) only", 3},
+		{"SELECT * FROM orders WHERE amount IN (5, 50)", "2 lookups on index (amount, id)", 2},
+		{"SELECT COUNT(*) FROM orders WHERE customer = 'ann'", "full scan", 5},
+		{"UPDATE orders SET amount = amount + 1 WHERE id >= 4", "range of primary key", 2},
+		{"DELETE FROM orders WHERE customer = 'cid'", "full scan", 5},
+		{"SELECT * FROM @tables", "system table", 1},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if _, err := db.Exec(tt.query, nil); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var entry struct {
+			Level       string
+			Msg         string
+			Statement   string
+			Table       string
+			AccessPath  string `json:"access_path"`
+			RowsScanned int    `json:"rows_scanned"`
+			Duration    int64
+		}
+		found := false
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%s: invalid log line %q: %v", tt.query, line, err)
+			}
+			if entry.Msg == "slow query" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s: no slow query log in\n%s", tt.query, buf.String())
+			continue
+		}
+		if entry.Level != "WARN" || entry.Statement != tt.query || entry.AccessPath != tt.path ||
+			entry.RowsScanned != tt.scanned || entry.Duration <= 0 {
+			t.Errorf("%s: unexpected log entry %+v", tt.query, entry)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "atomixdb.json")
+	data := `{"path": "shop.db", "mmap_initial": "1MB", "max_workers": 8, "worker_idle_timeout": "5s", "sort_memory": 65536}`
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ATOMIXDB_MAX_WORKERS", "4")
+	t.Setenv("ATOMIXDB_SLOW_QUERY_THRESHOLD", "250")
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Path != "shop.db" || cfg.MmapInitial != 1<<20 || cfg.MaxWorkers != 4 || cfg.WorkerIdleTimeout != 5*time.Second ||
+		cfg.SortMemory != 65536 || cfg.SlowQueryThreshold != 250*time.Millisecond || cfg.FileGrowth != DEFAULT_FILE_GROWTH {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.sources["path"] != file || cfg.sources["max_workers"] != "env" || cfg.sources["file_growth"] != "" {
+		t.Errorf("unexpected sources %v", cfg.sources)
+	}
+
+	errorTests := []struct {
+		data     string
+		env      string
+		expected string
+	}{
+		{`{"max_wokers": 2}`, "", `unknown setting "max_wokers"`},
+		{`{"mmap_initial": 1000}`, "", "mmap_initial: must be a multiple of the page size"},
+		{`{"file_growth": 0}`, "", "file_growth: must be at least 1"},
+		{`{"worker_idle_timeout": true}`, "", "worker_idle_timeout: expected a string or a number"},
+		{`{"statement_timeout": "soon"}`, "", "statement_timeout: invalid timeout: soon"},
+		{`{"statement_timeout": -5}`, "", "statement_timeout: invalid timeout: -5"},
+		{`{"path": "a.db"`, "", "unexpected EOF"},
+		{`{}`, "many", "ATOMIXDB_MAX_RANGE_ROWS: invalid number: many"},
+	}
+	for _, tt := range errorTests {
+		if err := os.WriteFile(file, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("ATOMIXDB_MAX_RANGE_ROWS", tt.env)
+		if tt.env == "" {
+			os.Unsetenv("ATOMIXDB_MAX_RANGE_ROWS")
+		}
+		_, err := LoadConfig(file)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s %s: expected an error with %q, got %v", tt.data, tt.env, tt.expected, err)
+		}
+	}
+
+	// the settings of a config built in code are checked too
+	rangeTests := []struct {
+		set      func(c *Config)
+		expected string
+	}{
+		{func(c *Config) { c.StatementTimeout = -time.Second }, "statement_timeout: must not be negative"},
+		{func(c *Config) { c.IdleTimeout = -time.Second }, "idle_in_transaction_timeout: must not be negative"},
+		{func(c *Config) { c.SortMemory = 0 }, "sort_memory: must be positive"},
+		{func(c *Config) { c.SortMemory = -1 }, "sort_memory: must be positive"},
+		{func(c *Config) { c.SlowQueryThreshold = -time.Millisecond }, "slow_query_threshold: must not be negative"},
+	}
+	for _, tt := range rangeTests {
+		c := DefaultConfig()
+		tt.set(c)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("expected an error with %q, got %v", tt.expected, err)
+		}
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("unexpected error for the defaults: %v", err)
+	}
+
+	// the engine uses the settings
+	cfg.Path = filepath.Join(dir, "shop.db")
+	db := newDB(cfg)
+	if err := db.kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db)
+	if db.kv.mmap.total != 1<<20 || db.pool.maxWorkers != 4 || db.SortMemory() != 65536 {
+		t.Errorf("expected the configured engine, got mmap %d, %d workers, sort memory %d",
+			db.kv.mmap.total, db.pool.maxWorkers, db.SortMemory())
+	}
+	if _, err := db.Exec("SET sort_memory = '1MB'", nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("SHOW CONFIG", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]string{}
+	for _, rec := range res.Records {
+		settings[string(rec.Vals[0].Str)] = string(rec.Vals[1].Str) + " " + string(rec.Vals[2].Str)
+	}
+	expected := map[string]string{
+		"path":                 cfg.Path + " " + file,
+		"mmap_initial":         "1048576 " + file,
+		"file_growth":          "8 default",
+		"max_workers":          "4 env",
+		"max_range_rows":       "500 default",
+		"sort_memory":          "1048576 SET",
+		"slow_query_threshold": "250ms env",
+	}
+	for name, value := range expected {
+		if settings[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, settings[name])
+		}
+	}
+	if len(settings) != len(configSettings) {
+		t.Errorf("expected %d settings, got %v", len(configSettings), settings)
+	}
+}
+
+func TestFileLocking(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "locked.db")
+	open := func(readOnly bool) (*DB, error) {
+		db := newDB(cfg)
+		db.kv.ReadOnly = readOnly
+		if err := db.kv.Open(); err != nil {
+			db.pool.Stop()
+			return nil, err
+		}
+		return db, nil
+	}
+
+	writer, err := open(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeInternalTables(writer); err != nil {
+		t.Fatal(err)
+	}
+	setupOrdersTable(t, writer)
+	for _, readOnly := range []bool{false, true} {
+		if _, err := open(readOnly); !errors.Is(err, ErrLocked) {
+			t.Errorf("read-only %v: expected ErrLocked while a writer has the file, got %v", readOnly, err)
+		}
+	}
+	closeDB(writer)
+
+	// readers share the file & keep the writers out
+	var readers []*DB
+	for i := 0; i < 2; i++ {
+		reader, err := open(true)
+		if err != nil {
+			t.Fatalf("reader %d: %v", i, err)
+		}
+		defer closeDB(reader)
+		readers = append(readers, reader)
+	}
+	if _, err := open(false); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked while readers have the file, got %v", err)
+	}
+	rows := queryRows(t, readers[1], nil, "SELECT id FROM orders WHERE amount > 20 ORDER BY id")
+	if strings.Join(rows, ",") != "1,3,5" {
+		t.Errorf("unexpected rows %v", rows)
+	}
+	if _, err := readers[0].Exec("DELETE FROM orders WHERE id = 1", nil); !errors.Is(err, ErrReadOnlyDB) {
+		t.Errorf("expected ErrReadOnlyDB, got %v", err)
+	}
+}
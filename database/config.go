@@ -0,0 +1,278 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration
+// the engine settings, read at startup from a JSON file & the environment,
+// the environment winning. every setting has a variable named ATOMIXDB_ &
+// its name in upper case:
+//
+//	{"path": "shop.db", "mmap_initial": "128MB", "max_workers": 8}
+//	ATOMIXDB_WORKER_IDLE_TIMEOUT=5s
+//
+// sizes take a kB, MB or GB suffix, durations are Go durations or plain
+// milliseconds like in SET.
+
+// the config file read when none is given
+const DEFAULT_CONFIG_FILE = "atomixdb.json"
+
+const (
+	DEFAULT_MMAP_INITIAL   = 64 << 20 // bytes mapped when the file is opened
+	DEFAULT_FILE_GROWTH    = 8        // the file grows by 1/8 of its size
+	DEFAULT_MAX_WORKERS    = 3
+	DEFAULT_WORKER_IDLE    = 2 * time.Second
+	DEFAULT_MAX_RANGE_ROWS = 500 // the rows of `DB.GetRange`
+)
+
+type Config struct {
+	Path               string
+	MmapInitial        int // bytes, a multiple of the page size
+	FileGrowth         int // the file grows by 1/FileGrowth of its size, at least a page
+	MaxWorkers         int
+	WorkerIdleTimeout  time.Duration // an idle worker stops after it
+	MaxRangeRows       int
+	StatementTimeout   time.Duration // the defaults of the SET settings
+	IdleTimeout        time.Duration
+	SortMemory         int
+	SlowQueryThreshold time.Duration
+	// where the settings that are not defaults come from, by name:
+	// the config file, "env" or "flag"
+	sources map[string]string
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Path:              fileName,
+		MmapInitial:       DEFAULT_MMAP_INITIAL,
+		FileGrowth:        DEFAULT_FILE_GROWTH,
+		MaxWorkers:        DEFAULT_MAX_WORKERS,
+		WorkerIdleTimeout: DEFAULT_WORKER_IDLE,
+		MaxRangeRows:      DEFAULT_MAX_RANGE_ROWS,
+		IdleTimeout:       DefaultTXTimeouts.Idle,
+		SortMemory:        DEFAULT_SORT_MEMORY,
+		sources:           map[string]string{},
+	}
+}
+
+type configSetting struct {
+	name  string
+	size  bool // an int in bytes, with a unit
+	field func(c *Config) any
+}
+
+var configSettings = []configSetting{
+	{"path", false, func(c *Config) any { return &c.Path }},
+	{"mmap_initial", true, func(c *Config) any { return &c.MmapInitial }},
+	{"file_growth", false, func(c *Config) any { return &c.FileGrowth }},
+	{"max_workers", false, func(c *Config) any { return &c.MaxWorkers }},
+	{"worker_idle_timeout", false, func(c *Config) any { return &c.WorkerIdleTimeout }},
+	{"max_range_rows", false, func(c *Config) any { return &c.MaxRangeRows }},
+	{"statement_timeout", false, func(c *Config) any { return &c.StatementTimeout }},
+	{"idle_in_transaction_timeout", false, func(c *Config) any { return &c.IdleTimeout }},
+	{"sort_memory", true, func(c *Config) any { return &c.SortMemory }},
+	{"slow_query_threshold", false, func(c *Config) any { return &c.SlowQueryThreshold }},
+}
+
+func (s configSetting) env() string {
+	return "ATOMIXDB_" + strings.ToUpper(s.name)
+}
+
+func (s configSetting) set(c *Config, v string) error {
+	switch p := s.field(c).(type) {
+	case *string:
+		if v == "" {
+			return errors.New("must not be empty")
+		}
+		*p = v
+	case *int:
+		if s.size {
+			n, err := parseSize(v)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", v)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := parseTimeout(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		*p = d
+	}
+	return nil
+}
+
+func (s configSetting) get(c *Config) string {
+	switch p := s.field(c).(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+func (c *Config) setSource(name, source string) {
+	if c.sources == nil {
+		c.sources = map[string]string{}
+	}
+	c.sources[name] = source
+}
+
+// the defaults, overridden by the config file & then by the environment.
+// an empty `file` reads DEFAULT_CONFIG_FILE if it exists.
+func LoadConfig(file string) (*Config, error) {
+	c := DefaultConfig()
+	if file == "" {
+		if _, err := os.Stat(DEFAULT_CONFIG_FILE); err == nil {
+			file = DEFAULT_CONFIG_FILE
+		}
+	}
+	if file != "" {
+		if err := c.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range configSettings {
+		v, ok := os.LookupEnv(s.env())
+		if !ok {
+			continue
+		}
+		if err := s.set(c, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env(), err)
+		}
+		c.setSource(s.name, "env")
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// a JSON object of the settings, the values are strings or numbers
+func (c *Config) readFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	var values map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for name, raw := range values {
+		s := findSetting(name)
+		if s == nil {
+			return fmt.Errorf("%s: unknown setting %q", file, name)
+		}
+		v := string(raw)
+		if len(raw) > 0 && raw[0] == '"' {
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("%s: %s: %w", file, name, err)
+			}
+		} else if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%s: %s: expected a string or a number, got %s", file, name, v)
+		}
+		if err := s.set(c, v); err != nil {
+			return fmt.Errorf("%s: %s: %w", file, name, err)
+		}
+		c.setSource(name, file)
+	}
+	return nil
+}
+
+func findSetting(name string) *configSetting {
+	for i := range configSettings {
+		if configSettings[i].name == name {
+			return &configSettings[i]
+		}
+	}
+	return nil
+}
+
+// check the ranges of the settings
+func (c *Config) Validate() error {
+	var err error
+	switch {
+	case c.Path == "":
+		err = errors.New("path: must not be empty")
+	case c.MmapInitial < BTREE_PAGE_SIZE || c.MmapInitial%BTREE_PAGE_SIZE != 0:
+		err = fmt.Errorf("mmap_initial: must be a multiple of the page size, %d bytes", BTREE_PAGE_SIZE)
+	case c.FileGrowth < 1:
+		err = errors.New("file_growth: must be at least 1")
+	case c.MaxWorkers < 1:
+		err = errors.New("max_workers: must be at least 1")
+	case c.WorkerIdleTimeout <= 0:
+		err = errors.New("worker_idle_timeout: must be positive")
+	case c.MaxRangeRows < 1:
+		err = errors.New("max_range_rows: must be at least 1")
+	case c.StatementTimeout < 0:
+		err = errors.New("statement_timeout: must not be negative")
+	case c.IdleTimeout < 0:
+		err = errors.New("idle_in_transaction_timeout: must not be negative")
+	case c.SortMemory < 1:
+		err = errors.New("sort_memory: must be positive")
+	case c.SlowQueryThreshold < 0:
+		err = errors.New("slow_query_threshold: must not be negative")
+	}
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// the settings the database was opened with, the SET settings with their
+// current values
+func (db *DB) Config() *Config {
+	c := DefaultConfig()
+	if db.config != nil {
+		*c = *db.config
+	}
+	t := db.Timeouts()
+	c.StatementTimeout, c.IdleTimeout = t.Statement, t.Idle
+	c.SortMemory = db.SortMemory()
+	c.SlowQueryThreshold = db.SlowQueryThreshold()
+	return c
+}
+
+// SHOW CONFIG, the effective settings & where they come from
+func showConfig(db *DB) *StatementResult {
+	res := &StatementResult{Records: []*Record{}}
+	opened := db.config
+	if opened == nil {
+		opened = DefaultConfig()
+	}
+	current := db.Config()
+	for _, s := range configSettings {
+		value := s.get(current)
+		source := opened.sources[s.name]
+		switch {
+		case value != s.get(opened):
+			source = "SET"
+		case source == "":
+			source = "default"
+		}
+		res.Records = append(res.Records, &Record{
+			Cols: []string{"name", "value", "source"},
+			Vals: []Value{bytesValue(s.name), bytesValue(value), bytesValue(source)},
+		})
+	}
+	return res
+}
@@ -0,0 +1,324 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the rows an IMPORT writes per transaction
+const DEFAULT_IMPORT_BATCH = 1000
+
+// the rejected rows an IMPORT reports one by one
+const MAX_REPORTED_ERRORS = 10
+
+type CSVOptions struct {
+	Delimiter  rune // ',' if 0
+	Quote      rune // '"' if 0
+	SkipErrors bool // skip the rows that cannot be imported instead of stopping
+	BatchSize  int  // rows per transaction, DEFAULT_IMPORT_BATCH if 0
+}
+
+func (o CSVOptions) withDefaults() CSVOptions {
+	if o.Delimiter == 0 {
+		o.Delimiter = ','
+	}
+	if o.Quote == 0 {
+		o.Quote = '"'
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DEFAULT_IMPORT_BATCH
+	}
+	return o
+}
+
+type ImportResult struct {
+	Imported int
+	Rejected int
+	Errors   []string // the first rejected rows & why
+}
+
+// IMPORT table FROM 'file' [DELIMITER 'c'] [QUOTE 'c'] [ON ERROR SKIP | ABORT] [BATCH n]
+type ImportStmt struct {
+	Table string
+	File  string
+	Opts  CSVOptions
+}
+
+// EXPORT table TO 'file' [DELIMITER 'c'] [QUOTE 'c']
+type ExportStmt struct {
+	Table string
+	File  string
+	Opts  CSVOptions
+}
+
+func (s *ImportStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if err := writableTableCheck(s.Table); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.File)
+	if err != nil {
+		return nil, fmt.Errorf("IMPORT: %w", err)
+	}
+	defer f.Close()
+	res, err := db.ImportCSV(tx, s.Table, f, s.Opts)
+	if err != nil {
+		if res.Imported > 0 {
+			imported := strings.TrimSuffix(rowsMessage(res.Imported, "imported"), ".")
+			return nil, fmt.Errorf("%w (%s before the error)", err, imported)
+		}
+		return nil, err
+	}
+	lines := append([]string{}, res.Errors...)
+	if n := res.Rejected - len(res.Errors); n > 0 {
+		lines = append(lines, fmt.Sprintf("... and %d more", n))
+	}
+	msg := rowsMessage(res.Imported, "imported")
+	if res.Rejected > 0 {
+		msg = fmt.Sprintf("%s %s", msg, rowsMessage(res.Rejected, "rejected"))
+	}
+	lines = append(lines, msg)
+	return &StatementResult{Message: strings.Join(lines, "\n"), RowsAffected: res.Imported}, nil
+}
+
+func (s *ExportStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	f, err := os.Create(s.File)
+	if err != nil {
+		return nil, fmt.Errorf("EXPORT: %w", err)
+	}
+	n, err := db.ExportCSV(tx, s.Table, f, s.Opts)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("EXPORT: %w", cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: rowsMessage(n, "exported"), RowsAffected: n}, nil
+}
+
+// insert the rows of a CSV file whose header names the columns. outside of
+// a transaction the rows are committed in batches, the batches committed
+// before an error are kept. inside one, the rows are written to it.
+func (db *DB) ImportCSV(tx *DBTX, table string, r io.Reader, opts CSVOptions) (*ImportResult, error) {
+	opts = opts.withDefaults()
+	res := &ImportResult{}
+	if err := writableTableCheck(table); err != nil {
+		return res, err
+	}
+	cr := newCSVReader(r, opts)
+	header, _, err := cr.read()
+	if errors.Is(err, io.EOF) {
+		return res, fmt.Errorf("IMPORT: the file has no header")
+	}
+	if err != nil {
+		return res, err
+	}
+	tdef := getTableDefTX(db, table, tx)
+	if tdef == nil {
+		return res, fmt.Errorf("table not found: %s", table)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	pos, err := insertColumns(tdef, header)
+	if err != nil {
+		return res, fmt.Errorf("IMPORT header: %w", err)
+	}
+
+	batch := opts.BatchSize
+	if tx != nil {
+		batch = 0 // everything goes to the session's transaction
+	}
+	for done := false; !done; {
+		imported, rejected, errs := 0, 0, []string(nil)
+		err := inWriteTX(db, tx, func(tx *DBTX) error {
+			for batch == 0 || imported+rejected < batch {
+				fields, line, err := cr.read()
+				if errors.Is(err, io.EOF) {
+					done = true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				err = importRow(db, tdef, pos, fields, &tx.kv)
+				if err == nil {
+					imported++
+					continue
+				}
+				if !opts.SkipErrors {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+				rejected++
+				errs = append(errs, fmt.Sprintf("line %d: %v", line, err))
+			}
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		res.Imported += imported
+		res.Rejected += rejected
+		for _, e := range errs {
+			if len(res.Errors) < MAX_REPORTED_ERRORS {
+				res.Errors = append(res.Errors, e)
+			}
+		}
+	}
+	return res, nil
+}
+
+func importRow(db *DB, tdef *TableDef, pos []int, fields []string, kvtx *KVTX) error {
+	if len(fields) != len(pos) {
+		return fmt.Errorf("expected %d fields, got %d", len(pos), len(fields))
+	}
+	vals := make([]Value, len(tdef.Cols))
+	for i, field := range fields {
+		v, err := parseCSVValue(field, tdef.Types[pos[i]])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", tdef.Cols[pos[i]], err)
+		}
+		vals[pos[i]] = v
+	}
+	_, err := dbUpdate(db, tdef, Record{Cols: tdef.Cols, Vals: vals}, MODE_INSERT_ONLY, kvtx)
+	return err
+}
+
+func parseCSVValue(field string, typ uint32) (Value, error) {
+	switch typ {
+	case TYPE_INT64:
+		n, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid integer %q", field)
+		}
+		return Value{Type: TYPE_INT64, I64: n}, nil
+	case TYPE_FLOAT64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid number %q", field)
+		}
+		return Value{Type: TYPE_FLOAT64, F64: f}, nil
+	default:
+		return Value{Type: TYPE_BYTES, Str: []byte(field)}, nil
+	}
+}
+
+// write the rows of the table in primary key order, after a header with
+// the column names. returns the number of rows.
+func (db *DB) ExportCSV(tx *DBTX, table string, w io.Writer, opts CSVOptions) (int, error) {
+	opts = opts.withDefaults()
+	tdef := getTableDefTX(db, table, tx)
+	if tdef == nil {
+		return 0, fmt.Errorf("table not found: %s", table)
+	}
+	bw := bufio.NewWriter(w)
+	writeCSVRecord(bw, tdef.Cols, opts)
+	n := 0
+	stmt := &SelectStmt{Items: []SelectItem{{}}, From: TableRef{Name: table}}
+	err := stmt.Query(db, tx, func(rec *Record) error {
+		fields := make([]string, len(rec.Vals))
+		for i, v := range rec.Vals {
+			fields[i] = formatValue(v)
+		}
+		writeCSVRecord(bw, fields, opts)
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("EXPORT: %w", err)
+	}
+	return n, nil
+}
+
+// fields holding the delimiter, the quote or a line break are quoted,
+// with the quotes inside doubled
+func writeCSVRecord(w *bufio.Writer, fields []string, opts CSVOptions) {
+	quote := string(opts.Quote)
+	for i, field := range fields {
+		if i > 0 {
+			w.WriteRune(opts.Delimiter)
+		}
+		if strings.ContainsRune(field, opts.Delimiter) || strings.Contains(field, quote) ||
+			strings.ContainsAny(field, "\r\n") {
+			field = quote + strings.ReplaceAll(field, quote, quote+quote) + quote
+		}
+		w.WriteString(field)
+	}
+	w.WriteString("\n")
+}
+
+// reads the records of a CSV file, quoted fields may span lines
+type csvReader struct {
+	r    *bufio.Reader
+	opts CSVOptions
+	line int // the line being read
+}
+
+func newCSVReader(r io.Reader, opts CSVOptions) *csvReader {
+	return &csvReader{r: bufio.NewReader(r), opts: opts, line: 1}
+}
+
+// the fields of the next record & the line it starts on, io.EOF at the
+// end. blank lines are skipped.
+func (c *csvReader) read() ([]string, int, error) {
+	var fields []string
+	var field strings.Builder
+	start := c.line
+	started := false // anything read on the record
+	quoted := false  // inside a quoted field
+	for {
+		ch, _, err := c.r.ReadRune()
+		if errors.Is(err, io.EOF) {
+			if quoted {
+				return nil, start, fmt.Errorf("line %d: unterminated quoted field", start)
+			}
+			if !started {
+				return nil, start, io.EOF
+			}
+			return append(fields, field.String()), start, nil
+		}
+		if err != nil {
+			return nil, start, err
+		}
+		if ch == '\n' {
+			c.line++
+		}
+		switch {
+		case quoted && ch == c.opts.Quote:
+			if next, _, err := c.r.ReadRune(); err == nil && next == c.opts.Quote {
+				field.WriteRune(ch) // a doubled quote
+			} else {
+				if err == nil {
+					c.r.UnreadRune()
+				}
+				quoted = false
+			}
+		case quoted:
+			field.WriteRune(ch)
+		case ch == c.opts.Quote && field.Len() == 0:
+			quoted, started = true, true
+		case ch == c.opts.Delimiter:
+			fields = append(fields, field.String())
+			field.Reset()
+			started = true
+		case ch == '\r':
+			// part of the line break that follows
+		case ch == '\n':
+			if !started {
+				start = c.line // a blank line
+				continue
+			}
+			return append(fields, field.String()), start, nil
+		default:
+			field.WriteRune(ch)
+			started = true
+		}
+	}
+}
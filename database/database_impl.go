@@ -2,10 +2,9 @@ package database
 
 import (
 	"atomixDB/database/helper"
-	"bufio"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -18,15 +17,24 @@ func newKV(filename string) *KV {
 	}
 }
 
-func newDB() *DB {
-	return &DB{
-		Path:   fileName,
-		kv:     *newKV(fileName),
-		tables: make(map[string]*TableDef),
-		pool:   NewPool(3),
+func newDB(cfg *Config) *DB {
+	db := &DB{
+		Path:         cfg.Path,
+		kv:           *newKV(cfg.Path),
+		tables:       make(map[string]*TableDef),
+		pool:         NewPoolTimeout(cfg.MaxWorkers, cfg.WorkerIdleTimeout),
+		timeouts:     TXTimeouts{Statement: cfg.StatementTimeout, Idle: cfg.IdleTimeout},
+		sortMemory:   cfg.SortMemory,
+		slowQuery:    cfg.SlowQueryThreshold,
+		maxRangeRows: cfg.MaxRangeRows,
+		config:       cfg,
 	}
+	db.kv.mmapInitial = cfg.MmapInitial
+	db.kv.fileGrowth = cfg.FileGrowth
+	return db
 }
 
+// the database file when none is given
 const fileName string = "database.db"
 
 func initializeInternalTables(db *DB) error {
@@ -51,63 +59,112 @@ func initializeInternalTables(db *DB) error {
 
 var ErrTableAlreadyExists error = errors.New("table already exists")
 
-func StartDB() {
-	scanner := bufio.NewReader(os.Stdin)
-	db := newDB()
-	if err := db.kv.Open(); err != nil {
-		log.Fatalf("Failed to open  %v", err)
+// open the database & run the session the options describe, returns the
+// exit code
+func StartDB(opts Options) int {
+	cfg, err := LoadConfig(opts.Config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return EXIT_USAGE
+	}
+	if opts.Path != "" {
+		cfg.Path = opts.Path
+		cfg.setSource("path", "flag")
 	}
-	err := initializeInternalTables(db)
+	if opts.SlowQuerySet {
+		cfg.SlowQueryThreshold = opts.SlowQuery
+		cfg.setSource("slow_query_threshold", "flag")
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return EXIT_USAGE
+	}
+	db := newDB(cfg)
+	db.kv.ReadOnly = opts.ReadOnly
+	logOut := io.Writer(os.Stderr)
+	if opts.LogFile != "" {
+		f, err := os.OpenFile(opts.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			db.pool.Stop()
+			return EXIT_USAGE
+		}
+		defer f.Close()
+		logOut = f
+	}
+	logger, err := NewLogger(logOut, opts.LogLevel, opts.LogFormat)
 	if err != nil {
-		if !errors.Is(err, ErrTableAlreadyExists) {
-			fmt.Println("Error while init table: ", err)
-			os.Exit(0)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		db.pool.Stop()
+		return EXIT_USAGE
+	}
+	db.SetLogger(logger)
+	if err := db.kv.Open(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", cfg.Path, err)
+		db.pool.Stop()
+		return EXIT_USAGE
+	}
+	// a read-only file has them already, or is empty
+	if !opts.ReadOnly {
+		if err := initializeInternalTables(db); err != nil && !errors.Is(err, ErrTableAlreadyExists) {
+			fmt.Fprintln(os.Stderr, "Error while init table:", err)
+			closeDB(db)
+			return EXIT_USAGE
 		}
 	}
+	if opts.Metrics != "" {
+		srv, err := db.ServeMetrics(opts.Metrics)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			closeDB(db)
+			return EXIT_USAGE
+		}
+		defer srv.Close()
+	}
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
-		shutdownDB(db)
+		closeDB(db)
+		if opts.Interactive {
+			fmt.Println("Exiting...")
+			os.Exit(EXIT_OK)
+		}
+		os.Exit(EXIT_FAILURE)
 	}()
 
-	commands := RegisterCommands()
-	var currentTX *DBTX
-	helper.PrintWelcomeMessage(true)
-
-	for {
-		fmt.Print("> ")
-		line, _, err := scanner.ReadLine()
+	var s *session
+	switch {
+	case opts.Command != "":
+		s = newSession(db, strings.NewReader(opts.Command), "-c", false)
+	case opts.File != "" && opts.File != "-":
+		f, err := os.Open(opts.File)
 		if err != nil {
-			fmt.Println("Error reading input:", err)
-			continue
-		}
-
-		command := strings.ToLower(strings.TrimSpace(string(line)))
-		if handler, exists := commands[command]; exists {
-			switch command {
-			case "begin":
-				currentTX = HandleBegin(scanner, db, currentTX)
-			case "commit":
-				currentTX = HandleCommit(scanner, db, currentTX)
-			case "abort":
-				currentTX = HandleAbort(scanner, db, currentTX)
-			default:
-				handler(scanner, db, currentTX)
-			}
-		} else if command == "exit" {
-			shutdownDB(db)
-			break
-		} else {
-			fmt.Println("Unknown command:", command)
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			closeDB(db)
+			return EXIT_USAGE
 		}
+		defer f.Close()
+		s = newSession(db, f, opts.File, false)
+	default:
+		s = newSession(db, os.Stdin, "stdin", opts.Interactive)
+	}
+	if opts.Format != "" {
+		s.output.Format = opts.Format
+	}
+	if opts.Interactive {
+		helper.PrintWelcomeMessage(true)
+	}
+	code := s.run()
+	closeDB(db)
+	if opts.Interactive {
+		fmt.Println("Exiting...")
 	}
+	return code
 }
 
-func shutdownDB(db *DB) {
+func closeDB(db *DB) {
 	db.kv.Close()
 	db.pool.Stop()
-	fmt.Println("Exiting...")
-	os.Exit(0)
 }
@@ -0,0 +1,476 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// INSERT INTO table [(cols)] VALUES (exprs), ... [ON CONFLICT ...] [RETURNING items]
+type InsertStmt struct {
+	Table      string
+	Cols       []string // every column in table order if empty
+	Rows       [][]Expr
+	OnConflict *OnConflict
+	Returning  []SelectItem
+}
+
+// ON CONFLICT [(pk)] DO NOTHING | DO UPDATE SET col = expr, ... [WHERE cond]
+// the expressions see the existing row & the proposed one as `excluded`.
+type OnConflict struct {
+	Cols  []string
+	Set   []Assignment // DO NOTHING if empty
+	Where Expr
+}
+
+// UPDATE table SET col = expr, ... [WHERE cond] [RETURNING items]
+type UpdateStmt struct {
+	Table     string
+	Set       []Assignment
+	Where     Expr
+	Returning []SelectItem
+	info      *ScanInfo
+}
+
+type Assignment struct {
+	Col  string
+	Expr Expr // evaluated against the old row
+}
+
+// DELETE FROM table [WHERE cond] [RETURNING items]
+type DeleteStmt struct {
+	Table     string
+	Where     Expr
+	Returning []SelectItem
+	info      *ScanInfo
+}
+
+// run `fn` in the session's transaction, or in one of its own that is
+// committed when `fn` succeeds. a statement that fails inside the
+// session's transaction leaves no changes behind.
+func inWriteTX(db *DB, tx *DBTX, fn func(tx *DBTX) error) error {
+	if tx == nil {
+		tx = &DBTX{}
+		db.beginInternal(tx)
+		if err := fn(tx); err != nil {
+			db.Abort(tx)
+			return err
+		}
+		return db.Commit(tx)
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
+	// savepoints named by users are identifiers, never empty
+	tx.kv.Savepoint("")
+	err := fn(tx)
+	if err != nil {
+		tx.kv.RollbackTo("")
+	}
+	tx.kv.Release("")
+	return err
+}
+
+// the rows of the table the condition holds for, read through the
+// ranges it implies. they are collected before any is changed.
+func matchingRows(db *DB, tx *DBTX, table string, where Expr, info *ScanInfo) ([][]Value, error) {
+	stmt := &SelectStmt{Items: []SelectItem{{}}, From: TableRef{Name: table}, Where: where, info: info}
+	var rows [][]Value
+	err := stmt.run(db, tx, &tx.kv.KVReader, func(rec *Record) error {
+		rows = append(rows, rec.Vals)
+		return nil
+	})
+	return rows, err
+}
+
+func (s *InsertStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	var out *returning
+	inserted, updated := 0, 0
+	if err := writableTableCheck(s.Table); err != nil {
+		return nil, err
+	}
+	err := inWriteTX(db, tx, func(tx *DBTX) error {
+		tdef := tx.tableDef(s.Table)
+		if tdef == nil {
+			return fmt.Errorf("table not found: %s", s.Table)
+		}
+		// the position in the row of each listed column
+		pos, err := insertColumns(tdef, s.Cols)
+		if err != nil {
+			return err
+		}
+		var set []Expr
+		var where Expr
+		if s.OnConflict != nil {
+			if set, where, err = s.OnConflict.bind(s.Table, tdef); err != nil {
+				return err
+			}
+		}
+		if out, err = newReturning(s.Returning, s.Table, tdef); err != nil {
+			return err
+		}
+
+		for _, list := range s.Rows {
+			if len(list) != len(pos) {
+				return fmt.Errorf("expected %d values, got %d", len(pos), len(list))
+			}
+			vals := make([]Value, len(tdef.Cols))
+			for i, e := range list {
+				// the values are constants, there is no row to refer to
+				bound, err := bindWhere(e, &schema{})
+				if err != nil {
+					return err
+				}
+				if vals[pos[i]], err = bound.Eval(nil); err != nil {
+					return err
+				}
+				if err := checkColumnValue(tdef, pos[i], vals[pos[i]]); err != nil {
+					return err
+				}
+			}
+			rec := Record{Cols: tdef.Cols, Vals: vals}
+			_, err := dbUpdate(db, tdef, rec, MODE_INSERT_ONLY, &tx.kv)
+			if err == nil {
+				inserted++
+				if err := out.add(vals); err != nil {
+					return err
+				}
+				continue
+			}
+			if !errors.Is(err, ErrRecordExists) || s.OnConflict == nil {
+				return err
+			}
+			if set == nil {
+				continue // DO NOTHING
+			}
+			ok, err := upsertRow(db, tdef, tx, vals, set, where, out)
+			if err != nil {
+				return err
+			}
+			if ok {
+				updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := rowsMessage(inserted, "inserted")
+	if updated > 0 {
+		msg += " " + rowsMessage(updated, "updated")
+	}
+	return out.result(&StatementResult{Message: msg, RowsAffected: inserted + updated}), nil
+}
+
+// the position in the row of each column of an INSERT, which must name
+// every column once as they cannot be NULL
+func insertColumns(tdef *TableDef, cols []string) ([]int, error) {
+	if len(cols) == 0 {
+		cols = tdef.Cols
+	}
+	pos := make([]int, len(cols))
+	seen := make([]bool, len(tdef.Cols))
+	for i, col := range cols {
+		idx := ColIndex(tdef, col)
+		if idx < 0 {
+			return nil, fmt.Errorf("column %s not found", col)
+		}
+		if seen[idx] {
+			return nil, fmt.Errorf("column %s specified more than once", col)
+		}
+		seen[idx] = true
+		pos[i] = idx
+	}
+	for i, ok := range seen {
+		if !ok {
+			return nil, fmt.Errorf("column %s cannot be NULL", tdef.Cols[i])
+		}
+	}
+	return pos, nil
+}
+
+// the expressions of DO UPDATE, bound to rows of [existing row..., proposed
+// row...]. columns without a table refer to the existing row.
+func (oc *OnConflict) bind(table string, tdef *TableDef) ([]Expr, Expr, error) {
+	if len(oc.Cols) > 0 {
+		if len(oc.Cols) != tdef.PKeys {
+			return nil, nil, fmt.Errorf("ON CONFLICT must name the primary key")
+		}
+		for _, col := range oc.Cols {
+			if idx := ColIndex(tdef, col); idx < 0 || idx >= tdef.PKeys {
+				return nil, nil, fmt.Errorf("ON CONFLICT must name the primary key, got %s", col)
+			}
+		}
+	}
+	if len(oc.Set) == 0 {
+		return nil, nil, nil
+	}
+	sch := tableSchema(table, tdef)
+	excluded := tableSchema("excluded", tdef)
+	sch = &schema{
+		tables: append(append([]string{}, sch.tables...), excluded.tables...),
+		cols:   append(append([]string{}, sch.cols...), excluded.cols...),
+	}
+	bind := func(e Expr) (Expr, error) {
+		if e == nil {
+			return nil, nil
+		}
+		e, err := qualifyColumns(e, table)
+		if err != nil {
+			return nil, err
+		}
+		return bindWhere(e, sch)
+	}
+	set, err := bindAssignments(oc.Set, tdef, bind)
+	if err != nil {
+		return nil, nil, err
+	}
+	where, err := bind(oc.Where)
+	if err != nil {
+		return nil, nil, err
+	}
+	return set, where, nil
+}
+
+// give the columns without a table the qualifier `table`
+func qualifyColumns(e Expr, table string) (Expr, error) {
+	if c, ok := e.(*ColumnRef); ok {
+		if c.Table == "" {
+			return &ColumnRef{Table: table, Name: c.Name}, nil
+		}
+		return c, nil
+	}
+	return mapChildren(e, func(e Expr) (Expr, error) { return qualifyColumns(e, table) })
+}
+
+// apply DO UPDATE to the existing row with the primary key of `proposed`.
+// reports false when the WHERE of DO UPDATE does not hold.
+func upsertRow(db *DB, tdef *TableDef, tx *DBTX, proposed []Value, set []Expr, where Expr, out *returning) (bool, error) {
+	rec := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: append([]Value{}, proposed[:tdef.PKeys]...)}
+	if _, err := dbGet(db, tdef, &rec, &tx.kv.Tree); err != nil {
+		return false, err
+	}
+	old := copyValues(rec.Vals)
+	row := append(append([]Value{}, old...), proposed...)
+	ok, err := matches(where, row)
+	if err != nil || !ok {
+		return false, err
+	}
+	vals, err := assignedValues(tdef, set, old, row)
+	if err != nil {
+		return false, err
+	}
+	if err := updateRow(db, tdef, old, vals, &tx.kv); err != nil {
+		return false, err
+	}
+	return true, out.add(vals)
+}
+
+// the new value of each column of a SET list, nil if unchanged
+func bindAssignments(list []Assignment, tdef *TableDef, bind func(Expr) (Expr, error)) ([]Expr, error) {
+	exprs := make([]Expr, len(tdef.Cols))
+	for _, a := range list {
+		idx := ColIndex(tdef, a.Col)
+		if idx < 0 {
+			return nil, fmt.Errorf("column %s not found", a.Col)
+		}
+		if exprs[idx] != nil {
+			return nil, fmt.Errorf("column %s assigned more than once", a.Col)
+		}
+		e, err := bind(a.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("SET %s: %w", a.Col, err)
+		}
+		exprs[idx] = e
+	}
+	return exprs, nil
+}
+
+// the row `old` with the assignments evaluated against `row`
+func assignedValues(tdef *TableDef, exprs []Expr, old, row []Value) ([]Value, error) {
+	vals := append([]Value{}, old...)
+	for i, e := range exprs {
+		if e == nil {
+			continue
+		}
+		v, err := e.Eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkColumnValue(tdef, i, v); err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func (s *UpdateStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	var out *returning
+	n := 0
+	if err := writableTableCheck(s.Table); err != nil {
+		return nil, err
+	}
+	err := inWriteTX(db, tx, func(tx *DBTX) error {
+		tdef := tx.tableDef(s.Table)
+		if tdef == nil {
+			return fmt.Errorf("table not found: %s", s.Table)
+		}
+		exprs, err := bindAssignments(s.Set, tdef, func(e Expr) (Expr, error) {
+			return bindWhere(e, tableSchema(s.Table, tdef))
+		})
+		if err != nil {
+			return err
+		}
+		if out, err = newReturning(s.Returning, s.Table, tdef); err != nil {
+			return err
+		}
+
+		rows, err := matchingRows(db, tx, s.Table, s.Where, s.info)
+		if err != nil {
+			return err
+		}
+		for _, old := range rows {
+			vals, err := assignedValues(tdef, exprs, old, old)
+			if err != nil {
+				return err
+			}
+			if err := updateRow(db, tdef, old, vals, &tx.kv); err != nil {
+				return err
+			}
+			if err := out.add(vals); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.result(&StatementResult{Message: rowsMessage(n, "updated"), RowsAffected: n}), nil
+}
+
+// the RETURNING items, evaluated against the new rows of INSERT & UPDATE
+// or the deleted rows of DELETE
+type returning struct {
+	names   []string
+	exprs   []Expr
+	records []*Record
+}
+
+// nil without RETURNING
+func newReturning(items []SelectItem, table string, tdef *TableDef) (*returning, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	for _, item := range items {
+		var err error
+		walkExpr(item.Expr, func(e Expr) {
+			if _, ok := e.(*AggregateCall); ok && err == nil {
+				err = fmt.Errorf("aggregate %s is not allowed in RETURNING", e)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	names, exprs, err := bindItems(items, tableSchema(table, tdef), false)
+	if err != nil {
+		return nil, fmt.Errorf("RETURNING: %w", err)
+	}
+	return &returning{names: names, exprs: exprs, records: []*Record{}}, nil
+}
+
+func (r *returning) add(row []Value) error {
+	if r == nil {
+		return nil
+	}
+	rec, err := project(r.names, r.exprs, row)
+	if err != nil {
+		return err
+	}
+	r.records = append(r.records, rec)
+	return nil
+}
+
+func (r *returning) result(res *StatementResult) *StatementResult {
+	if r != nil {
+		res.Records = r.records
+	}
+	return res
+}
+
+// stored values must have the type of the column, there are no NULLs
+func checkColumnValue(tdef *TableDef, i int, v Value) error {
+	if v.Type == TYPE_NULL {
+		return fmt.Errorf("column %s cannot be NULL", tdef.Cols[i])
+	}
+	if v.Type != tdef.Types[i] {
+		return fmt.Errorf("column %s: %w, got %s", tdef.Cols[i], ErrTypeMismatch, formatValue(v))
+	}
+	return nil
+}
+
+// replace the row `old` with `vals`. a changed primary key moves the row.
+func updateRow(db *DB, tdef *TableDef, old, vals []Value, kvtx *KVTX) error {
+	rec := Record{Cols: tdef.Cols, Vals: vals}
+	for i := 0; i < tdef.PKeys; i++ {
+		if cmpValuesNull(old[i], vals[i]) != 0 {
+			if _, err := dbDelete(db, tdef, Record{Cols: tdef.Cols, Vals: old}, kvtx); err != nil {
+				return err
+			}
+			_, err := dbUpdate(db, tdef, rec, MODE_INSERT_ONLY, kvtx)
+			return err
+		}
+	}
+	_, err := dbUpdate(db, tdef, rec, MODE_UPDATE_ONLY, kvtx)
+	return err
+}
+
+func (s *DeleteStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	var out *returning
+	n := 0
+	if err := writableTableCheck(s.Table); err != nil {
+		return nil, err
+	}
+	err := inWriteTX(db, tx, func(tx *DBTX) error {
+		tdef := tx.tableDef(s.Table)
+		if tdef == nil {
+			return fmt.Errorf("table not found: %s", s.Table)
+		}
+		var err error
+		if out, err = newReturning(s.Returning, s.Table, tdef); err != nil {
+			return err
+		}
+		rows, err := matchingRows(db, tx, s.Table, s.Where, s.info)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			old, err := dbDeleteByKey(db, tdef, row[:tdef.PKeys], &tx.kv)
+			if err != nil {
+				return err
+			}
+			if err := out.add(old.Vals); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.result(&StatementResult{Message: rowsMessage(n, "deleted"), RowsAffected: n}), nil
+}
+
+func rowsMessage(n int, verb string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 row %s.", verb)
+	}
+	return fmt.Sprintf("%d rows %s.", n, verb)
+}
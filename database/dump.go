@@ -0,0 +1,319 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// Dump Format
+// JSON Lines, a header line followed by each table & then its rows:
+//
+//	{"format":"atomixdb-dump","version":1}
+//	{"type":"table","name":"t","columns":[{"name":"id","type":"int64"}],"primary_key":["id"],"indexes":[["v","id"]]}
+//	{"type":"row","table":"t","values":[1,"text",{"base64":"/w=="}]}
+//
+// bytes that are not valid UTF-8 are written as base64. the key prefixes
+// & the page layout are not part of the dump, they are assigned again.
+
+const (
+	DUMP_FORMAT  = "atomixdb-dump"
+	DUMP_VERSION = 1
+)
+
+type dumpHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type dumpLine struct {
+	Type string `json:"type"`
+	// table
+	Name       string       `json:"name,omitempty"`
+	Columns    []dumpColumn `json:"columns,omitempty"`
+	PrimaryKey []string     `json:"primary_key,omitempty"`
+	Indexes    [][]string   `json:"indexes,omitempty"`
+	// row
+	Table  string            `json:"table,omitempty"`
+	Values []json.RawMessage `json:"values,omitempty"`
+}
+
+type dumpColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type dumpBytes struct {
+	Base64 []byte `json:"base64"`
+}
+
+type DumpResult struct {
+	Tables int
+	Rows   int
+}
+
+// DUMP TO 'file'
+type DumpStmt struct {
+	File string
+}
+
+// RESTORE FROM 'file'
+type RestoreStmt struct {
+	File string
+}
+
+func (s *DumpStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	f, err := os.Create(s.File)
+	if err != nil {
+		return nil, fmt.Errorf("DUMP: %w", err)
+	}
+	res, err := db.Dump(tx, f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("DUMP: %w", cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: dumpMessage(res, "dumped")}, nil
+}
+
+func (s *RestoreStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if tx != nil {
+		return nil, fmt.Errorf("RESTORE cannot run inside a transaction")
+	}
+	f, err := os.Open(s.File)
+	if err != nil {
+		return nil, fmt.Errorf("RESTORE: %w", err)
+	}
+	defer f.Close()
+	res, err := db.Restore(f)
+	if err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: dumpMessage(res, "restored"), RowsAffected: res.Rows}, nil
+}
+
+func dumpMessage(res *DumpResult, verb string) string {
+	tables := "tables"
+	if res.Tables == 1 {
+		tables = "table"
+	}
+	rows := "rows"
+	if res.Rows == 1 {
+		rows = "row"
+	}
+	return fmt.Sprintf("%d %s and %d %s %s.", res.Tables, tables, res.Rows, rows, verb)
+}
+
+// write every user table & its rows, as of a single snapshot
+func (db *DB) Dump(tx *DBTX, w io.Writer) (*DumpResult, error) {
+	res := &DumpResult{}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(dumpHeader{Format: DUMP_FORMAT, Version: DUMP_VERSION}); err != nil {
+		return nil, fmt.Errorf("DUMP: %w", err)
+	}
+	err := withReader(db, tx, func(reader *KVReader) error {
+		tables, err := listTables(db, &reader.Tree)
+		if err != nil {
+			return err
+		}
+		for _, tdef := range tables {
+			if err := enc.Encode(dumpTable(tdef)); err != nil {
+				return fmt.Errorf("DUMP: %w", err)
+			}
+			res.Tables++
+			stmt := &SelectStmt{Items: []SelectItem{{}}, From: TableRef{Name: tdef.Name}}
+			err := stmt.run(db, tx, reader, func(rec *Record) error {
+				line := dumpLine{Type: "row", Table: tdef.Name}
+				for _, v := range rec.Vals {
+					line.Values = append(line.Values, dumpValue(v))
+				}
+				res.Rows++
+				return enc.Encode(line)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, fmt.Errorf("DUMP: %w", err)
+	}
+	return res, nil
+}
+
+func dumpTable(tdef *TableDef) dumpLine {
+	line := dumpLine{
+		Type:       "table",
+		Name:       tdef.Name,
+		PrimaryKey: tdef.Cols[:tdef.PKeys],
+		Indexes:    tdef.Indexes,
+	}
+	for i, col := range tdef.Cols {
+		line.Columns = append(line.Columns, dumpColumn{Name: col, Type: typeNames[tdef.Types[i]]})
+	}
+	return line
+}
+
+func dumpValue(v Value) json.RawMessage {
+	var data []byte
+	switch {
+	case v.Type == TYPE_INT64:
+		data, _ = json.Marshal(v.I64)
+	case utf8.Valid(v.Str):
+		data, _ = json.Marshal(string(v.Str))
+	default:
+		data, _ = json.Marshal(dumpBytes{Base64: v.Str})
+	}
+	return data
+}
+
+// recreate the tables of a dump & load their rows. each table is created
+// & loaded in a commit of its own, the tables must not exist.
+func (db *DB) Restore(r io.Reader) (*DumpResult, error) {
+	res := &DumpResult{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<24)
+	lineNo := 0
+	next := func() ([]byte, bool) {
+		for sc.Scan() {
+			lineNo++
+			if len(bytes.TrimSpace(sc.Bytes())) > 0 {
+				return sc.Bytes(), true
+			}
+		}
+		return nil, false
+	}
+
+	data, ok := next()
+	var header dumpHeader
+	if !ok || json.Unmarshal(data, &header) != nil || header.Format != DUMP_FORMAT {
+		return res, errors.New("RESTORE: not a dump file")
+	}
+	if header.Version != DUMP_VERSION {
+		return res, fmt.Errorf("RESTORE: unsupported dump version %d", header.Version)
+	}
+
+	var tdef *TableDef
+	var rows []Record
+	// load the rows of the table read so far
+	flush := func() error {
+		if tdef == nil {
+			return nil
+		}
+		if err := db.BulkLoad(tdef.Name, rows, 0); err != nil {
+			return fmt.Errorf("RESTORE %s: %w", tdef.Name, err)
+		}
+		res.Rows += len(rows)
+		rows = nil
+		return nil
+	}
+	for {
+		data, ok := next()
+		if !ok {
+			break
+		}
+		var line dumpLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			return res, fmt.Errorf("RESTORE line %d: %w", lineNo, err)
+		}
+		switch line.Type {
+		case "table":
+			if err := flush(); err != nil {
+				return res, err
+			}
+			var err error
+			if tdef, err = restoreTable(db, &line); err != nil {
+				return res, fmt.Errorf("RESTORE line %d: %w", lineNo, err)
+			}
+			res.Tables++
+		case "row":
+			if tdef == nil || line.Table != tdef.Name {
+				return res, fmt.Errorf("RESTORE line %d: the rows of %s must follow its table", lineNo, line.Table)
+			}
+			rec, err := restoreRow(tdef, line.Values)
+			if err != nil {
+				return res, fmt.Errorf("RESTORE line %d: %w", lineNo, err)
+			}
+			rows = append(rows, rec)
+		default:
+			return res, fmt.Errorf("RESTORE line %d: unknown line type %q", lineNo, line.Type)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return res, fmt.Errorf("RESTORE: %w", err)
+	}
+	return res, flush()
+}
+
+func restoreTable(db *DB, line *dumpLine) (*TableDef, error) {
+	tdef := &TableDef{Name: line.Name, PKeys: len(line.PrimaryKey), Indexes: line.Indexes}
+	for _, col := range line.Columns {
+		typ := uint32(TYPE_ERROR)
+		for t, name := range typeNames {
+			if name == col.Type {
+				typ = t
+			}
+		}
+		if typ == TYPE_ERROR {
+			return nil, fmt.Errorf("column %s: unknown type %q", col.Name, col.Type)
+		}
+		tdef.Cols = append(tdef.Cols, col.Name)
+		tdef.Types = append(tdef.Types, typ)
+	}
+	for i, col := range line.PrimaryKey {
+		if i >= len(tdef.Cols) || tdef.Cols[i] != col {
+			return nil, fmt.Errorf("the primary key must be the leading columns")
+		}
+	}
+	tx := &DBTX{}
+	db.beginInternal(tx)
+	if err := tx.TableNew(tdef); err != nil {
+		db.Abort(tx)
+		return nil, err
+	}
+	if err := db.Commit(tx); err != nil {
+		return nil, err
+	}
+	return tdef, nil
+}
+
+func restoreRow(tdef *TableDef, values []json.RawMessage) (Record, error) {
+	rec := Record{Cols: tdef.Cols}
+	if len(values) != len(tdef.Cols) {
+		return rec, fmt.Errorf("expected %d values, got %d", len(tdef.Cols), len(values))
+	}
+	for i, data := range values {
+		v := Value{Type: tdef.Types[i]}
+		var err error
+		switch v.Type {
+		case TYPE_INT64:
+			err = json.Unmarshal(data, &v.I64)
+		default:
+			var s string
+			if err = json.Unmarshal(data, &s); err == nil {
+				v.Str = []byte(s)
+			} else {
+				var b dumpBytes
+				err = json.Unmarshal(data, &b)
+				v.Str = b.Base64
+			}
+		}
+		if err != nil {
+			return rec, fmt.Errorf("column %s: invalid value %s", tdef.Cols[i], data)
+		}
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
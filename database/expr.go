@@ -0,0 +1,572 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// an expression of a query, evaluated against a row
+type Expr interface {
+	Eval(row []Value) (Value, error)
+	String() string
+}
+
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// a constant
+type Literal struct {
+	Val Value
+}
+
+// a column, resolved to its position in the row by `bindExpr`
+type ColumnRef struct {
+	Table string // optional qualifier
+	Name  string
+	idx   int
+}
+
+// a binary operator: arithmetic, `||`, comparisons, LIKE, AND & OR
+type BinaryExpr struct {
+	Op          string
+	Left, Right Expr
+}
+
+// NOT & negation
+type UnaryExpr struct {
+	Op      string
+	Operand Expr
+}
+
+// `expr [NOT] IN (list)`
+type InExpr struct {
+	Expr Expr
+	List []Expr
+	Not  bool
+}
+
+// an aggregate function, e.g. `count(*)` or `sum(price)`
+type AggregateCall struct {
+	Func string
+	Arg  Expr // nil for `count(*)`
+}
+
+// the column at a fixed position, used once an aggregation has
+// replaced the rows with groups
+type slotRef struct {
+	idx  int
+	name string
+}
+
+func (e *Literal) Eval(row []Value) (Value, error) {
+	return e.Val, nil
+}
+
+func (e *Literal) String() string {
+	switch e.Val.Type {
+	case TYPE_BYTES:
+		return "'" + strings.ReplaceAll(string(e.Val.Str), "'", "''") + "'"
+	default:
+		return formatValue(e.Val)
+	}
+}
+
+func (e *ColumnRef) Eval(row []Value) (Value, error) {
+	return row[e.idx], nil
+}
+
+func (e *ColumnRef) String() string {
+	if e.Table != "" {
+		return e.Table + "." + e.Name
+	}
+	return e.Name
+}
+
+func (e *BinaryExpr) Eval(row []Value) (Value, error) {
+	l, err := e.Left.Eval(row)
+	if err != nil {
+		return Value{}, err
+	}
+	if e.Op == "and" || e.Op == "or" {
+		// short circuit on the value that decides, so that
+		// NULL AND false is false & NULL OR true is true
+		decides := e.Op == "or"
+		if l.Type != TYPE_NULL && truthy(l) == decides {
+			return boolValue(decides), nil
+		}
+		r, err := e.Right.Eval(row)
+		if err != nil {
+			return Value{}, err
+		}
+		if r.Type != TYPE_NULL && truthy(r) == decides {
+			return boolValue(decides), nil
+		}
+		if l.Type == TYPE_NULL || r.Type == TYPE_NULL {
+			return Value{Type: TYPE_NULL}, nil
+		}
+		return boolValue(!decides), nil
+	}
+
+	r, err := e.Right.Eval(row)
+	if err != nil {
+		return Value{}, err
+	}
+	if l.Type == TYPE_NULL || r.Type == TYPE_NULL {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	switch e.Op {
+	case "like":
+		if l.Type != TYPE_BYTES || r.Type != TYPE_BYTES {
+			return Value{}, fmt.Errorf("%s: %w, expected strings", e, ErrTypeMismatch)
+		}
+		return boolValue(likeMatch(l.Str, r.Str)), nil
+	case "||":
+		return Value{Type: TYPE_BYTES, Str: []byte(formatValue(l) + formatValue(r))}, nil
+	case "+", "-", "*", "/", "%":
+		v, err := arithmetic(e.Op, l, r)
+		if err != nil {
+			return Value{}, fmt.Errorf("%s: %w", e, err)
+		}
+		return v, nil
+	}
+	c, err := cmpValues(l, r)
+	if err != nil {
+		return Value{}, fmt.Errorf("%s: %w", e, err)
+	}
+	switch e.Op {
+	case "=":
+		return boolValue(c == 0), nil
+	case "!=":
+		return boolValue(c != 0), nil
+	case "<":
+		return boolValue(c < 0), nil
+	case "<=":
+		return boolValue(c <= 0), nil
+	case ">":
+		return boolValue(c > 0), nil
+	case ">=":
+		return boolValue(c >= 0), nil
+	default:
+		return Value{}, fmt.Errorf("unknown operator %s", e.Op)
+	}
+}
+
+func (e *BinaryExpr) String() string {
+	return operandString(e.Left, e, false) + " " + strings.ToUpper(e.Op) + " " + operandString(e.Right, e, true)
+}
+
+func (e *UnaryExpr) Eval(row []Value) (Value, error) {
+	v, err := e.Operand.Eval(row)
+	if err != nil || v.Type == TYPE_NULL {
+		return v, err
+	}
+	if e.Op == "-" {
+		switch v.Type {
+		case TYPE_INT64:
+			return Value{Type: TYPE_INT64, I64: -v.I64}, nil
+		case TYPE_FLOAT64:
+			return Value{Type: TYPE_FLOAT64, F64: -v.F64}, nil
+		}
+		return Value{}, fmt.Errorf("%s: %w, expected a number", e, ErrTypeMismatch)
+	}
+	return boolValue(!truthy(v)), nil
+}
+
+func (e *UnaryExpr) String() string {
+	if e.Op == "-" {
+		return "-" + operandString(e.Operand, e, false)
+	}
+	return strings.ToUpper(e.Op) + " " + operandString(e.Operand, e, false)
+}
+
+var ErrDivisionByZero = errors.New("division by zero")
+
+// integers stay integers, with a float operand the result is a float
+func arithmetic(op string, l, r Value) (Value, error) {
+	if !isNumber(l) || !isNumber(r) {
+		return Value{}, fmt.Errorf("%w, expected numbers", ErrTypeMismatch)
+	}
+	if l.Type == TYPE_INT64 && r.Type == TYPE_INT64 {
+		a, b := l.I64, r.I64
+		var n int64
+		switch op {
+		case "+":
+			n = a + b
+		case "-":
+			n = a - b
+		case "*":
+			n = a * b
+		case "/", "%":
+			if b == 0 {
+				return Value{}, ErrDivisionByZero
+			}
+			if op == "/" {
+				n = a / b
+			} else {
+				n = a % b
+			}
+		}
+		return Value{Type: TYPE_INT64, I64: n}, nil
+	}
+	a, b := toFloat(l), toFloat(r)
+	var f float64
+	switch op {
+	case "+":
+		f = a + b
+	case "-":
+		f = a - b
+	case "*":
+		f = a * b
+	case "/", "%":
+		if b == 0 {
+			return Value{}, ErrDivisionByZero
+		}
+		if op == "/" {
+			f = a / b
+		} else {
+			f = math.Mod(a, b)
+		}
+	}
+	return Value{Type: TYPE_FLOAT64, F64: f}, nil
+}
+
+// NULL unless the value is found, when the list holds a NULL
+func (e *InExpr) Eval(row []Value) (Value, error) {
+	v, err := e.Expr.Eval(row)
+	if err != nil || v.Type == TYPE_NULL {
+		return v, err
+	}
+	result := boolValue(false)
+	for _, item := range e.List {
+		x, err := item.Eval(row)
+		if err != nil {
+			return Value{}, err
+		}
+		if x.Type == TYPE_NULL {
+			result = Value{Type: TYPE_NULL}
+			continue
+		}
+		c, err := cmpValues(v, x)
+		if err != nil {
+			return Value{}, fmt.Errorf("%s: %w", e, err)
+		}
+		if c == 0 {
+			result = boolValue(true)
+			break
+		}
+	}
+	if e.Not && result.Type != TYPE_NULL {
+		result = boolValue(!truthy(result))
+	}
+	return result, nil
+}
+
+func (e *InExpr) String() string {
+	list := make([]string, len(e.List))
+	for i, item := range e.List {
+		list[i] = item.String()
+	}
+	op := " IN ("
+	if e.Not {
+		op = " NOT IN ("
+	}
+	return operandString(e.Expr, e, false) + op + strings.Join(list, ", ") + ")"
+}
+
+// how tightly an expression binds, for printing the parentheses it needs
+func precedence(e Expr) int {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		switch e.Op {
+		case "or":
+			return 1
+		case "and":
+			return 2
+		case "+", "-", "||":
+			return 5
+		case "*", "/", "%":
+			return 6
+		}
+		return 4
+	case *UnaryExpr:
+		if e.Op == "-" {
+			return 7
+		}
+		return 3
+	case *InExpr:
+		return 4
+	}
+	return 10
+}
+
+// an operand of `parent`, parenthesized if it binds less tightly.
+// operators associate to the left.
+func operandString(e, parent Expr, right bool) string {
+	p, pp := precedence(e), precedence(parent)
+	if p < pp || (right && p == pp) {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// matches `s` against a LIKE pattern, `%` matches any run of bytes & `_` a single one
+func likeMatch(s, pattern []byte) bool {
+	// backtrack to the last `%` on a mismatch
+	star, mark := -1, 0
+	i, j := 0, 0
+	for i < len(s) {
+		switch {
+		case j < len(pattern) && pattern[j] == '%':
+			star, mark = j, i
+			j++
+		case j < len(pattern) && (pattern[j] == '_' || pattern[j] == s[i]):
+			i++
+			j++
+		case star >= 0:
+			mark++
+			i, j = mark, star+1
+		default:
+			return false
+		}
+	}
+	for j < len(pattern) && pattern[j] == '%' {
+		j++
+	}
+	return j == len(pattern)
+}
+
+func (e *AggregateCall) Eval(row []Value) (Value, error) {
+	return Value{}, fmt.Errorf("aggregate %s is not allowed here", e)
+}
+
+func (e *AggregateCall) String() string {
+	if e.Arg == nil {
+		return e.Func + "(*)"
+	}
+	return e.Func + "(" + e.Arg.String() + ")"
+}
+
+func (e *slotRef) Eval(row []Value) (Value, error) {
+	return row[e.idx], nil
+}
+
+func (e *slotRef) String() string {
+	return e.name
+}
+
+// the columns of the rows an expression is evaluated against
+type schema struct {
+	tables []string // the table (or alias) of each column
+	cols   []string
+}
+
+func tableSchema(name string, tdef *TableDef) *schema {
+	s := &schema{cols: tdef.Cols}
+	for range tdef.Cols {
+		s.tables = append(s.tables, name)
+	}
+	return s
+}
+
+func (s *schema) resolve(table, name string) (int, error) {
+	found := -1
+	for i, col := range s.cols {
+		if col != name || (table != "" && s.tables[i] != table) {
+			continue
+		}
+		if found >= 0 {
+			return -1, fmt.Errorf("column reference %q is ambiguous", name)
+		}
+		found = i
+	}
+	if found < 0 {
+		if table != "" {
+			return -1, fmt.Errorf("column %s.%s not found", table, name)
+		}
+		return -1, fmt.Errorf("column %s not found", name)
+	}
+	return found, nil
+}
+
+// resolve the column references of `e` against `s`. returns a copy,
+// so that the parsed statement can be executed again.
+func bindExpr(e Expr, s *schema) (Expr, error) {
+	if c, ok := e.(*ColumnRef); ok {
+		idx, err := s.resolve(c.Table, c.Name)
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnRef{Table: c.Table, Name: c.Name, idx: idx}, nil
+	}
+	return mapChildren(e, func(e Expr) (Expr, error) { return bindExpr(e, s) })
+}
+
+// a copy of `e` with each direct subexpression replaced by `fn`
+func mapChildren(e Expr, fn func(Expr) (Expr, error)) (Expr, error) {
+	var err error
+	apply := func(e Expr) Expr {
+		if e == nil || err != nil {
+			return e
+		}
+		var out Expr
+		out, err = fn(e)
+		return out
+	}
+	var out Expr
+	switch e := e.(type) {
+	case *BinaryExpr:
+		out = &BinaryExpr{Op: e.Op, Left: apply(e.Left), Right: apply(e.Right)}
+	case *UnaryExpr:
+		out = &UnaryExpr{Op: e.Op, Operand: apply(e.Operand)}
+	case *InExpr:
+		in := &InExpr{Expr: apply(e.Expr), Not: e.Not}
+		for _, item := range e.List {
+			in.List = append(in.List, apply(item))
+		}
+		out = in
+	case *AggregateCall:
+		out = &AggregateCall{Func: e.Func, Arg: apply(e.Arg)}
+	case *FuncCall:
+		call := &FuncCall{Func: e.Func}
+		for _, arg := range e.Args {
+			call.Args = append(call.Args, apply(arg))
+		}
+		out = call
+	default:
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// call `fn` on `e` & each of its subexpressions
+func walkExpr(e Expr, fn func(Expr)) {
+	if e == nil {
+		return
+	}
+	fn(e)
+	mapChildren(e, func(e Expr) (Expr, error) {
+		walkExpr(e, fn)
+		return e, nil
+	})
+}
+
+// the conjuncts of a WHERE clause, `a AND b AND c` -> [a, b, c]
+func splitAnd(e Expr) []Expr {
+	if b, ok := e.(*BinaryExpr); ok && b.Op == "and" {
+		return append(splitAnd(b.Left), splitAnd(b.Right)...)
+	}
+	if e == nil {
+		return nil
+	}
+	return []Expr{e}
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Value{Type: TYPE_INT64, I64: 1}
+	}
+	return Value{Type: TYPE_INT64, I64: 0}
+}
+
+// conditions hold for non-zero numbers & non-empty strings, NULL never holds
+func truthy(v Value) bool {
+	switch v.Type {
+	case TYPE_INT64:
+		return v.I64 != 0
+	case TYPE_FLOAT64:
+		return v.F64 != 0
+	case TYPE_BYTES:
+		return len(v.Str) > 0
+	default:
+		return false
+	}
+}
+
+// orders two non-NULL values, numbers compare with numbers & strings with strings
+func cmpValues(a, b Value) (int, error) {
+	switch {
+	case a.Type == TYPE_BYTES && b.Type == TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str), nil
+	case a.Type == TYPE_INT64 && b.Type == TYPE_INT64:
+		switch {
+		case a.I64 < b.I64:
+			return -1, nil
+		case a.I64 > b.I64:
+			return 1, nil
+		}
+		return 0, nil
+	case isNumber(a) && isNumber(b):
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, ErrTypeMismatch
+	}
+}
+
+// orders any two values, NULLs first. used for sorting & grouping.
+func cmpValuesNull(a, b Value) int {
+	if a.Type == TYPE_NULL || b.Type == TYPE_NULL {
+		switch {
+		case a.Type == b.Type:
+			return 0
+		case a.Type == TYPE_NULL:
+			return -1
+		}
+		return 1
+	}
+	c, err := cmpValues(a, b)
+	if err != nil {
+		// numbers before strings
+		if isNumber(a) {
+			return -1
+		}
+		return 1
+	}
+	return c
+}
+
+func isNumber(v Value) bool {
+	return v.Type == TYPE_INT64 || v.Type == TYPE_FLOAT64
+}
+
+func toFloat(v Value) float64 {
+	if v.Type == TYPE_FLOAT64 {
+		return v.F64
+	}
+	return float64(v.I64)
+}
+
+// a string that is equal for equal values, used as a map key
+func valuesKey(vals []Value) string {
+	var buf []byte
+	for _, v := range vals {
+		buf = append(buf, byte(v.Type))
+		switch v.Type {
+		case TYPE_INT64:
+			buf = encodeValues(buf, []Value{v})
+		case TYPE_FLOAT64:
+			if v.F64 == math.Trunc(v.F64) && math.Abs(v.F64) < 1<<62 {
+				// 2.0 groups with 2
+				buf[len(buf)-1] = TYPE_INT64
+				buf = encodeValues(buf, []Value{{Type: TYPE_INT64, I64: int64(v.F64)}})
+			} else {
+				buf = append(buf, fmt.Sprint(math.Float64bits(v.F64))...)
+				buf = append(buf, 0)
+			}
+		case TYPE_BYTES:
+			buf = encodeValues(buf, []Value{v})
+		}
+	}
+	return string(buf)
+}
@@ -4,22 +4,28 @@ import (
 	"encoding/binary"
 )
 
+// the free list is a queue of the free pages in a linked list of nodes.
+// pages are taken from the head & added to the tail, in place: the slots
+// after `tailSeq` & the `next` pointer of the tail node are not part of
+// the list on disk, so writing them is safe until the master page points
+// to the new sequence numbers.
 type FreeListData struct {
-	head uint64
-	// cached pointers to list nodes for accessing both ends
-	nodes []uint64 // from tail to head
-	// cached total number of items; stored in the head node
-	total int
-	// cached number of discarded items in the tail nodes
-	offset int
+	headPage uint64 // the node holding `headSeq`
+	headSeq  uint64 // the position of the oldest item
+	tailPage uint64 // the node holding `tailSeq`, never full
+	tailSeq  uint64 // the position of the next item
+	// free pages not in the list yet, found when a file of an older
+	// format was opened. they are added by the next commit.
+	unlisted []uint64
 }
 
 type FreeList struct {
 	FreeListData
 	// for each transaction
-	version   uint64   // current version
+	version   uint64   // the version being committed
 	minReader uint64   // minimum reader version
 	freed     []uint64 // pages that will be added to the free list
+	tail      BNode    // the private copy of the tail node, once written
 
 	// callbacks for managing on-disk pages
 	get func(uint64) BNode  // de-reference a pointer
@@ -28,78 +34,92 @@ type FreeList struct {
 }
 
 // Free List Node Format
-// | type | size | total | next |  pointers-version-pairs |
-// |  2B  |  2B  |   8B  |  8B  |       size * 16B        |
+// | type | next |  pointers-version-pairs |
+// |  2B  |  8B  |     FREE_LIST_CAP * 16B |
 
 const (
 	BNODE_FREE_LIST  = 3
-	FREE_LIST_HEADER = 4 + 8 + 8
-	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+	FREE_LIST_HEADER = 2 + 8
+	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 16
 )
 
+// take the oldest free page, 0 if none can be reused yet
 func (fl *FreeList) Pop() uint64 {
-	fl.loadCache()
-	return flPop1(fl)
-}
-
-func (fl *FreeList) Add(freed []uint64) {
-	if len(freed) == 0 {
-		return
-	}
-	total := fl.Total() + len(freed)
-	flPush(fl, freed, nil)
-	if fl.head != 0 {
-		flnSetTotal(fl.get(fl.head), uint64(total))
+	if fl.headSeq == fl.tailSeq {
+		return 0
 	}
-}
-
-func (fl *FreeList) loadCache() {
-	if len(fl.nodes) > 0 {
-		return
+	node := fl.get(fl.headPage)
+	ptr, ver := flnItem(node, int(fl.headSeq%FREE_LIST_CAP))
+	if versionBefore(fl.minReader, ver) {
+		// cannot use; possibly reachable by the minimum version reader.
+		// the items are in version order, so none of the others can be used either.
+		return 0
 	}
-
-	curr := fl.head
-	if curr == 0 {
-		fl.total = 0
-		fl.offset = 0
-		return
+	fl.headSeq++
+	if fl.headSeq%FREE_LIST_CAP == 0 {
+		// the head node is used up. the master page on disk still
+		// points to it, so it is freed by this version.
+		fl.freed = append(fl.freed, fl.headPage)
+		fl.headPage = flnNext(node)
 	}
+	return ptr
+}
 
-	var nodes []uint64
-	for curr != 0 {
-		nodes = append(nodes, curr)
-		node := fl.get(curr)
-		curr = flnNext(node)
+// add the pages in `freed` to the list, with the nodes freed while doing so
+func (fl *FreeList) addFreed() {
+	for len(fl.freed) > 0 {
+		freed := fl.freed
+		fl.freed = nil
+		for _, ptr := range freed {
+			fl.push(flItem{ptr: ptr, version: fl.version})
+		}
 	}
+}
 
-	for i := 0; i < len(nodes)/2; i++ {
-		nodes[i], nodes[len(nodes)-1-i] = nodes[len(nodes)-1-i], nodes[i]
+// add the pages found by `setUnlisted`, usable by any reader
+func (fl *FreeList) addUnlisted() {
+	for _, ptr := range fl.unlisted {
+		fl.push(flItem{ptr: ptr, version: 0})
 	}
+	fl.unlisted = nil
+}
 
-	fl.nodes = nodes
-	headNode := fl.get(fl.head)
-	fl.total = flnSize(headNode)
-	fl.offset = 0
+// a free page & the version of the commit that freed it
+type flItem struct {
+	ptr     uint64
+	version uint64
 }
 
-func flPop1(fl *FreeList) uint64 {
-	if fl.total == 0 {
-		return 0
+func (fl *FreeList) push(item flItem) {
+	if fl.tailPage == 0 {
+		// an empty file, start the list
+		fl.tail = newFreeListNode()
+		fl.tailPage = fl.new(fl.tail)
+		fl.headPage = fl.tailPage
+	} else if fl.tail.data == nil {
+		fl.tail = BNode{data: append([]byte(nil), fl.get(fl.tailPage).data...)}
+		fl.use(fl.tailPage, fl.tail)
 	}
-
-	assert(fl.offset < flnSize(fl.get(fl.nodes[0])))
-	ptr, ver := flnItem(fl.get(fl.nodes[0]), fl.offset)
-	if versionBefore(fl.minReader, ver) {
-		// cannot use; possibly reachable by the minimum version reader
-		return 0
-	}
-	fl.offset++
-	fl.total--
-	if fl.offset >= flnSize(fl.get(fl.nodes[0])) {
-		fl.nodes = fl.nodes[1:]
-		fl.offset = 0
+	flnSetItem(fl.tail, int(fl.tailSeq%FREE_LIST_CAP), item.ptr, item.version)
+	fl.tailSeq++
+	if fl.tailSeq%FREE_LIST_CAP == 0 {
+		// the tail node is full, link a new one
+		next := newFreeListNode()
+		ptr := fl.Pop()
+		if ptr == 0 {
+			ptr = fl.new(next)
+		} else {
+			fl.use(ptr, next)
+		}
+		flnSetNext(fl.tail, ptr)
+		fl.tail, fl.tailPage = next, ptr
 	}
-	return ptr
+}
+
+func newFreeListNode() BNode {
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	binary.LittleEndian.PutUint16(node.data[0:2], BNODE_FREE_LIST)
+	return node
 }
 
 func versionBefore(u uint64, ver uint64) bool {
@@ -108,119 +128,52 @@ func versionBefore(u uint64, ver uint64) bool {
 
 func flnItem(node BNode, offset int) (uint64, uint64) {
 	pos := FREE_LIST_HEADER + offset*16
-	if len(node.data) < int(pos)+16 {
-		return 0, 0
-	}
 	ptr := binary.LittleEndian.Uint64(node.data[pos : pos+8])
 	ver := binary.LittleEndian.Uint64(node.data[pos+8 : pos+16])
 	return ptr, ver
 }
 
-func flnSize(node BNode) int {
-	return int(node.nKeys())
+func flnSetItem(node BNode, offset int, ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER + offset*16
+	binary.LittleEndian.PutUint64(node.data[pos:pos+8], ptr)
+	binary.LittleEndian.PutUint64(node.data[pos+8:pos+16], ver)
 }
 
 func flnNext(node BNode) uint64 {
-	return binary.LittleEndian.Uint64(node.data[4+8:])
+	return binary.LittleEndian.Uint64(node.data[2:])
 }
 
-func flnPtr(node BNode, idx int) uint64 {
-	return binary.LittleEndian.Uint64(node.data[FREE_LIST_HEADER+idx*8:])
+func flnSetNext(node BNode, next uint64) {
+	binary.LittleEndian.PutUint64(node.data[2:], next)
 }
 
-func flnSetPtr(node BNode, idx int, ptr uint64) {
-	binary.LittleEndian.PutUint64(node.data[FREE_LIST_HEADER+idx*8:], ptr)
+// the number of free pages
+func (fl *FreeListData) Total() int {
+	return int(fl.tailSeq-fl.headSeq) + len(fl.unlisted)
 }
 
-func flnSetHeader(node BNode, size uint16, next uint64) {
-	binary.LittleEndian.PutUint16(node.data[2:], size)
-	binary.LittleEndian.PutUint64(node.data[4+8:], next)
-}
-
-func flnSetTotal(node BNode, total uint64) {
-	binary.LittleEndian.PutUint64(node.data[4:], total)
-}
-
-func (fl *FreeList) Get(pgnum int) uint64 {
-	node := fl.get(fl.head)
-	for flnSize(node) < pgnum {
-		pgnum -= flnSize(node)
-		next := flnNext(node)
-		node = fl.get(next)
-	}
-	return flnPtr(node, flnSize(node)-pgnum-1)
-}
-
-// calculates the number of page `pointers` across all nodes
-func (fl *FreeList) Total() int {
-	if fl == nil || fl.head == 0 {
-		return 0 // Handle nil case or empty list
-	}
-
-	total := 0
-	nodeId := fl.head
-
-	for nodeId > 0 {
-		node := fl.get(nodeId)
-		total += flnSize(node)
-		nodeId = flnNext(node)
-	}
-	return total
-}
-
-// remove the `popn` pointers & add new `freed` pointers
-func (fl *FreeList) Update(popn int, freed []uint64) {
-	if popn == 0 || len(freed) == 0 {
-		return // no change to be done
-	}
-
-	total := fl.Total()
-	reuse := []uint64{} // construct the new list
-
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
-		node := fl.get(fl.head)
-		freed = append(freed, fl.head) // reuse the node itself
-
-		if popn >= flnSize(node) {
-			popn -= flnSize(node)
-		} else {
-			remain := flnSize(node) - popn
-			popn = 0
-			// collect resuable pointers
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-				remain--
-				reuse = append(reuse, flnPtr(node, remain))
-			}
-			for i := 0; i < remain; i++ {
-				freed = append(freed, flnPtr(node, i))
+// the pages below `used` that are not reachable from `root`, for the files
+// of an older format, whose free list is not read
+func (fl *FreeListData) setUnlisted(get func(uint64) BNode, root uint64, used uint64) {
+	reachable := make([]bool, used)
+	reachable[0] = true // the master page
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		reachable[ptr] = true
+		node := get(ptr)
+		if node.bNodeType() == BNODE_INODE {
+			for i := uint16(0); i < node.nKeys(); i++ {
+				walk(node.getPtr(i))
 			}
 		}
-		total -= flnSize(node)
-		fl.head = flnNext(node)
 	}
-	assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0)
-	flPush(fl, freed, reuse)
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
-}
-
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-
-		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
-		}
-		flnSetHeader(new, uint16(size), fl.head)
-		for i, ptr := range freed[:size] {
-			flnSetPtr(new, i, ptr)
-		}
-		freed = freed[size:]
-		if len(reuse) > 0 {
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, new)
-		} else {
-			fl.head = fl.new(new)
+	if root != 0 {
+		walk(root)
+	}
+	*fl = FreeListData{}
+	for ptr, ok := range reachable {
+		if !ok {
+			fl.unlisted = append(fl.unlisted, uint64(ptr))
 		}
 	}
 }
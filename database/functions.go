@@ -0,0 +1,109 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// a scalar function, e.g. `upper(name)`
+type FuncCall struct {
+	Func string
+	Args []Expr
+}
+
+type scalarFunc struct {
+	minArgs, maxArgs int // maxArgs < 0 for any number
+	// called with the evaluated arguments, NULLs included
+	eval func(args []Value) (Value, error)
+}
+
+var scalarFuncs = map[string]scalarFunc{
+	"upper":    {1, 1, strictString(bytes.ToUpper)},
+	"lower":    {1, 1, strictString(bytes.ToLower)},
+	"length":   {1, 1, funcLength},
+	"abs":      {1, 1, funcAbs},
+	"coalesce": {1, -1, funcCoalesce},
+}
+
+func (e *FuncCall) Eval(row []Value) (Value, error) {
+	args := make([]Value, len(e.Args))
+	for i, arg := range e.Args {
+		v, err := arg.Eval(row)
+		if err != nil {
+			return Value{}, err
+		}
+		args[i] = v
+	}
+	v, err := scalarFuncs[e.Func].eval(args)
+	if err != nil {
+		return Value{}, fmt.Errorf("%s: %w", e, err)
+	}
+	return v, nil
+}
+
+func (e *FuncCall) String() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+	return e.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+// check the number of arguments of a call
+func checkFuncCall(call *FuncCall) error {
+	f, ok := scalarFuncs[call.Func]
+	if !ok {
+		return fmt.Errorf("unknown function %s", call.Func)
+	}
+	if len(call.Args) < f.minArgs || (f.maxArgs >= 0 && len(call.Args) > f.maxArgs) {
+		return fmt.Errorf("wrong number of arguments for %s", call.Func)
+	}
+	return nil
+}
+
+// a string function that is NULL on NULL
+func strictString(fn func([]byte) []byte) func([]Value) (Value, error) {
+	return func(args []Value) (Value, error) {
+		switch args[0].Type {
+		case TYPE_NULL:
+			return args[0], nil
+		case TYPE_BYTES:
+			return Value{Type: TYPE_BYTES, Str: fn(args[0].Str)}, nil
+		}
+		return Value{}, fmt.Errorf("%w, expected a string", ErrTypeMismatch)
+	}
+}
+
+func funcLength(args []Value) (Value, error) {
+	switch args[0].Type {
+	case TYPE_NULL:
+		return args[0], nil
+	case TYPE_BYTES:
+		return Value{Type: TYPE_INT64, I64: int64(len(args[0].Str))}, nil
+	}
+	return Value{}, fmt.Errorf("%w, expected a string", ErrTypeMismatch)
+}
+
+func funcAbs(args []Value) (Value, error) {
+	v := args[0]
+	switch {
+	case v.Type == TYPE_INT64 && v.I64 < 0:
+		v.I64 = -v.I64
+	case v.Type == TYPE_FLOAT64 && v.F64 < 0:
+		v.F64 = -v.F64
+	case v.Type == TYPE_BYTES:
+		return Value{}, fmt.Errorf("%w, expected a number", ErrTypeMismatch)
+	}
+	return v, nil
+}
+
+// the first argument that is not NULL
+func funcCoalesce(args []Value) (Value, error) {
+	for _, v := range args {
+		if v.Type != TYPE_NULL {
+			return v, nil
+		}
+	}
+	return Value{Type: TYPE_NULL}, nil
+}
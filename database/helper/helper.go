@@ -66,12 +66,48 @@ func PrintWelcomeMessage(isWelcome bool) {
 	fmt.Println("Available Commands:")
 	fmt.Println("  CREATE       - Create a new table")
 	fmt.Println("  INSERT       - Add a record to a table")
-	fmt.Println("  DELETE       - Delete a record from a table")
+	fmt.Println("  DELETE       - Delete a record by its primary key, printing the deleted row")
 	fmt.Println("  GET          - Retrieve a record from a table")
-	fmt.Println("  UPDATE       - Update a record in a table")
+	fmt.Println("  UPDATE       - Update a record in a table, empty values are kept")
 	fmt.Println("  BEGIN        - Begin new transaction")
+	fmt.Println("  BEGIN READ ONLY - Begin a read-only transaction on a fixed snapshot")
 	fmt.Println("  COMMIT       - Commit transaction")
 	fmt.Println("  ABORT        - Rollback transaction")
+	fmt.Println("  SAVEPOINT name   - Mark a point inside the transaction")
+	fmt.Println("  ROLLBACK TO name - Undo the changes made after a savepoint")
+	fmt.Println("  RELEASE name     - Forget a savepoint, keeping its changes")
+	fmt.Println("  SELECT items FROM table [WHERE cond] [GROUP BY cols] [HAVING cond]")
+	fmt.Println("               - Query rows, with count/sum/min/max/avg aggregates")
+	fmt.Println("               - items are expressions with + - * / % ||, upper/lower/length/abs/coalesce and [AS] alias")
+	fmt.Println("               - FROM t1 [LEFT] JOIN t2 ON cond joins tables")
+	fmt.Println("               - ORDER BY expr [ASC|DESC], ... sorts the result")
+	fmt.Println("               - WHERE supports AND, OR, NOT, = != < <= > >=, LIKE and IN (...)")
+	fmt.Println("  INSERT INTO table [(cols)] VALUES (exprs), ... - Insert rows")
+	fmt.Println("               - ON CONFLICT [(pk)] DO NOTHING skips rows whose key exists")
+	fmt.Println("               - ON CONFLICT [(pk)] DO UPDATE SET col = expr, ... [WHERE cond] updates them,")
+	fmt.Println("                 excluded.col is the value of the row being inserted")
+	fmt.Println("  LOAD table FROM 'file' [FILLFACTOR 90]       - Bulk load an empty table, one row of values per line")
+	fmt.Println("  IMPORT table FROM 'file.csv' [DELIMITER ','] [QUOTE '\"'] [ON ERROR SKIP|ABORT] [BATCH 1000]")
+	fmt.Println("               - Insert the rows of a CSV file, the header row names the columns")
+	fmt.Println("  EXPORT table TO 'file.csv' [DELIMITER ','] [QUOTE '\"'] - Write the rows of a table as CSV")
+	fmt.Println("  DUMP TO 'file'                              - Write the schema and rows of every table as JSON Lines")
+	fmt.Println("  RESTORE FROM 'file'                         - Recreate the tables of a dump and load their rows")
+	fmt.Println("  SHOW TABLES                              - List the tables")
+	fmt.Println("  SHOW CONFIG                              - The settings in effect and where they come from")
+	fmt.Println("  DESCRIBE table                           - Show the columns, types, primary key and indexes of a table")
+	fmt.Println("  SHOW INDEXES [FROM table]                - List the primary keys and indexes with their key prefixes")
+	fmt.Println("               - the catalog can be queried as @tables, @columns and @indexes")
+	fmt.Println("  STATS [table]                            - Rows, pages and key sizes of the tables and indexes, and the file size")
+	fmt.Println("  UPDATE table SET col = expr, ... [WHERE cond]  - Update the matching rows")
+	fmt.Println("  DELETE FROM table [WHERE cond]                - Delete the matching rows")
+	fmt.Println("               - RETURNING items after INSERT, UPDATE or DELETE prints the new or deleted rows")
+	fmt.Println("  SET statement_timeout = '30s'            - Abort transactions whose command runs longer")
+	fmt.Println("  SET idle_in_transaction_timeout = '10m'  - Abort transactions left idle, 0 disables")
+	fmt.Println("  SET sort_memory = '16MB'                 - Memory a sort uses before spilling to disk")
+	fmt.Println("  SET slow_query_threshold = '100ms'       - Log the statements taking longer, 0 disables")
+	fmt.Println("  SET output = table|csv|tsv|json|jsonl|vertical - How this session prints the rows")
+	fmt.Println("  SET footer = on|off                      - Print the row count and elapsed time after the rows")
+	fmt.Println("  SET binary_output = hex|base64           - How bytes that are not valid UTF-8 are printed")
 	fmt.Println("  HELP         - List all commands")
 	fmt.Println("  EXIT         - Exit the program")
 	fmt.Println()
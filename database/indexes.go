@@ -3,6 +3,7 @@ package database
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -10,7 +11,18 @@ const (
 	INDEX_DEL = 2
 )
 
-func indexOp(_ *DB, tdef *TableDef, rec Record, op int, kvtx *KVTX) {
+// the key of the i-th index for a row with the values of `tdef.Cols`
+func indexKey(tdef *TableDef, i int, vals []Value) []byte {
+	index := tdef.Indexes[i]
+	ivals := make([]Value, len(index))
+	for j, c := range index {
+		ivals[j] = vals[ColIndex(tdef, c)]
+	}
+	return encodeKey(nil, tdef.IndexPrefix[i], ivals)
+}
+
+// add or delete the index entries of a row
+func indexOp(_ *DB, tdef *TableDef, rec Record, op int, kvtx *KVTX) error {
 	key := make([]byte, 0, 256)
 	irec := make([]Value, len(rec.Cols))
 
@@ -30,10 +42,11 @@ func indexOp(_ *DB, tdef *TableDef, rec Record, op int, kvtx *KVTX) {
 			panic("invalid index op")
 		}
 		if err != nil {
-			//! TODO
+			return fmt.Errorf("index (%s): %w", strings.Join(index, ", "), err)
 		}
 		assert(done)
 	}
+	return nil
 }
 
 func encodeKeyPartial(
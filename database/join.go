@@ -0,0 +1,257 @@
+package database
+
+import (
+	"fmt"
+)
+
+const (
+	JOIN_INNER = 1
+	JOIN_LEFT  = 2 // keeps the outer rows without a match, with NULLs
+)
+
+// [INNER | LEFT] JOIN table ON cond
+type JoinClause struct {
+	Kind  int
+	Table TableRef
+	On    Expr
+}
+
+// joins every row of `outer` with the rows of the inner table it matches.
+// `probe` returns the candidate inner rows of an outer row, which are
+// then checked against the whole ON condition.
+type joinIter struct {
+	outer rowIter
+	kind  int
+	on    Expr // bound against the joined row
+	width int  // columns of the inner table
+	probe func(outer []Value) ([][]Value, error)
+	// the current outer row & its candidates
+	row     []Value
+	cands   [][]Value
+	pos     int
+	matched bool
+}
+
+func (j *joinIter) next() ([]Value, error) {
+	for {
+		if j.row == nil {
+			row, err := j.outer.next()
+			if err != nil || row == nil {
+				return nil, err
+			}
+			if j.cands, err = j.probe(row); err != nil {
+				return nil, err
+			}
+			j.row, j.pos, j.matched = row, 0, false
+		}
+		for j.pos < len(j.cands) {
+			joined := append(append(make([]Value, 0, len(j.row)+j.width), j.row...), j.cands[j.pos]...)
+			j.pos++
+			ok, err := matches(j.on, joined)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				j.matched = true
+				return joined, nil
+			}
+		}
+		row := j.row
+		j.row = nil
+		if j.kind == JOIN_LEFT && !j.matched {
+			joined := append(make([]Value, 0, len(row)+j.width), row...)
+			for i := 0; i < j.width; i++ {
+				joined = append(joined, Value{Type: TYPE_NULL})
+			}
+			return joined, nil
+		}
+	}
+}
+
+// the columns an expression refers to lie in [lo, hi) of the joined row
+func refsWithin(e Expr, lo, hi int) bool {
+	ok := true
+	walkExpr(e, func(e Expr) {
+		if c, isCol := e.(*ColumnRef); isCol && (c.idx < lo || c.idx >= hi) {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// an equality of the ON condition between the inner table & the outer rows
+type joinKey struct {
+	inner Expr // bound against the inner table alone
+	outer Expr // bound against the outer rows
+}
+
+// join the inner table to the rows of `outer`, which are `offset` columns wide.
+// an equality on a column leading the inner primary key or one of its indexes
+// is probed through that key for every outer row, other equalities are
+// answered from a hash table of the inner rows.
+func (q *query) openJoin(outer rowIter, join JoinClause, inner *TableDef, offset int) (rowIter, error) {
+	// the ON condition can refer to this table & the ones before it
+	sch := &schema{
+		tables: q.sch.tables[:offset+len(inner.Cols)],
+		cols:   q.sch.cols[:offset+len(inner.Cols)],
+	}
+	on, err := bindWhere(join.On, sch)
+	if err != nil {
+		return nil, fmt.Errorf("JOIN ON: %w", err)
+	}
+	innerSch := tableSchema(join.Table.qualifier(), inner)
+	outerSch := &schema{tables: sch.tables[:offset], cols: sch.cols[:offset]}
+
+	var keys []joinKey
+	indexed := -1 // the key probed through an index
+	for _, cond := range splitAnd(on) {
+		b, ok := cond.(*BinaryExpr)
+		if !ok || b.Op != "=" {
+			continue
+		}
+		l, r := b.Left, b.Right
+		if refsWithin(l, 0, offset) && refsWithin(r, offset, len(sch.cols)) {
+			l, r = r, l
+		}
+		if !refsWithin(l, offset, len(sch.cols)) || !refsWithin(r, 0, offset) {
+			continue
+		}
+		// rebind each side against its own rows
+		innerExpr, err := bindExpr(unbind(l), innerSch)
+		if err != nil {
+			return nil, err
+		}
+		outerExpr, err := bindExpr(unbind(r), outerSch)
+		if err != nil {
+			return nil, err
+		}
+		if c, isCol := innerExpr.(*ColumnRef); isCol && indexed < 0 && leadsKey(inner, c.Name) {
+			indexed = len(keys)
+		}
+		keys = append(keys, joinKey{inner: innerExpr, outer: outerExpr})
+	}
+
+	j := &joinIter{outer: outer, kind: join.Kind, on: on, width: len(inner.Cols)}
+	switch {
+	case indexed >= 0:
+		j.probe = q.indexProbe(inner, keys[indexed])
+	case len(keys) > 0:
+		j.probe = q.hashProbe(inner, keys)
+	default:
+		j.probe = q.loopProbe(inner)
+	}
+	return j, nil
+}
+
+// the unbound form of a bound expression, for binding it to another schema
+func unbind(e Expr) Expr {
+	if c, ok := e.(*ColumnRef); ok {
+		return &ColumnRef{Table: c.Table, Name: c.Name}
+	}
+	out, _ := mapChildren(e, func(e Expr) (Expr, error) { return unbind(e), nil })
+	return out
+}
+
+// look up the inner rows with the key of the outer row, through
+// `findIndex` & `dbScan` like any other range scan
+func (q *query) indexProbe(inner *TableDef, key joinKey) func([]Value) ([][]Value, error) {
+	col := key.inner.(*ColumnRef).Name
+	typ := inner.Types[ColIndex(inner, col)]
+	return func(outer []Value) ([][]Value, error) {
+		v, err := key.outer.Eval(outer)
+		if err != nil {
+			return nil, err
+		}
+		if v.Type != typ {
+			return nil, nil // NULL or another type never equals the column
+		}
+		r := scanRange{col: col, loCmp: CMP_GE, hiCmp: CMP_LE}
+		r.add("=", v)
+		src, err := q.source(inner, r)
+		if err != nil {
+			return nil, err
+		}
+		return readAll(src)
+	}
+}
+
+// build a hash table of the inner rows on the first use
+func (q *query) hashProbe(inner *TableDef, keys []joinKey) func([]Value) ([][]Value, error) {
+	var table map[string][][]Value
+	return func(outer []Value) ([][]Value, error) {
+		if table == nil {
+			src, err := q.source(inner, fullRange(inner))
+			if err != nil {
+				return nil, err
+			}
+			rows, err := readAll(src)
+			if err != nil {
+				return nil, err
+			}
+			table = map[string][][]Value{}
+			for _, row := range rows {
+				k, ok, err := evalKey(keys, row, func(k joinKey) Expr { return k.inner })
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					table[k] = append(table[k], row)
+				}
+			}
+		}
+		k, ok, err := evalKey(keys, outer, func(k joinKey) Expr { return k.outer })
+		if err != nil || !ok {
+			return nil, err
+		}
+		return table[k], nil
+	}
+}
+
+// the hash key of a row, false if any part is NULL
+func evalKey(keys []joinKey, row []Value, side func(joinKey) Expr) (string, bool, error) {
+	vals := make([]Value, len(keys))
+	for i, k := range keys {
+		v, err := side(k).Eval(row)
+		if err != nil {
+			return "", false, err
+		}
+		if v.Type == TYPE_NULL {
+			return "", false, nil
+		}
+		vals[i] = v
+	}
+	return valuesKey(vals), true, nil
+}
+
+// without an equality every inner row is a candidate
+func (q *query) loopProbe(inner *TableDef) func([]Value) ([][]Value, error) {
+	var rows [][]Value
+	loaded := false
+	return func(outer []Value) ([][]Value, error) {
+		if !loaded {
+			src, err := q.source(inner, fullRange(inner))
+			if err != nil {
+				return nil, err
+			}
+			if rows, err = readAll(src); err != nil {
+				return nil, err
+			}
+			loaded = true
+		}
+		return rows, nil
+	}
+}
+
+func readAll(rows rowIter) ([][]Value, error) {
+	var out [][]Value
+	for {
+		row, err := rows.next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return out, nil
+		}
+		out = append(out, row)
+	}
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+type TokenType int
+
+const (
+	TOKEN_EOF    TokenType = iota
+	TOKEN_IDENT            // names & keywords
+	TOKEN_NUMBER           // integer & decimal literals
+	TOKEN_STRING           // 'quoted' literals
+	TOKEN_SYMBOL           // operators & punctuation
+)
+
+type Token struct {
+	Type TokenType
+	Text string // for TOKEN_STRING the unquoted value
+	Pos  int    // byte offset in the statement
+}
+
+// two character operators are matched before single characters
+var symbols = []string{"<=", ">=", "!=", "<>", "||", "=", "<", ">", "(", ")", ",", ".", "*", "+", "-", "/", "%", ";"}
+
+// splits a statement into tokens
+func tokenize(input string) ([]Token, error) {
+	var tokens []Token
+	i := 0
+	for i < len(input) {
+		ch := input[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '-' && i+1 < len(input) && input[i+1] == '-':
+			// comment till the end of line
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case isIdentStart(ch):
+			start := i
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{Type: TOKEN_IDENT, Text: input[start:i], Pos: start})
+		case ch == '"':
+			// quoted identifier
+			start := i
+			end := strings.IndexByte(input[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted identifier at %d", start)
+			}
+			tokens = append(tokens, Token{Type: TOKEN_IDENT, Text: input[i+1 : i+1+end], Pos: start})
+			i += end + 2
+		case ch >= '0' && ch <= '9':
+			start := i
+			for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+				i++
+			}
+			if i+1 < len(input) && input[i] == '.' && input[i+1] >= '0' && input[i+1] <= '9' {
+				i++
+				for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, Token{Type: TOKEN_NUMBER, Text: input[start:i], Pos: start})
+		case ch == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(input) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if input[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(input) && input[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(input[i])
+				i++
+			}
+			tokens = append(tokens, Token{Type: TOKEN_STRING, Text: sb.String(), Pos: start})
+		default:
+			matched := false
+			for _, sym := range symbols {
+				if strings.HasPrefix(input[i:], sym) {
+					tokens = append(tokens, Token{Type: TOKEN_SYMBOL, Text: sym, Pos: i})
+					i += len(sym)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", ch, i)
+			}
+		}
+	}
+	tokens = append(tokens, Token{Type: TOKEN_EOF, Pos: len(input)})
+	return tokens, nil
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || ch == '@' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentPart(ch byte) bool {
+	return isIdentStart(ch) || (ch >= '0' && ch <= '9')
+}
+
+// splits a line into its statements at the `;` outside of quotes &
+// comments, the statements are trimmed & the empty ones dropped
+func splitStatements(input string) []string {
+	var stmts []string
+	start := 0
+	var quote byte // the quote of the string or identifier being read
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0 // a doubled quote reopens on the next character
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '-' && i+1 < len(input) && input[i+1] == '-':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case ch == ';':
+			stmts = append(stmts, input[start:i])
+			start = i + 1
+		}
+	}
+	stmts = append(stmts, input[start:])
+	out := stmts[:0]
+	for _, stmt := range stmts {
+		if stmt = strings.TrimSpace(stmt); stmt != "" && !strings.HasPrefix(stmt, "--") {
+			out = append(out, stmt)
+		}
+	}
+	return out
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Logging
+// the DB, its KV & its worker pool write structured logs to a `*slog.Logger`,
+// nothing is logged until one is set with `DB.SetLogger`. statements slower
+// than the threshold of `DB.SetSlowQueryThreshold` are logged at the warn
+// level with the table they read, how & the rows read from it.
+
+// drops every record, for the components without a logger
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// a logger writing to `w` in the "text" or "json" format
+func NewLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// the logger of the database, its KV & its worker pool. set it before the
+// database is used, nil discards the logs.
+func (db *DB) SetLogger(l *slog.Logger) {
+	db.logger = l
+	db.kv.logger = l
+	if db.pool != nil {
+		db.pool.SetLogger(l)
+	}
+}
+
+func (db *DB) log() *slog.Logger {
+	if db.logger == nil {
+		return discardLogger
+	}
+	return db.logger
+}
+
+func (kv *KV) log() *slog.Logger {
+	if kv.logger == nil {
+		return discardLogger
+	}
+	return kv.logger
+}
+
+// the pool's workers run in their own goroutines, the logger may be set
+// while they do
+func (p *WorkerPool) SetLogger(l *slog.Logger) {
+	p.logger.Store(l)
+}
+
+func (p *WorkerPool) log() *slog.Logger {
+	if l := p.logger.Load(); l != nil {
+		return l
+	}
+	return discardLogger
+}
+
+// statements taking at least `d` are logged, 0 turns the log off
+func (db *DB) SetSlowQueryThreshold(d time.Duration) {
+	db.mu.Lock()
+	db.slowQuery = d
+	db.mu.Unlock()
+}
+
+func (db *DB) SlowQueryThreshold() time.Duration {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.slowQuery
+}
+
+// how a statement read its table, for the slow query log
+type ScanInfo struct {
+	Table   string
+	Path    string // e.g. "full scan", "range of index (a, b)"
+	Scanned int    // rows read from the table, before WHERE
+}
+
+// the statements reading a table fill in `info` when they run
+type scanReporter interface {
+	reportScan(info *ScanInfo)
+}
+
+func (s *SelectStmt) reportScan(info *ScanInfo) { s.info = info }
+func (s *UpdateStmt) reportScan(info *ScanInfo) { s.info = info }
+func (s *DeleteStmt) reportScan(info *ScanInfo) { s.info = info }
+
+// the access path of the FROM table, from the ranges it is read through
+func (q *query) accessPath() string {
+	base := q.tables[0]
+	path := ""
+	switch {
+	case systemTableOf(base) != nil:
+		path = "system table"
+	case len(q.scan) == 0:
+		path = "none" // the condition holds for no row
+	default:
+		r := q.scan[0]
+		key := r.key
+		if key == nil {
+			key = []string{r.col}
+		}
+		name := "primary key"
+		if i, err := findIndex(base, key); err == nil && i >= 0 {
+			name = fmt.Sprintf("index (%s)", strings.Join(base.Indexes[i], ", "))
+			if r.keyOnly {
+				name += " only"
+			}
+		}
+		points := true
+		for i := range q.scan {
+			points = points && q.scan[i].point()
+		}
+		switch {
+		case len(q.scan) == 1 && !r.bounded() && name == "primary key":
+			path = "full scan"
+		case len(q.scan) == 1 && !r.bounded():
+			path = "full scan of " + name
+		case points && len(q.scan) == 1:
+			path = "lookup on " + name
+		case points:
+			path = fmt.Sprintf("%d lookups on %s", len(q.scan), name)
+		case len(q.scan) == 1:
+			path = "range of " + name
+		default:
+			path = fmt.Sprintf("%d ranges of %s", len(q.scan), name)
+		}
+	}
+	for _, inner := range q.tables[1:] {
+		path += ", join " + inner.Name
+	}
+	return path
+}
+
+// counts the rows passing through
+type countingIter struct {
+	rows rowIter
+	n    *int
+}
+
+func (it *countingIter) next() ([]Value, error) {
+	row, err := it.rows.next()
+	if row != nil {
+		*it.n++
+	}
+	return row, err
+}
+
+// run a parsed statement, logging it when it is slower than the threshold
+func (db *DB) execStatement(stmt Statement, text string, tx *DBTX) (*StatementResult, error) {
+	var info ScanInfo
+	if r, ok := stmt.(scanReporter); ok {
+		r.reportScan(&info)
+	}
+	start := time.Now()
+	res, err := stmt.Exec(db, tx)
+	elapsed := time.Since(start)
+	if threshold := db.SlowQueryThreshold(); threshold > 0 && elapsed >= threshold {
+		attrs := []any{"statement", text}
+		if info.Table != "" {
+			attrs = append(attrs, "table", info.Table, "access_path", info.Path, "rows_scanned", info.Scanned)
+		}
+		attrs = append(attrs, "duration", elapsed)
+		if err != nil {
+			attrs = append(attrs, "err", err)
+		}
+		db.log().Warn("slow query", attrs...)
+	}
+	return res, err
+}
+
+// parse & run a statement, in `tx` or in a transaction of its own when nil
+func (db *DB) Exec(text string, tx *DBTX) (*StatementResult, error) {
+	stmt, err := parseStatement(text)
+	if err != nil {
+		return nil, err
+	}
+	return db.execStatement(stmt, text, tx)
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics
+// counters & histograms updated by the commits, read with `DB.Metrics` or
+// scraped in the Prometheus text format from `DB.MetricsHandler`.
+
+// upper bounds of the latency buckets, in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// upper bounds of the pages written per commit
+var pageBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one for the values above all bounds
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64 // cumulative, the values up to each bound then all of them
+	Sum    float64
+	Count  uint64
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.counts)), Sum: h.sum, Count: h.count}
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		s.Counts[i] = total
+	}
+	return s
+}
+
+// the metrics of a KV, nil until it is opened
+type kvMetrics struct {
+	commits        atomic.Uint64
+	aborts         atomic.Uint64
+	writerWait     atomic.Int64 // nanoseconds
+	freePages      atomic.Int64
+	commitLatency  *histogram
+	fsyncLatency   *histogram
+	pagesPerCommit *histogram
+}
+
+func newKVMetrics() *kvMetrics {
+	return &kvMetrics{
+		commitLatency:  newHistogram(latencyBuckets),
+		fsyncLatency:   newHistogram(latencyBuckets),
+		pagesPerCommit: newHistogram(pageBuckets),
+	}
+}
+
+func (m *kvMetrics) commit(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.aborts.Add(1)
+		return
+	}
+	m.commits.Add(1)
+	m.commitLatency.observe(time.Since(start).Seconds())
+}
+
+func (m *kvMetrics) abort() {
+	if m != nil {
+		m.aborts.Add(1)
+	}
+}
+
+// take the writer lock, adding the time waited for it
+func (kv *KV) lockWriter() {
+	start := time.Now()
+	kv.writer.Lock()
+	if kv.metrics != nil {
+		kv.metrics.writerWait.Add(int64(time.Since(start)))
+	}
+}
+
+// fsync the file, timing it
+func (kv *KV) sync() error {
+	start := time.Now()
+	err := kv.fp.Sync()
+	if kv.metrics != nil {
+		kv.metrics.fsyncLatency.observe(time.Since(start).Seconds())
+	}
+	return err
+}
+
+type MetricsSnapshot struct {
+	Commits        uint64 // write transactions committed, with at least a write
+	Aborts         uint64 // write transactions aborted or failing to commit
+	CommitLatency  HistogramSnapshot
+	FsyncLatency   HistogramSnapshot
+	PagesPerCommit HistogramSnapshot
+	WriterWait     time.Duration // spent waiting for the writer lock
+	FreePages      int           // in the free list after the last commit
+	ActiveReaders  int           // snapshots held, `KV.readers`
+	QueueDepth     int           // tasks waiting for a worker, `WorkerPool.waiting`
+	Workers        int
+}
+
+func (db *DB) Metrics() MetricsSnapshot {
+	s := MetricsSnapshot{}
+	if m := db.kv.metrics; m != nil {
+		s.Commits = m.commits.Load()
+		s.Aborts = m.aborts.Load()
+		s.CommitLatency = m.commitLatency.snapshot()
+		s.FsyncLatency = m.fsyncLatency.snapshot()
+		s.PagesPerCommit = m.pagesPerCommit.snapshot()
+		s.WriterWait = time.Duration(m.writerWait.Load())
+		s.FreePages = int(m.freePages.Load())
+	}
+	db.kv.mu.Lock()
+	s.ActiveReaders = len(db.kv.readers)
+	db.kv.mu.Unlock()
+	if db.pool != nil {
+		s.QueueDepth = db.pool.Waiting()
+		s.Workers = db.pool.Workers()
+	}
+	return s
+}
+
+// write the metrics in the Prometheus text format
+func (db *DB) WriteMetrics(w io.Writer) error {
+	s := db.Metrics()
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string, v float64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+	}
+	hist := func(name, help string, h HistogramSnapshot) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, bound := range h.Bounds {
+			fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.Counts[i])
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+		fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.Sum), name, h.Count)
+	}
+	metric("atomixdb_commits_total", "counter", "Write transactions committed.", float64(s.Commits))
+	metric("atomixdb_aborts_total", "counter", "Write transactions aborted or failing to commit.", float64(s.Aborts))
+	hist("atomixdb_commit_duration_seconds", "Time to commit a write transaction.", s.CommitLatency)
+	hist("atomixdb_fsync_duration_seconds", "Time of an fsync of the database file.", s.FsyncLatency)
+	hist("atomixdb_commit_pages", "Pages written per commit.", s.PagesPerCommit)
+	metric("atomixdb_writer_lock_wait_seconds_total", "counter", "Time spent waiting for the writer lock.", s.WriterWait.Seconds())
+	metric("atomixdb_free_pages", "gauge", "Pages in the free list.", float64(s.FreePages))
+	metric("atomixdb_active_readers", "gauge", "Snapshots held by readers & transactions.", float64(s.ActiveReaders))
+	metric("atomixdb_worker_queue_depth", "gauge", "Tasks waiting for a worker.", float64(s.QueueDepth))
+	metric("atomixdb_workers", "gauge", "Running workers of the pool.", float64(s.Workers))
+	return bw.Flush()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		db.WriteMetrics(w)
+	})
+}
+
+// serve the metrics at /metrics on `addr` until the server is closed
+func (db *DB) ServeMetrics(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", db.MetricsHandler())
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return srv, nil
+}
@@ -3,6 +3,7 @@
 package database
 
 import (
+	"errors"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -25,3 +26,17 @@ func fallocateFile(fd uintptr, offset int64, length int64) error {
 func pwriteFile(fd uintptr, data []byte, offset int64) (int, error) {
 	return syscall.Pwrite(int(fd), data, offset)
 }
+
+// take an advisory lock on the whole file without waiting, shared or
+// exclusive. it is released when the file is closed.
+func lockFile(fd uintptr, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	err := unix.Flock(int(fd), how|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
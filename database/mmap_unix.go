@@ -2,7 +2,12 @@
 
 package database
 
-import "syscall"
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 func mmapFile(fd uintptr, offset int64, length int, prot, flags int) ([]byte, error) {
 	return syscall.Mmap(int(fd), offset, length, prot, flags)
@@ -19,3 +24,17 @@ func fallocateFile(fd uintptr, offset int64, length int64) error {
 func pwriteFile(fd uintptr, data []byte, offset int64) (int, error) {
 	return syscall.Pwrite(int(fd), data, offset)
 }
+
+// take an advisory lock on the whole file without waiting, shared or
+// exclusive. it is released when the file is closed.
+func lockFile(fd uintptr, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	err := unix.Flock(int(fd), how|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
@@ -3,19 +3,26 @@
 package database
 
 import (
+	"errors"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
 func mmapFile(fd uintptr, offset int64, length int, prot, flags int) ([]byte, error) {
-	h, err := syscall.CreateFileMapping(syscall.Handle(fd), nil, uint32(syscall.PAGE_READWRITE),
+	protect, access := uint32(syscall.PAGE_READWRITE), uint32(syscall.FILE_MAP_WRITE)
+	if prot&PROT_WRITE == 0 {
+		protect, access = syscall.PAGE_READONLY, syscall.FILE_MAP_READ
+	}
+	h, err := syscall.CreateFileMapping(syscall.Handle(fd), nil, protect,
 		uint32(offset>>32), uint32(offset&0xffffffff), nil)
 	if err != nil {
 		return nil, err
 	}
 	defer syscall.CloseHandle(h)
 
-	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE,
+	addr, err := syscall.MapViewOfFile(h, access,
 		uint32(offset>>32), uint32(offset&0xffffffff), uintptr(length))
 	if err != nil {
 		return nil, err
@@ -50,3 +57,20 @@ func pwriteFile(fd uintptr, data []byte, offset int64) (int, error) {
 	err := syscall.WriteFile(syscall.Handle(fd), data, &bytesWritten, &overlapped)
 	return int(bytesWritten), err
 }
+
+// take a lock on the file without waiting, shared or exclusive. it is
+// released when the file is closed. windows locks keep others from
+// reading & writing the bytes they cover, so it covers a byte past the
+// end of any database.
+func lockFile(fd uintptr, exclusive bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	overlapped := windows.Overlapped{OffsetHigh: 1 << 30}
+	err := windows.LockFileEx(windows.Handle(fd), flags, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
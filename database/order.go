@@ -0,0 +1,423 @@
+package database
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// an ORDER BY term, NULLs sort first
+type OrderItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// the memory a sort may use before spilling sorted runs to temporary files
+const DEFAULT_SORT_MEMORY = 16 << 20
+
+func (db *DB) SetSortMemory(n int) {
+	db.mu.Lock()
+	db.sortMemory = n
+	db.mu.Unlock()
+}
+
+func (db *DB) SortMemory() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.sortMemory <= 0 {
+		return DEFAULT_SORT_MEMORY
+	}
+	return db.sortMemory
+}
+
+func bindOrder(items []OrderItem, bind func(Expr) (Expr, error)) ([]Expr, error) {
+	var keys []Expr
+	for _, item := range items {
+		e, err := bind(item.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("ORDER BY: %w", err)
+		}
+		keys = append(keys, e)
+	}
+	return keys, nil
+}
+
+// whether the rows can be read in ORDER BY order through a key of the
+// FROM table, instead of being sorted. adjusts the scan if so.
+// the joins keep the order of the rows of the FROM table.
+func (q *query) useIndexOrder(keys []Expr) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	base := q.tables[0]
+	if systemTableOf(base) != nil {
+		return false // made in primary key order only
+	}
+	desc := q.stmt.OrderBy[0].Desc
+	var cols []string
+	for i, e := range keys {
+		c, ok := e.(*ColumnRef)
+		if !ok || baseColumn(base, c) == "" || q.stmt.OrderBy[i].Desc != desc {
+			return false
+		}
+		cols = append(cols, baseColumn(base, c))
+	}
+
+	// the ranges must follow each other in the order of `cols`. with a
+	// single range, the columns fixed to a value can come first.
+	var fixed []string
+	for i := range q.scan {
+		r := &q.scan[i]
+		switch {
+		case len(q.scan) == 1 && len(r.prefix) > 0 && r.lo == nil && r.hi == nil:
+			fixed = r.key[:len(r.prefix)]
+		case len(q.scan) == 1 && len(r.prefix) > 0 && r.col == cols[0]:
+			fixed = r.key[:len(r.prefix)]
+		case len(r.prefix) > 0:
+			return false
+		case r.bounded() && r.col != cols[0]:
+			return false // the range on another key is likely narrower
+		}
+	}
+	key := append(append([]string{}, fixed...), cols...)
+	if _, err := findIndex(base, key); err != nil {
+		return false
+	}
+	for i := range q.scan {
+		r := &q.scan[i]
+		if r.lo == nil && r.hi == nil {
+			r.col = cols[0]
+		}
+		r.key, r.desc = key, desc
+	}
+	if desc {
+		for i, j := 0, len(q.scan)-1; i < j; i, j = i+1, j-1 {
+			q.scan[i], q.scan[j] = q.scan[j], q.scan[i]
+		}
+	}
+	return true
+}
+
+// passes the records to `fn` in ORDER BY order
+type orderedOutput struct {
+	keys   []Expr // evaluated against the rows, nil if no sort is needed
+	sorter *externalSorter
+	fn     func(rec *Record) error
+	names  []string
+}
+
+func newOrderedOutput(db *DB, items []OrderItem, keys []Expr, fn func(rec *Record) error) *orderedOutput {
+	out := &orderedOutput{keys: keys, fn: fn}
+	if len(keys) > 0 {
+		desc := make([]bool, len(items))
+		for i, item := range items {
+			desc[i] = item.Desc
+		}
+		out.sorter = &externalSorter{desc: desc, budget: db.SortMemory()}
+	}
+	return out
+}
+
+func (out *orderedOutput) add(row []Value, rec *Record) error {
+	if out.sorter == nil {
+		return out.fn(rec)
+	}
+	out.names = rec.Cols
+	key := make([]Value, len(out.keys))
+	for i, e := range out.keys {
+		v, err := e.Eval(row)
+		if err != nil {
+			return err
+		}
+		key[i] = v
+	}
+	return out.sorter.add(key, rec.Vals)
+}
+
+func (out *orderedOutput) finish() error {
+	if out.sorter == nil {
+		return nil
+	}
+	return out.sorter.merge(func(vals []Value) error {
+		return out.fn(&Record{Cols: out.names, Vals: vals})
+	})
+}
+
+func (out *orderedOutput) close() {
+	if out.sorter != nil {
+		out.sorter.close()
+	}
+}
+
+// sorts rows by their keys. once the rows held in memory exceed the budget
+// they are sorted & written to a temporary file as a run, at the end the
+// runs are merged.
+type externalSorter struct {
+	desc   []bool
+	budget int
+	buf    []sortEntry
+	size   int // estimated bytes of `buf`
+	seq    uint64
+	runs   []*os.File
+}
+
+type sortEntry struct {
+	seq  uint64 // the input order, keeps the sort stable
+	key  []Value
+	vals []Value
+}
+
+func (s *externalSorter) less(a, b *sortEntry) bool {
+	for i := range a.key {
+		c := cmpValuesNull(a.key[i], b.key[i])
+		if s.desc[i] {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return a.seq < b.seq
+}
+
+func (s *externalSorter) add(key, vals []Value) error {
+	e := sortEntry{seq: s.seq, key: key, vals: vals}
+	s.seq++
+	s.buf = append(s.buf, e)
+	s.size += entrySize(&e)
+	if s.size > s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+func entrySize(e *sortEntry) int {
+	n := 64
+	for _, v := range e.key {
+		n += 40 + len(v.Str)
+	}
+	for _, v := range e.vals {
+		n += 40 + len(v.Str)
+	}
+	return n
+}
+
+func (s *externalSorter) sortBuf() {
+	sort.Slice(s.buf, func(i, j int) bool { return s.less(&s.buf[i], &s.buf[j]) })
+}
+
+// write the rows held in memory as a sorted run
+func (s *externalSorter) spill() error {
+	s.sortBuf()
+	f, err := os.CreateTemp("", "atomixdb-sort-*")
+	if err != nil {
+		return fmt.Errorf("sort: %w", err)
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	for i := range s.buf {
+		writeSortEntry(w, &s.buf[i])
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("sort: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("sort: %w", err)
+	}
+	s.buf, s.size = nil, 0
+	return nil
+}
+
+// pass the rows to `fn` in order
+func (s *externalSorter) merge(fn func(vals []Value) error) error {
+	s.sortBuf()
+	if len(s.runs) == 0 {
+		for _, e := range s.buf {
+			if err := fn(e.vals); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	h := &runHeap{sorter: s}
+	mem := &sortRun{mem: s.buf}
+	for _, run := range append([]*sortRun{mem}, s.openRuns()...) {
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.runs = append(h.runs, run)
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		run := h.runs[0]
+		if err := fn(run.cur.vals); err != nil {
+			return err
+		}
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func (s *externalSorter) openRuns() []*sortRun {
+	var runs []*sortRun
+	for _, f := range s.runs {
+		runs = append(runs, &sortRun{r: bufio.NewReader(f)})
+	}
+	return runs
+}
+
+// remove the temporary files
+func (s *externalSorter) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+	s.buf = nil
+}
+
+// a sorted run, either spilled to a file or the rows left in memory
+type sortRun struct {
+	r   *bufio.Reader
+	mem []sortEntry
+	cur sortEntry
+}
+
+func (run *sortRun) advance() (bool, error) {
+	if run.r == nil {
+		if len(run.mem) == 0 {
+			return false, nil
+		}
+		run.cur, run.mem = run.mem[0], run.mem[1:]
+		return true, nil
+	}
+	e, err := readSortEntry(run.r)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sort: %w", err)
+	}
+	run.cur = e
+	return true, nil
+}
+
+type runHeap struct {
+	sorter *externalSorter
+	runs   []*sortRun
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool {
+	return h.sorter.less(&h.runs[i].cur, &h.runs[j].cur)
+}
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*sortRun)) }
+func (h *runHeap) Pop() interface{} {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
+
+// Sort Run Entry Format
+// | seq | nkey | key values | nvals | values |
+// the numbers are uvarints, a value is | type 1B | payload |
+// with 8 bytes for numbers & | len uvarint | bytes | for strings.
+
+func writeSortEntry(w *bufio.Writer, e *sortEntry) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], e.seq)])
+	for _, vals := range [][]Value{e.key, e.vals} {
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(vals)))])
+		for _, v := range vals {
+			writeSortValue(w, v)
+		}
+	}
+}
+
+func writeSortValue(w *bufio.Writer, v Value) {
+	var buf [binary.MaxVarintLen64]byte
+	w.WriteByte(byte(v.Type))
+	switch v.Type {
+	case TYPE_INT64:
+		binary.LittleEndian.PutUint64(buf[:8], uint64(v.I64))
+		w.Write(buf[:8])
+	case TYPE_FLOAT64:
+		binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(v.F64))
+		w.Write(buf[:8])
+	case TYPE_BYTES:
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(v.Str)))])
+		w.Write(v.Str)
+	}
+}
+
+func readSortEntry(r *bufio.Reader) (sortEntry, error) {
+	var e sortEntry
+	seq, err := binary.ReadUvarint(r)
+	if err != nil {
+		return e, err // io.EOF at the end of the run
+	}
+	e.seq = seq
+	for _, vals := range []*[]Value{&e.key, &e.vals} {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return e, io.ErrUnexpectedEOF
+		}
+		*vals = make([]Value, n)
+		for i := range *vals {
+			if (*vals)[i], err = readSortValue(r); err != nil {
+				return e, err
+			}
+		}
+	}
+	return e, nil
+}
+
+func readSortValue(r *bufio.Reader) (Value, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return Value{}, io.ErrUnexpectedEOF
+	}
+	v := Value{Type: uint32(typ)}
+	var buf [8]byte
+	switch v.Type {
+	case TYPE_INT64, TYPE_FLOAT64:
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return v, io.ErrUnexpectedEOF
+		}
+		u := binary.LittleEndian.Uint64(buf[:])
+		if v.Type == TYPE_INT64 {
+			v.I64 = int64(u)
+		} else {
+			v.F64 = math.Float64frombits(u)
+		}
+	case TYPE_BYTES:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return v, io.ErrUnexpectedEOF
+		}
+		v.Str = make([]byte, n)
+		if _, err := io.ReadFull(r, v.Str); err != nil {
+			return v, io.ErrUnexpectedEOF
+		}
+	}
+	return v, nil
+}
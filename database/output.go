@@ -0,0 +1,240 @@
+package database
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// result output formats, set per session with `SET output = format`
+const (
+	OUTPUT_TABLE    = "table"    // ASCII table
+	OUTPUT_CSV      = "csv"      // a header row & a row per record
+	OUTPUT_TSV      = "tsv"      // tab separated, with \t \n \r \\ escaped
+	OUTPUT_JSON     = "json"     // an array of objects
+	OUTPUT_JSONL    = "jsonl"    // an object per line
+	OUTPUT_VERTICAL = "vertical" // a column per line, for wide rows
+)
+
+var outputFormats = []string{OUTPUT_TABLE, OUTPUT_CSV, OUTPUT_TSV, OUTPUT_JSON, OUTPUT_JSONL, OUTPUT_VERTICAL}
+
+// how bytes that are not valid UTF-8 are shown, `SET binary_output = hex | base64`
+const (
+	BINARY_HEX    = "hex"    // \x followed by the hex digits
+	BINARY_BASE64 = "base64" // standard base64
+)
+
+type OutputOptions struct {
+	Format string
+	Footer bool   // the row count & elapsed time after the records
+	Binary string // BINARY_HEX or BINARY_BASE64
+}
+
+func checkOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, expected one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+// a value as text, bytes that are not valid UTF-8 are encoded
+func displayValue(v Value, binary string) string {
+	if v.Type != TYPE_BYTES || utf8.Valid(v.Str) {
+		return formatValue(v)
+	}
+	if binary == BINARY_BASE64 {
+		return base64.StdEncoding.EncodeToString(v.Str)
+	}
+	return `\x` + hex.EncodeToString(v.Str)
+}
+
+// write the records & the message of a result in the chosen format
+func writeResult(w io.Writer, res *StatementResult, opts OutputOptions, elapsed time.Duration) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	if res.Records != nil {
+		switch opts.Format {
+		case OUTPUT_CSV:
+			writeCSVRecords(bw, res.Records, opts)
+		case OUTPUT_TSV:
+			writeTSV(bw, res.Records, opts)
+		case OUTPUT_JSON, OUTPUT_JSONL:
+			writeJSON(bw, res.Records, opts)
+		case OUTPUT_VERTICAL:
+			writeVertical(bw, res.Records, opts)
+		default:
+			writeTable(bw, res.Records, opts.Binary)
+		}
+		if opts.Footer {
+			rows := "rows"
+			if len(res.Records) == 1 {
+				rows = "row"
+			}
+			fmt.Fprintf(bw, "(%d %s, %v)\n", len(res.Records), rows, elapsed.Round(time.Microsecond))
+		}
+	}
+	if res.Message != "" {
+		fmt.Fprintln(bw, res.Message)
+	}
+}
+
+func displayFields(rec *Record, binary string) []string {
+	fields := make([]string, len(rec.Vals))
+	for i, v := range rec.Vals {
+		fields[i] = displayValue(v, binary)
+	}
+	return fields
+}
+
+func writeTable(w io.Writer, records []*Record, binary string) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No records found")
+		return
+	}
+
+	colWidths := make([]int, len(records[0].Cols))
+	for _, record := range records {
+		for i, col := range record.Cols {
+			colWidths[i] = max(colWidths[i], len(col))
+			colWidths[i] = max(colWidths[i], len(displayValue(record.Vals[i], binary)))
+		}
+	}
+
+	border := "+"
+	for _, width := range colWidths {
+		border += strings.Repeat("-", width+2) + "+"
+	}
+
+	fmt.Fprintln(w, border)
+	fmt.Fprint(w, "|")
+	for i, col := range records[0].Cols {
+		fmt.Fprintf(w, " %-*s |", colWidths[i], col)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, border)
+
+	for _, record := range records {
+		fmt.Fprint(w, "|")
+		for i, val := range record.Vals {
+			fmt.Fprintf(w, " %-*s |", colWidths[i], displayValue(val, binary))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, border)
+}
+
+func writeCSVRecords(w *bufio.Writer, records []*Record, opts OutputOptions) {
+	csvOpts := CSVOptions{}.withDefaults()
+	if len(records) > 0 {
+		writeCSVRecord(w, records[0].Cols, csvOpts)
+	}
+	for _, rec := range records {
+		writeCSVRecord(w, displayFields(rec, opts.Binary), csvOpts)
+	}
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func writeTSV(w io.Writer, records []*Record, opts OutputOptions) {
+	if len(records) > 0 {
+		fmt.Fprintln(w, strings.Join(records[0].Cols, "\t"))
+	}
+	for _, rec := range records {
+		fields := displayFields(rec, opts.Binary)
+		for i := range fields {
+			fields[i] = tsvEscaper.Replace(fields[i])
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+}
+
+// an object per record with the columns in order, as an array or one per line
+func writeJSON(w io.Writer, records []*Record, opts OutputOptions) {
+	array := opts.Format == OUTPUT_JSON
+	if array {
+		fmt.Fprint(w, "[")
+	}
+	for i, rec := range records {
+		if array && i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		if array {
+			fmt.Fprint(w, "\n  ")
+		}
+		var sb strings.Builder
+		sb.WriteByte('{')
+		for j, col := range rec.Cols {
+			if j > 0 {
+				sb.WriteByte(',')
+			}
+			sb.Write(jsonString(col))
+			sb.WriteByte(':')
+			sb.Write(jsonValue(rec.Vals[j], opts.Binary))
+		}
+		sb.WriteByte('}')
+		fmt.Fprint(w, sb.String())
+		if !array {
+			fmt.Fprintln(w)
+		}
+	}
+	if array {
+		if len(records) > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "]")
+	}
+}
+
+func jsonString(s string) []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+func jsonValue(v Value, binary string) []byte {
+	switch v.Type {
+	case TYPE_INT64:
+		return strconv.AppendInt(nil, v.I64, 10)
+	case TYPE_FLOAT64:
+		data, err := json.Marshal(v.F64)
+		if err != nil {
+			return jsonString(formatValue(v)) // NaN & the infinities
+		}
+		return data
+	case TYPE_NULL:
+		return []byte("null")
+	default:
+		return jsonString(displayValue(v, binary))
+	}
+}
+
+// psql's expanded display, a block per record with a line per column
+//
+//	-[ RECORD 1 ]---
+//	id       | 1
+//	customer | ann
+func writeVertical(w io.Writer, records []*Record, opts OutputOptions) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No records found")
+		return
+	}
+	width := 0
+	for _, col := range records[0].Cols {
+		width = max(width, len(col))
+	}
+	for i, rec := range records {
+		header := fmt.Sprintf("-[ RECORD %d ]", i+1)
+		fmt.Fprintln(w, header+strings.Repeat("-", max(width+3-len(header), 3)))
+		for j, field := range displayFields(rec, opts.Binary) {
+			fmt.Fprintf(w, "%-*s | %s\n", width, rec.Cols[j], field)
+		}
+	}
+}
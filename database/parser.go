@@ -0,0 +1,980 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownStatement = errors.New("unknown statement")
+
+type Parser struct {
+	tokens []Token
+	pos    int
+}
+
+// parses a single statement, an optional trailing `;` is allowed
+func parseStatement(input string) (Statement, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+
+	var stmt Statement
+	switch {
+	case p.acceptKeyword("savepoint"):
+		stmt, err = p.parseSavepoint()
+	case p.acceptKeyword("rollback"):
+		stmt, err = p.parseRollbackTo()
+	case p.acceptKeyword("release"):
+		stmt, err = p.parseRelease()
+	case p.acceptKeyword("set"):
+		stmt, err = p.parseSet()
+	case p.acceptKeyword("select"):
+		stmt, err = p.parseSelect()
+	case p.acceptKeyword("import"):
+		stmt, err = p.parseImport()
+	case p.acceptKeyword("export"):
+		stmt, err = p.parseExport()
+	case p.acceptKeyword("dump"):
+		stmt, err = p.parseDump()
+	case p.acceptKeyword("restore"):
+		stmt, err = p.parseRestore()
+	case p.acceptKeyword("load"):
+		stmt, err = p.parseLoad()
+	case p.acceptKeyword("show"):
+		stmt, err = p.parseShow()
+	case p.acceptKeyword("describe"), p.acceptKeyword("desc"):
+		stmt, err = p.parseDescribe()
+	case p.acceptKeyword("stats"):
+		stmt, err = p.parseStats()
+	case p.acceptKeyword("insert"):
+		stmt, err = p.parseInsert()
+	case p.acceptKeyword("update"):
+		stmt, err = p.parseUpdate()
+	case p.acceptKeyword("delete"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, ErrUnknownStatement
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if p.peek().Type != TOKEN_EOF {
+		return nil, p.errorf("unexpected %q", p.peek().Text)
+	}
+	return stmt, nil
+}
+
+// parses a comma separated list of constant values, e.g. a row of a file
+func parseValues(input string) ([]Value, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	list, err := p.parseExprList()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().Type != TOKEN_EOF {
+		return nil, p.errorf("unexpected %q", p.peek().Text)
+	}
+	vals := make([]Value, len(list))
+	for i, e := range list {
+		bound, err := bindWhere(e, &schema{})
+		if err != nil {
+			return nil, err
+		}
+		if vals[i], err = bound.Eval(nil); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// parses a standalone expression, e.g. a filter for `QueryWhere`
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().Type != TOKEN_EOF {
+		return nil, p.errorf("unexpected %q", p.peek().Text)
+	}
+	return e, nil
+}
+
+// SAVEPOINT name
+func (p *Parser) parseSavepoint() (Statement, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &SavepointStmt{Name: name}, nil
+}
+
+// ROLLBACK TO [SAVEPOINT] name
+func (p *Parser) parseRollbackTo() (Statement, error) {
+	if err := p.expectKeyword("to"); err != nil {
+		return nil, err
+	}
+	p.acceptKeyword("savepoint")
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &RollbackToStmt{Name: name}, nil
+}
+
+// RELEASE [SAVEPOINT] name
+func (p *Parser) parseRelease() (Statement, error) {
+	p.acceptKeyword("savepoint")
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseStmt{Name: name}, nil
+}
+
+// SET name {= | TO} value
+func (p *Parser) parseSet() (Statement, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptSymbol("=") && !p.acceptKeyword("to") {
+		return nil, p.errorf("expected \"=\" or TO")
+	}
+	tok := p.next()
+	if tok.Type != TOKEN_STRING && tok.Type != TOKEN_NUMBER && tok.Type != TOKEN_IDENT {
+		return nil, p.errorf("expected a value")
+	}
+	return &SetStmt{Name: strings.ToLower(name), Value: tok.Text}, nil
+}
+
+// LOAD table FROM 'file' [FILLFACTOR percent]
+func (p *Parser) parseLoad() (Statement, error) {
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	file, err := p.parseFile("from")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &LoadStmt{Table: table, File: file}
+	if p.acceptKeyword("fillfactor") {
+		tok := p.next()
+		n, err := strconv.Atoi(tok.Text)
+		if tok.Type != TOKEN_NUMBER || err != nil || n < 50 || n > 100 {
+			return nil, p.errorf("FILLFACTOR must be a percentage between 50 and 100")
+		}
+		stmt.FillFactor = n
+	}
+	return stmt, nil
+}
+
+// IMPORT table FROM 'file' [DELIMITER 'c'] [QUOTE 'c'] [ON ERROR SKIP | ABORT] [BATCH n]
+func (p *Parser) parseImport() (Statement, error) {
+	table, file, err := p.parseTableFile("from")
+	if err != nil {
+		return nil, err
+	}
+	opts, err := p.parseCSVOptions(true)
+	if err != nil {
+		return nil, err
+	}
+	return &ImportStmt{Table: table, File: file, Opts: opts}, nil
+}
+
+// EXPORT table TO 'file' [DELIMITER 'c'] [QUOTE 'c']
+func (p *Parser) parseExport() (Statement, error) {
+	table, file, err := p.parseTableFile("to")
+	if err != nil {
+		return nil, err
+	}
+	opts, err := p.parseCSVOptions(false)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportStmt{Table: table, File: file, Opts: opts}, nil
+}
+
+// SHOW TABLES | SHOW INDEXES [FROM table] | SHOW CONFIG
+func (p *Parser) parseShow() (Statement, error) {
+	switch {
+	case p.acceptKeyword("tables"):
+		return &ShowStmt{What: "tables"}, nil
+	case p.acceptKeyword("config"):
+		return &ShowStmt{What: "config"}, nil
+	case p.acceptKeyword("indexes"), p.acceptKeyword("index"):
+		stmt := &ShowStmt{What: "indexes"}
+		if p.acceptKeyword("from") {
+			table, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Table = table
+		}
+		return stmt, nil
+	default:
+		return nil, p.errorf("expected TABLES, INDEXES or CONFIG after SHOW")
+	}
+}
+
+// DESCRIBE table
+func (p *Parser) parseDescribe() (Statement, error) {
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &ShowStmt{What: "describe", Table: table}, nil
+}
+
+// STATS [table]
+func (p *Parser) parseStats() (Statement, error) {
+	stmt := &StatsStmt{}
+	if p.peek().Type == TOKEN_IDENT {
+		stmt.Table = p.next().Text
+	}
+	return stmt, nil
+}
+
+// DUMP TO 'file'
+func (p *Parser) parseDump() (Statement, error) {
+	file, err := p.parseFile("to")
+	if err != nil {
+		return nil, err
+	}
+	return &DumpStmt{File: file}, nil
+}
+
+// RESTORE FROM 'file'
+func (p *Parser) parseRestore() (Statement, error) {
+	file, err := p.parseFile("from")
+	if err != nil {
+		return nil, err
+	}
+	return &RestoreStmt{File: file}, nil
+}
+
+// table {FROM | TO} 'file'
+func (p *Parser) parseTableFile(kw string) (string, string, error) {
+	table, err := p.expectIdent()
+	if err != nil {
+		return "", "", err
+	}
+	file, err := p.parseFile(kw)
+	return table, file, err
+}
+
+// {FROM | TO} 'file'
+func (p *Parser) parseFile(kw string) (string, error) {
+	if err := p.expectKeyword(kw); err != nil {
+		return "", err
+	}
+	tok := p.next()
+	if tok.Type != TOKEN_STRING {
+		return "", p.errorf("expected a file name")
+	}
+	return tok.Text, nil
+}
+
+func (p *Parser) parseCSVOptions(importing bool) (CSVOptions, error) {
+	var opts CSVOptions
+	for {
+		var err error
+		switch {
+		case p.acceptKeyword("delimiter"):
+			opts.Delimiter, err = p.parseChar("DELIMITER")
+		case p.acceptKeyword("quote"):
+			opts.Quote, err = p.parseChar("QUOTE")
+		case importing && p.acceptKeyword("on"):
+			if err := p.expectKeyword("error"); err != nil {
+				return opts, err
+			}
+			switch {
+			case p.acceptKeyword("skip"):
+				opts.SkipErrors = true
+			case p.acceptKeyword("abort"):
+				opts.SkipErrors = false
+			default:
+				return opts, p.errorf("expected SKIP or ABORT")
+			}
+		case importing && p.acceptKeyword("batch"):
+			tok := p.next()
+			n, perr := strconv.Atoi(tok.Text)
+			if tok.Type != TOKEN_NUMBER || perr != nil || n <= 0 {
+				return opts, p.errorf("BATCH must be a positive number")
+			}
+			opts.BatchSize = n
+		default:
+			d := opts.withDefaults()
+			if d.Delimiter == d.Quote {
+				return opts, p.errorf("the delimiter and the quote must differ")
+			}
+			return opts, nil
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+}
+
+// a string of a single character other than a line break
+func (p *Parser) parseChar(what string) (rune, error) {
+	tok := p.next()
+	r := []rune(tok.Text)
+	if tok.Type != TOKEN_STRING || len(r) != 1 || r[0] == '\n' || r[0] == '\r' {
+		return 0, p.errorf("%s must be a single character", what)
+	}
+	return r[0], nil
+}
+
+// SELECT expr [[AS] alias], ... FROM table [[INNER | LEFT] JOIN table ON cond]...
+// [WHERE cond] [GROUP BY exprs] [HAVING cond] [ORDER BY exprs]
+func (p *Parser) parseSelect() (Statement, error) {
+	stmt := &SelectStmt{}
+	var err error
+	if stmt.Items, err = p.parseSelectItems(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if stmt.From, err = p.parseTableRef(); err != nil {
+		return nil, err
+	}
+	for {
+		kind := JOIN_INNER
+		switch {
+		case p.acceptKeyword("join"):
+		case p.acceptKeyword("inner"):
+			if err := p.expectKeyword("join"); err != nil {
+				return nil, err
+			}
+		case p.acceptKeyword("left"):
+			p.acceptKeyword("outer")
+			if err := p.expectKeyword("join"); err != nil {
+				return nil, err
+			}
+			kind = JOIN_LEFT
+		default:
+			kind = 0
+		}
+		if kind == 0 {
+			break
+		}
+		join := JoinClause{Kind: kind}
+		if join.Table, err = p.parseTableRef(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("on"); err != nil {
+			return nil, err
+		}
+		if join.On, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		stmt.Joins = append(stmt.Joins, join)
+	}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("group") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if stmt.GroupBy, err = p.parseExprList(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("having") {
+		if stmt.Having, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if stmt.OrderBy, err = p.parseOrderBy(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// (* | expr [[AS] alias]) {, (* | expr [[AS] alias])}
+func (p *Parser) parseSelectItems() ([]SelectItem, error) {
+	var items []SelectItem
+	for {
+		if p.acceptSymbol("*") {
+			items = append(items, SelectItem{})
+		} else {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			item := SelectItem{Expr: e}
+			if item.Alias, err = p.parseAlias(); err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if !p.acceptSymbol(",") {
+			return items, nil
+		}
+	}
+}
+
+// expr [ASC | DESC] {, expr [ASC | DESC]}
+func (p *Parser) parseOrderBy() ([]OrderItem, error) {
+	var items []OrderItem
+	for {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		item := OrderItem{Expr: e}
+		if p.acceptKeyword("desc") {
+			item.Desc = true
+		} else {
+			p.acceptKeyword("asc")
+		}
+		items = append(items, item)
+		if !p.acceptSymbol(",") {
+			return items, nil
+		}
+	}
+}
+
+// INSERT INTO table [(cols)] VALUES (exprs), ...
+// [ON CONFLICT [(col)] DO NOTHING | DO UPDATE SET col = expr, ... [WHERE cond]]
+// [RETURNING items]
+func (p *Parser) parseInsert() (Statement, error) {
+	if err := p.expectKeyword("into"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: table}
+	if p.acceptSymbol("(") {
+		if stmt.Cols, err = p.parseIdentList(); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("values"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		row, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("on") {
+		if stmt.OnConflict, err = p.parseOnConflict(); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Returning, err = p.parseReturning(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// CONFLICT [(col)] DO NOTHING | DO UPDATE SET col = expr, ... [WHERE cond]
+func (p *Parser) parseOnConflict() (*OnConflict, error) {
+	if err := p.expectKeyword("conflict"); err != nil {
+		return nil, err
+	}
+	oc := &OnConflict{}
+	var err error
+	if p.acceptSymbol("(") {
+		if oc.Cols, err = p.parseIdentList(); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("do"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("nothing") {
+		return oc, nil
+	}
+	if err := p.expectKeyword("update"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	if oc.Set, err = p.parseAssignments(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if oc.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return oc, nil
+}
+
+// [RETURNING items]
+func (p *Parser) parseReturning() ([]SelectItem, error) {
+	if !p.acceptKeyword("returning") {
+		return nil, nil
+	}
+	return p.parseSelectItems()
+}
+
+func (p *Parser) parseIdentList() ([]string, error) {
+	var list []string
+	for {
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, name)
+		if !p.acceptSymbol(",") {
+			return list, nil
+		}
+	}
+}
+
+// UPDATE table SET col = expr, ... [WHERE cond] [RETURNING items]
+func (p *Parser) parseUpdate() (Statement, error) {
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: table}
+	if err := p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	if stmt.Set, err = p.parseAssignments(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Returning, err = p.parseReturning(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *Parser) parseAssignments() ([]Assignment, error) {
+	var list []Assignment
+	for {
+		col, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Assignment{Col: col, Expr: e})
+		if !p.acceptSymbol(",") {
+			return list, nil
+		}
+	}
+}
+
+// DELETE FROM table [WHERE cond] [RETURNING items]
+func (p *Parser) parseDelete() (Statement, error) {
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: table}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Returning, err = p.parseReturning(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// the words that end a table reference, so they are not taken as an alias
+var clauseKeywords = map[string]bool{
+	"from": true, "where": true, "group": true, "having": true, "order": true, "limit": true,
+	"join": true, "inner": true, "left": true, "on": true, "set": true, "returning": true,
+}
+
+// table [[AS] alias]
+func (p *Parser) parseTableRef() (TableRef, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return TableRef{}, err
+	}
+	ref := TableRef{Name: name}
+	ref.Alias, err = p.parseAlias()
+	return ref, err
+}
+
+// [[AS] alias]
+func (p *Parser) parseAlias() (string, error) {
+	if p.acceptKeyword("as") {
+		return p.expectIdent()
+	}
+	if tok := p.peek(); tok.Type == TOKEN_IDENT && !clauseKeywords[strings.ToLower(tok.Text)] {
+		return p.next().Text, nil
+	}
+	return "", nil
+}
+
+func (p *Parser) parseExprList() ([]Expr, error) {
+	var list []Expr
+	for {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if !p.acceptSymbol(",") {
+			return list, nil
+		}
+	}
+}
+
+// expr := or ; or := and {OR and} ; and := not {AND not} ; not := NOT not | cmp
+// cmp := sum [op sum | [NOT] LIKE sum | [NOT] IN (exprs)]
+// sum := product {(+ | - | ||) product} ; product := unary {(* | / | %) unary}
+// unary := - unary | operand
+func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseNot() (Expr, error) {
+	if !p.acceptKeyword("not") {
+		return p.parseComparison()
+	}
+	e, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Op: "not", Operand: e}, nil
+}
+
+func (p *Parser) parseComparison() (Expr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "!=", "<>", "<=", ">=", "<", ">"} {
+		if p.acceptSymbol(op) {
+			right, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			if op == "<>" {
+				op = "!="
+			}
+			return &BinaryExpr{Op: op, Left: left, Right: right}, nil
+		}
+	}
+	not := p.acceptKeyword("not")
+	switch {
+	case p.acceptKeyword("like"):
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		var e Expr = &BinaryExpr{Op: "like", Left: left, Right: right}
+		if not {
+			e = &UnaryExpr{Op: "not", Operand: e}
+		}
+		return e, nil
+	case p.acceptKeyword("in"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		list, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return &InExpr{Expr: left, List: list, Not: not}, p.expectSymbol(")")
+	case not:
+		return nil, p.errorf("expected LIKE or IN after NOT")
+	}
+	return left, nil
+}
+
+func (p *Parser) parseSum() (Expr, error) {
+	return p.parseBinary([]string{"+", "-", "||"}, p.parseProduct)
+}
+
+func (p *Parser) parseProduct() (Expr, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+// operands joined by left associative operators
+func (p *Parser) parseBinary(ops []string, operand func() (Expr, error)) (Expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range ops {
+			if p.acceptSymbol(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, Left: left, Right: right}
+	}
+}
+
+func (p *Parser) parseUnary() (Expr, error) {
+	if !p.acceptSymbol("-") {
+		return p.parseOperand()
+	}
+	if tok := p.peek(); tok.Type == TOKEN_NUMBER {
+		p.pos++
+		return parseNumber(tok.Text, true)
+	}
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Op: "-", Operand: e}, nil
+}
+
+// a literal, a column, a function call or a parenthesized expression
+func (p *Parser) parseOperand() (Expr, error) {
+	tok := p.peek()
+	switch {
+	case tok.Type == TOKEN_NUMBER:
+		p.pos++
+		return parseNumber(tok.Text, false)
+	case tok.Type == TOKEN_STRING:
+		p.pos++
+		return &Literal{Val: Value{Type: TYPE_BYTES, Str: []byte(tok.Text)}}, nil
+	case p.acceptKeyword("null"):
+		return &Literal{Val: Value{Type: TYPE_NULL}}, nil
+	case p.acceptSymbol("("):
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tok.Type == TOKEN_IDENT:
+		p.pos++
+		if p.acceptSymbol("(") {
+			return p.parseCall(strings.ToLower(tok.Text))
+		}
+		if p.acceptSymbol(".") {
+			name, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+			return &ColumnRef{Table: tok.Text, Name: name}, nil
+		}
+		return &ColumnRef{Name: tok.Text}, nil
+	default:
+		return nil, p.errorf("expected an expression")
+	}
+}
+
+// the arguments of a function call, after the `(`
+func (p *Parser) parseCall(name string) (Expr, error) {
+	if _, ok := scalarFuncs[name]; ok {
+		call := &FuncCall{Func: name}
+		if !p.acceptSymbol(")") {
+			args, err := p.parseExprList()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = args
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkFuncCall(call); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return call, nil
+	}
+	if !aggregateFuncs[name] {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	call := &AggregateCall{Func: name}
+	if name == "count" && p.acceptSymbol("*") {
+		return call, p.expectSymbol(")")
+	}
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	call.Arg = arg
+	return call, p.expectSymbol(")")
+}
+
+func parseNumber(text string, negative bool) (Expr, error) {
+	if negative {
+		text = "-" + text
+	}
+	if strings.Contains(text, ".") {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", text)
+		}
+		return &Literal{Val: Value{Type: TYPE_FLOAT64, F64: f}}, nil
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s", text)
+	}
+	return &Literal{Val: Value{Type: TYPE_INT64, I64: n}}, nil
+}
+
+func (p *Parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *Parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Type != TOKEN_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *Parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.Type == TOKEN_IDENT && strings.EqualFold(tok.Text, kw)
+}
+
+func (p *Parser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.errorf("expected %s", strings.ToUpper(kw))
+	}
+	return nil
+}
+
+func (p *Parser) isSymbol(sym string) bool {
+	tok := p.peek()
+	return tok.Type == TOKEN_SYMBOL && tok.Text == sym
+}
+
+func (p *Parser) acceptSymbol(sym string) bool {
+	if p.isSymbol(sym) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return p.errorf("expected %q", sym)
+	}
+	return nil
+}
+
+func (p *Parser) expectIdent() (string, error) {
+	tok := p.peek()
+	if tok.Type != TOKEN_IDENT {
+		return "", p.errorf("expected a name")
+	}
+	p.pos++
+	return tok.Text, nil
+}
+
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	tok := p.peek()
+	near := tok.Text
+	if tok.Type == TOKEN_EOF {
+		near = "end of input"
+	}
+	return fmt.Errorf("syntax error near %q: %s", near, fmt.Sprintf(format, args...))
+}
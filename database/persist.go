@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"sync"
 )
@@ -19,6 +20,9 @@ const (
 
 type KV struct {
 	Path string
+	// open the file with a shared lock & without writing, other read-only
+	// processes may open it too but no writer
+	ReadOnly bool
 	// internals
 	fp *os.File
 
@@ -41,6 +45,13 @@ type KV struct {
 
 	version uint64
 	readers ReaderList // heap, for tranking the minimum reader version
+	// recently committed write sets, for validating concurrent transactions
+	history []commitRecord
+	metrics *kvMetrics
+	logger  *slog.Logger
+	// tuning, 0 for DEFAULT_MMAP_INITIAL & DEFAULT_FILE_GROWTH
+	mmapInitial int
+	fileGrowth  int
 }
 
 // implements heap.Interface
@@ -54,15 +65,20 @@ func (rl ReaderList) Less(i int, j int) bool {
 	if rl[i] == nil || rl[j] == nil {
 		return false
 	}
-	return rl[i].index < rl[j].index
+	return versionBefore(rl[i].version, rl[j].version)
 }
 
 func (rl ReaderList) Swap(i, j int) {
 	rl[i], rl[j] = rl[j], rl[i]
+	// keep the positions in sync so `EndRead` removes the right reader
+	rl[i].index = i
+	rl[j].index = j
 }
 
 func (rl *ReaderList) Push(item interface{}) {
-	*rl = append(*rl, item.(*KVReader))
+	reader := item.(*KVReader)
+	reader.index = len(*rl)
+	*rl = append(*rl, reader)
 }
 
 func (rl *ReaderList) Pop() interface{} {
@@ -77,15 +93,37 @@ func (rl *ReaderList) Pop() interface{} {
 // it contains the pointer to the root and other important bits.
 // | sig | btree_root | page_used | free_list | version |
 // |  8B | 	   8B 	  | 	 8B	  |		8B	  |   8B    |
+//
+// the version is needed to tell which pages of the free list can be reused,
+// files written before it was stored read as version 0.
+
+// the file is locked by another process, a writer keeps out every other
+// process & a reader keeps out the writers
+var ErrLocked = errors.New("database is locked by another process")
+
+// the commit of a write transaction on a read-only KV
+var ErrReadOnlyDB = errors.New("database is open read-only")
 
 func (db *KV) Open() error {
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	flag := os.O_RDWR | os.O_CREATE
+	if db.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(db.Path, flag, 0o644)
 	if err != nil {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
+	// mapping the file of another writer would corrupt it
+	if err := lockFile(fp.Fd(), !db.ReadOnly); err != nil {
+		fp.Close()
+		return fmt.Errorf("KV Open: %w", err)
+	}
 	db.fp = fp
+	if db.metrics == nil {
+		db.metrics = newKVMetrics()
+	}
 	// create the inital mmap
-	sz, chunk, err := mmapInit(db.fp)
+	sz, chunk, err := mmapInit(db.fp, db.mmapInitial, db.prot())
 	if err != nil {
 		goto fail
 	}
@@ -93,13 +131,12 @@ func (db *KV) Open() error {
 	db.mmap.total = len(chunk)
 	db.mmap.chunks = [][]byte{chunk}
 
-	db.free = FreeListData{
-		head: 0,
-	}
+	db.free = FreeListData{}
 	err = masterLoad(db)
 	if err != nil {
 		goto fail
 	}
+	db.log().Info("database opened", "path", db.Path, "file_size", db.mmap.file, "pages", db.page.flushed)
 	return nil
 
 fail:
@@ -111,52 +148,43 @@ func (db *KV) Close() {
 	for _, chunk := range db.mmap.chunks {
 		err := unmapFile(chunk)
 		if err != nil {
-			fmt.Println("Error while closing DB")
+			db.log().Error("unmap failed", "path", db.Path, "err", err)
 		}
 	}
 	_ = db.fp.Close()
 }
 
 func (db *KVTX) Get(key []byte) ([]byte, bool, error) {
+	db.trackRead(key, key)
 	return db.Tree.Get(key)
 }
 
+// the writes stay in the private tree until commit
 func (db *KVTX) Set(key, val []byte) error {
-	db.Tree.Insert(key, val)
-	return flushPages(db)
+	if err := db.Tree.Insert(key, val); err != nil {
+		return err
+	}
+	db.recordWrite(key, val, false)
+	return nil
 }
 
 func (db *KVTX) Delete(req *DeleteReq) (bool, error) {
-	val, _, err := db.Get(req.Key)
+	val, exists, err := db.Get(req.Key)
 	if err != nil {
 		return false, err
-	} else if len(val) == 0 {
-		return false, errors.New("record not found")
+	} else if !exists {
+		return false, ErrRecordNotFound
 	}
 	deleted := db.Tree.Delete(req.Key)
 	if deleted {
 		req.Old = val
+		db.recordWrite(req.Key, nil, true)
 	}
-	return deleted, flushPages(db)
-}
-
-// persist the newly allocated pages after updates
-func flushPages(db *KVTX) error {
-	if err := writePages(db); err != nil {
-		return err
-	}
-	return syncPages(db)
+	return deleted, nil
 }
 
 func writePages(db *KVTX) error {
-	freed := []uint64{}
-
-	for ptr, page := range db.page.updates {
-		if page == nil {
-			freed = append(freed, ptr)
-		}
-	}
-	db.free.Add(freed)
+	collectFreed(db)
 	npages := int(db.page.nappend) + int(db.kv.page.flushed)
 
 	// extends mmap & file if needed
@@ -166,6 +194,7 @@ func writePages(db *KVTX) error {
 	if err := extendMmap(db.kv, npages); err != nil {
 		return err
 	}
+	db.mmap.chunks = db.kv.mmap.chunks
 
 	for ptr, page := range db.page.updates {
 		if page != nil {
@@ -175,22 +204,26 @@ func writePages(db *KVTX) error {
 	return nil
 }
 
-func syncPages(db *KVTX) error {
-	if err := db.kv.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
-	}
-	db.kv.page.flushed += uint64(db.page.nappend)
-	db.page.updates = map[uint64][]byte{}
-
-	if err := masterStore(db.kv); err != nil {
-		return err
-	}
-	if err := db.kv.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+// move the deallocated pages to `free.freed`, they are added to the
+// free list once all the allocations of the commit are done
+func collectFreed(db *KVTX) {
+	for ptr, page := range db.page.updates {
+		if page == nil {
+			db.free.freed = append(db.free.freed, ptr)
+			delete(db.page.updates, ptr)
+		}
 	}
-	return nil
 }
 
+// Master Page Format
+// | sig | root | used | free head | version | format | head seq | free tail | tail seq |
+// | 8B  |  8B  |  8B  |    8B     |   8B    |   8B   |    8B    |    8B     |    8B    |
+//
+// files of format 0 were written before the free list kept its head & tail,
+// their free pages are found again when they are opened.
+
+const MASTER_FORMAT = 1
+
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created
@@ -201,13 +234,25 @@ func masterLoad(db *KV) error {
 	data := db.mmap.chunks[0]
 	root := binary.LittleEndian.Uint64(data[8:])
 	pagesUsed := binary.LittleEndian.Uint64(data[16:])
-	freeListPtr := binary.LittleEndian.Uint64(data[24:])
+	headPage := binary.LittleEndian.Uint64(data[24:])
+	version := binary.LittleEndian.Uint64(data[32:])
+	format := binary.LittleEndian.Uint64(data[40:])
+	headSeq := binary.LittleEndian.Uint64(data[48:])
+	tailPage := binary.LittleEndian.Uint64(data[56:])
+	tailSeq := binary.LittleEndian.Uint64(data[64:])
 
 	if !bytes.Equal([]byte(DB_SIG), data[:8]) {
 		return errors.New("bad signature")
 	}
+	if format > MASTER_FORMAT {
+		return fmt.Errorf("unsupported file format %d, expected at most %d", format, MASTER_FORMAT)
+	}
 	isBad := 1 > pagesUsed || pagesUsed > uint64(db.mmap.file/BTREE_PAGE_SIZE)
 	isBad = isBad || (root >= pagesUsed)
+	if format == MASTER_FORMAT {
+		isBad = isBad || headPage >= pagesUsed || tailPage >= pagesUsed
+		isBad = isBad || headSeq > tailSeq || (tailSeq > 0 && tailPage == 0)
+	}
 
 	if isBad {
 		return errors.New("bad master page")
@@ -215,16 +260,29 @@ func masterLoad(db *KV) error {
 
 	db.tree.root = root
 	db.page.flushed = pagesUsed
-	db.free.head = freeListPtr
+	db.version = version
+	if format == MASTER_FORMAT {
+		db.free = FreeListData{headPage: headPage, headSeq: headSeq, tailPage: tailPage, tailSeq: tailSeq}
+	} else {
+		reader := KVReader{}
+		reader.mmap.chunks = db.mmap.chunks
+		db.free.setUnlisted(reader.pageGetMapped, root, pagesUsed)
+		db.log().Info("rebuilding the free list of an older file format", "format", format, "free_pages", len(db.free.unlisted))
+	}
 	return nil
 }
 
 func masterStore(db *KV) error {
-	var data [32]byte
+	var data [72]byte
 	copy(data[:8], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[8:16], db.tree.root)
 	binary.LittleEndian.PutUint64(data[16:24], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[24:32], db.free.head)
+	binary.LittleEndian.PutUint64(data[24:32], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[32:40], db.version)
+	binary.LittleEndian.PutUint64(data[40:48], MASTER_FORMAT)
+	binary.LittleEndian.PutUint64(data[48:56], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[56:64], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[64:72], db.free.tailSeq)
 	// Pwrite ensures that updating the page is atomic
 	_, err := pwriteFile(db.fp.Fd(), data[:], 0)
 	if err != nil {
@@ -233,7 +291,8 @@ func masterStore(db *KV) error {
 	return nil
 }
 
-func mmapInit(fp *os.File) (int, []byte, error) {
+// map at least `initial` bytes, doubled until the file fits
+func mmapInit(fp *os.File, initial int, prot int) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
@@ -242,14 +301,17 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 		return 0, nil, errors.New("file size is not a multiple of page size")
 	}
 
-	mmapSize := 64 << 20
+	mmapSize := initial
+	if mmapSize <= 0 {
+		mmapSize = DEFAULT_MMAP_INITIAL
+	}
 	for mmapSize < int(fi.Size()) {
 		// mmapSize can be larger than the file
 		mmapSize *= 2
 	}
 
 	// maps the file data into the process's virtual address space
-	chunk, err := mmapFile(fp.Fd(), 0, mmapSize, PROT_READ|PROT_WRITE, MAP_SHARED)
+	chunk, err := mmapFile(fp.Fd(), 0, mmapSize, prot, MAP_SHARED)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -257,17 +319,27 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 	return int(fi.Size()), chunk, nil
 }
 
+// the protection of the mapped pages
+func (db *KV) prot() int {
+	if db.ReadOnly {
+		return PROT_READ
+	}
+	return PROT_READ | PROT_WRITE
+}
+
 func extendMmap(db *KV, npages int) error {
 	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
 		return nil
 	}
 
-	chunk, err := mmapFile(db.fp.Fd(), int64(db.mmap.total), db.mmap.total, PROT_READ|PROT_WRITE, MAP_SHARED)
+	chunk, err := mmapFile(db.fp.Fd(), int64(db.mmap.total), db.mmap.total, db.prot(), MAP_SHARED)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
+	db.mu.Lock()
 	db.mmap.total += db.mmap.total
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mu.Unlock()
 	return nil
 }
 
@@ -277,8 +349,12 @@ func extendFile(db *KV, npages int) error {
 		return nil
 	}
 
+	growth := db.fileGrowth
+	if growth <= 0 {
+		growth = DEFAULT_FILE_GROWTH
+	}
 	for filePages < npages {
-		inc := filePages / 8
+		inc := filePages / growth
 		if inc < 1 {
 			inc = 1
 		}
@@ -298,7 +374,7 @@ func extendFile(db *KV, npages int) error {
 	return nil
 }
 
-// callbacks for BTree & Freelist, dereference a pointer
+// callbacks for BTree & Freelist while a commit is applied, dereference a pointer
 func (db *KVTX) pageGet(ptr uint64) BNode {
 	if page, ok := db.page.updates[ptr]; ok {
 		return BNode{page}
@@ -334,6 +410,11 @@ func (db *KVReader) pageGetMapped(ptr uint64) BNode {
 	panic("bad ptr")
 }
 
+// callback for Freelist, reuse a page
+func (db *KVTX) pageUse(ptr uint64, node BNode) {
+	db.page.updates[ptr] = node.data
+}
+
 // callback for Freelist, allocate new page
 func (db *KVTX) pageAppend(node BNode) uint64 {
 	assert(len(node.data) <= BTREE_PAGE_SIZE)
@@ -342,7 +423,3 @@ func (db *KVTX) pageAppend(node BNode) uint64 {
 	db.page.updates[ptr] = node.data
 	return ptr
 }
-
-func (db *KVTX) pageUse(ptr uint64, node BNode) {
-	db.page.updates[ptr] = node.data
-}
@@ -0,0 +1,488 @@
+package database
+
+import (
+	"sort"
+)
+
+// the most ranges a scan is split into, e.g. for a long IN list
+const MAX_SCAN_RANGES = 256
+
+// a range of the primary key or of an index. the key columns in front of
+// `col` are fixed to the values in `prefix`, `col` is bounded by lo & hi.
+type scanRange struct {
+	col    string
+	prefix []Value
+	lo     *Value // nil if unbounded
+	hi     *Value
+	loCmp  int  // CMP_GE or CMP_GT
+	hiCmp  int  // CMP_LE or CMP_LT
+	desc   bool // from the upper bound down
+	// read the rows from the index key alone, the columns that are
+	// not in the key are NULL
+	keyOnly bool
+	// the key columns the rows are read in order of, starting with the
+	// prefix columns & `col`. by default any key led by `col`.
+	key []string
+}
+
+func fullRange(tdef *TableDef) scanRange {
+	return scanRange{col: tdef.Cols[0], loCmp: CMP_GE, hiCmp: CMP_LE}
+}
+
+func (r *scanRange) bounded() bool {
+	return r.lo != nil || r.hi != nil || len(r.prefix) > 0
+}
+
+// whether the range is a single value
+func (r *scanRange) point() bool {
+	return r.lo != nil && r.hi != nil && r.loCmp == CMP_GE && r.hiCmp == CMP_LE &&
+		cmpValuesNull(*r.lo, *r.hi) == 0
+}
+
+func (r *scanRange) empty() bool {
+	if r.lo == nil || r.hi == nil {
+		return false
+	}
+	c := cmpValuesNull(*r.lo, *r.hi)
+	return c > 0 || (c == 0 && (r.loCmp == CMP_GT || r.hiCmp == CMP_LT))
+}
+
+// narrow the range with `col op val`, returns false for other operators
+func (r *scanRange) add(op string, val Value) bool {
+	switch op {
+	case "=":
+		return r.add(">=", val) && r.add("<=", val)
+	case ">", ">=":
+		cmp := CMP_GE
+		if op == ">" {
+			cmp = CMP_GT
+		}
+		if r.lo == nil {
+			r.lo, r.loCmp = &val, cmp
+			return true
+		}
+		c, _ := cmpValues(val, *r.lo)
+		if c > 0 || (c == 0 && cmp == CMP_GT) {
+			r.lo, r.loCmp = &val, cmp
+		}
+		return true
+	case "<", "<=":
+		cmp := CMP_LE
+		if op == "<" {
+			cmp = CMP_LT
+		}
+		if r.hi == nil {
+			r.hi, r.hiCmp = &val, cmp
+			return true
+		}
+		c, _ := cmpValues(val, *r.hi)
+		if c < 0 || (c == 0 && cmp == CMP_LT) {
+			r.hi, r.hiCmp = &val, cmp
+		}
+		return true
+	}
+	return false
+}
+
+// the intersection of two ranges of the same column
+func (r scanRange) intersect(other scanRange) (scanRange, bool) {
+	if other.lo != nil {
+		op := ">="
+		if other.loCmp == CMP_GT {
+			op = ">"
+		}
+		r.add(op, *other.lo)
+	}
+	if other.hi != nil {
+		op := "<="
+		if other.hiCmp == CMP_LT {
+			op = "<"
+		}
+		r.add(op, *other.hi)
+	}
+	return r, !r.empty()
+}
+
+// orders the lower bounds of two ranges, unbounded first
+func cmpLower(a, b *scanRange) int {
+	switch {
+	case a.lo == nil || b.lo == nil:
+		return boolInt(b.lo == nil) - boolInt(a.lo == nil)
+	}
+	if c := cmpValuesNull(*a.lo, *b.lo); c != 0 {
+		return c
+	}
+	return boolInt(a.loCmp == CMP_GT) - boolInt(b.loCmp == CMP_GT)
+}
+
+// orders the upper bounds of two ranges, unbounded last
+func cmpUpper(a, b *scanRange) int {
+	switch {
+	case a.hi == nil || b.hi == nil:
+		return boolInt(a.hi == nil) - boolInt(b.hi == nil)
+	}
+	if c := cmpValuesNull(*a.hi, *b.hi); c != 0 {
+		return c
+	}
+	return boolInt(a.hiCmp == CMP_LE) - boolInt(b.hiCmp == CMP_LE)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sort the ranges & merge the ones that overlap or touch
+func unionRanges(ranges []scanRange) []scanRange {
+	sort.SliceStable(ranges, func(i, j int) bool { return cmpLower(&ranges[i], &ranges[j]) < 0 })
+	var out []scanRange
+	for _, r := range ranges {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if last.hi == nil || r.lo == nil {
+				if cmpUpper(&r, last) > 0 {
+					last.hi, last.hiCmp = r.hi, r.hiCmp
+				}
+				continue
+			}
+			c := cmpValuesNull(*r.lo, *last.hi)
+			if c < 0 || (c == 0 && (r.loCmp == CMP_GE || last.hiCmp == CMP_LE)) {
+				if cmpUpper(&r, last) > 0 {
+					last.hi, last.hiCmp = r.hi, r.hiCmp
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func intersectRanges(a, b []scanRange) []scanRange {
+	var out []scanRange
+	for _, x := range a {
+		for _, y := range b {
+			if r, ok := x.intersect(y); ok {
+				out = append(out, r)
+			}
+		}
+	}
+	return unionRanges(out)
+}
+
+// a conjunct of the form `col op literal` or `literal op col`
+func rangeTerm(e Expr) (col *ColumnRef, op string, val Value, ok bool) {
+	b, isBin := e.(*BinaryExpr)
+	if !isBin {
+		return nil, "", Value{}, false
+	}
+	flipped := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	if _, isCmp := flipped[b.Op]; !isCmp {
+		return nil, "", Value{}, false
+	}
+	if c, isCol := b.Left.(*ColumnRef); isCol {
+		if lit, isLit := b.Right.(*Literal); isLit {
+			return c, b.Op, lit.Val, true
+		}
+	}
+	if c, isCol := b.Right.(*ColumnRef); isCol {
+		if lit, isLit := b.Left.(*Literal); isLit {
+			return c, flipped[b.Op], lit.Val, true
+		}
+	}
+	return nil, "", Value{}, false
+}
+
+// whether a range scan can start at `col`
+func leadsKey(tdef *TableDef, col string) bool {
+	if tdef.Cols[0] == col {
+		return true
+	}
+	for _, index := range tdef.Indexes {
+		if index[0] == col {
+			return true
+		}
+	}
+	return false
+}
+
+// the column of `tdef` a bound reference points to, "" for the columns
+// of the joined tables that follow it in the row
+func baseColumn(tdef *TableDef, c *ColumnRef) string {
+	if c.idx < len(tdef.Cols) {
+		return tdef.Cols[c.idx]
+	}
+	return ""
+}
+
+// the ranges of `col` a condition limits it to, in key order. false if
+// the condition does not limit the column. the ranges may hold values
+// the condition rejects, but never miss one it accepts.
+func termRanges(tdef *TableDef, cond Expr, col string) ([]scanRange, bool) {
+	typ := tdef.Types[ColIndex(tdef, col)]
+	isCol := func(e Expr) bool {
+		c, ok := e.(*ColumnRef)
+		return ok && baseColumn(tdef, c) == col
+	}
+	r := scanRange{col: col, loCmp: CMP_GE, hiCmp: CMP_LE}
+
+	if c, op, val, ok := rangeTerm(cond); ok {
+		// the key only holds values of the column type
+		if !isCol(c) || val.Type != typ {
+			return nil, false
+		}
+		r.add(op, val)
+		return []scanRange{r}, true
+	}
+	switch e := cond.(type) {
+	case *InExpr:
+		if e.Not || !isCol(e.Expr) {
+			return nil, false
+		}
+		var points []scanRange
+		for _, item := range e.List {
+			lit, ok := item.(*Literal)
+			if !ok {
+				return nil, false
+			}
+			if lit.Val.Type == TYPE_NULL {
+				continue // never equals the column
+			}
+			if lit.Val.Type != typ {
+				return nil, false
+			}
+			p := r
+			p.add("=", lit.Val)
+			points = append(points, p)
+		}
+		return unionRanges(points), true
+	case *BinaryExpr:
+		switch e.Op {
+		case "like":
+			lit, ok := e.Right.(*Literal)
+			if !isCol(e.Left) || !ok || lit.Val.Type != TYPE_BYTES || typ != TYPE_BYTES {
+				return nil, false
+			}
+			return likeRange(r, lit.Val.Str)
+		case "and":
+			left, okl := termRanges(tdef, e.Left, col)
+			right, okr := termRanges(tdef, e.Right, col)
+			switch {
+			case okl && okr:
+				return intersectRanges(left, right), true
+			case okl:
+				return left, true
+			}
+			return right, okr
+		case "or":
+			left, okl := termRanges(tdef, e.Left, col)
+			right, okr := termRanges(tdef, e.Right, col)
+			if !okl || !okr {
+				return nil, false
+			}
+			return unionRanges(append(left, right...)), true
+		}
+	}
+	return nil, false
+}
+
+// the strings a LIKE pattern can match share the bytes before the first
+// wildcard, `'ab%'` -> ['ab', 'ac')
+func likeRange(r scanRange, pattern []byte) ([]scanRange, bool) {
+	n := 0
+	for n < len(pattern) && pattern[n] != '%' && pattern[n] != '_' {
+		n++
+	}
+	prefix := append([]byte{}, pattern[:n]...)
+	if n == len(pattern) {
+		r.add("=", Value{Type: TYPE_BYTES, Str: prefix})
+		return []scanRange{r}, true
+	}
+	if n == 0 {
+		return nil, false
+	}
+	r.add(">=", Value{Type: TYPE_BYTES, Str: prefix})
+	// the next string after all those with the prefix
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) > 0 {
+		end[len(end)-1]++
+		r.add("<", Value{Type: TYPE_BYTES, Str: end})
+	}
+	return []scanRange{r}, true
+}
+
+// the ranges of `col` implied by the conjuncts of the WHERE clause
+func columnRanges(tdef *TableDef, conds []Expr, col string) ([]scanRange, bool) {
+	ranges := []scanRange{{col: col, loCmp: CMP_GE, hiCmp: CMP_LE}}
+	limited := false
+	for _, cond := range conds {
+		if t, ok := termRanges(tdef, cond, col); ok {
+			ranges, limited = intersectRanges(ranges, t), true
+		}
+	}
+	return ranges, limited
+}
+
+// the ranges to read for the WHERE clause, through the key that narrows
+// them the most. on a key, the leading columns limited to single values
+// are fixed & the next limited column is bounded, e.g. for an index on
+// (a, b), `a IN (1, 2) AND b > 5` reads (1, >5) & (2, >5).
+// the whole clause is still evaluated on every row, the ranges only skip rows.
+func planRange(tdef *TableDef, where Expr) []scanRange {
+	conds := splitAnd(where)
+	best, bestScore := []scanRange{fullRange(tdef)}, 0
+	keys := append([][]string{tdef.Cols[:tdef.PKeys]}, tdef.Indexes...)
+	for i, key := range keys {
+		// the ranges of the leading columns, up to one that is not points
+		var sets [][]scanRange
+		for _, col := range key {
+			set, ok := columnRanges(tdef, conds, col)
+			if !ok {
+				break
+			}
+			sets = append(sets, set)
+			if !allPoints(set) {
+				break
+			}
+		}
+		ranges, used := keyRanges(key, sets)
+		if used == 0 {
+			continue
+		}
+		score := 0
+		for _, set := range sets[:used] {
+			switch {
+			case len(ranges) == 0:
+				score = 1 << 30 // nothing to read
+			case allPoints(set):
+				score += 8
+			case set[0].lo != nil && set[0].hi != nil:
+				score += 4
+			default:
+				score += 2
+			}
+		}
+		if i == 0 {
+			score++ // no second lookup in the primary tree
+		}
+		if score > bestScore {
+			best, bestScore = ranges, score
+		}
+	}
+	return best
+}
+
+func allPoints(ranges []scanRange) bool {
+	for i := range ranges {
+		if !ranges[i].point() {
+			return false
+		}
+	}
+	return true
+}
+
+// the ranges of a key: each combination of the values of the point columns,
+// with the ranges of the last column. trailing columns are dropped while
+// there are too many ranges. returns the number of columns used.
+func keyRanges(key []string, sets [][]scanRange) ([]scanRange, int) {
+	for ; len(sets) > 0; sets = sets[:len(sets)-1] {
+		n := 1
+		for _, set := range sets {
+			n *= len(set)
+		}
+		if n > MAX_SCAN_RANGES {
+			continue
+		}
+		prefixes := [][]Value{nil}
+		for _, set := range sets[:len(sets)-1] {
+			var next [][]Value
+			for _, p := range prefixes {
+				for _, r := range set {
+					next = append(next, append(append([]Value{}, p...), *r.lo))
+				}
+			}
+			prefixes = next
+		}
+		out := []scanRange{}
+		for _, p := range prefixes {
+			for _, r := range sets[len(sets)-1] {
+				r.prefix, r.key = p, key[:len(sets)]
+				out = append(out, r)
+			}
+		}
+		return out, len(sets)
+	}
+	return nil, 0
+}
+
+// the columns of the FROM table the statement refers to, false for all of them
+func (q *query) baseColumns() ([]string, bool) {
+	s, base := q.stmt, q.tables[0]
+	var exprs []Expr
+	for _, item := range s.Items {
+		if item.Expr == nil {
+			return nil, false // `*`
+		}
+		exprs = append(exprs, item.Expr)
+	}
+	exprs = append(exprs, s.Where, s.Having)
+	exprs = append(exprs, s.GroupBy...)
+	for _, item := range s.OrderBy {
+		exprs = append(exprs, item.Expr)
+	}
+	for _, join := range s.Joins {
+		exprs = append(exprs, join.On)
+	}
+	used := map[string]bool{}
+	var cols []string
+	for _, e := range exprs {
+		walkExpr(e, func(e Expr) {
+			c, ok := e.(*ColumnRef)
+			if !ok {
+				return
+			}
+			// aliases & unknown columns are left to the binding
+			idx, err := q.sch.resolve(c.Table, c.Name)
+			if err == nil && idx < len(base.Cols) && !used[base.Cols[idx]] {
+				used[base.Cols[idx]] = true
+				cols = append(cols, base.Cols[idx])
+			}
+		})
+	}
+	return cols, true
+}
+
+// answer the query from the keys of the index the ranges are read
+// through, when it holds every column the statement uses. this saves
+// looking up each row in the primary tree.
+func (q *query) useKeyOnly() {
+	base := q.tables[0]
+	if len(q.scan) == 0 {
+		return
+	}
+	key := q.scan[0].key
+	if key == nil {
+		key = []string{q.scan[0].col}
+	}
+	indexNo, err := findIndex(base, key)
+	if err != nil || indexNo < 0 {
+		return // the primary key holds the whole row anyway
+	}
+	cols, ok := q.baseColumns()
+	if !ok {
+		return
+	}
+	for _, col := range cols {
+		if !contains(base.Indexes[indexNo], col) {
+			return
+		}
+	}
+	for i := range q.scan {
+		q.scan[i].keyOnly = true
+	}
+}
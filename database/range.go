@@ -60,6 +60,11 @@ func dbScan(db *DB, tdef *TableDef, req *Scanner, tree *BTree) error {
 	// seek to the start key
 	req.keyStart = encodeKeyPartial(nil, prefix, req.Key1.Vals, tdef, index, req.Cmp1)
 	req.keyEnd = encodeKeyPartial(nil, prefix, req.Key2.Vals, tdef, index, req.Cmp2)
+	if req.Cmp1 > 0 {
+		tree.trackRead(req.keyStart, req.keyEnd)
+	} else {
+		tree.trackRead(req.keyEnd, req.keyStart)
+	}
 	req.iter = tree.Seek(req.keyStart, req.Cmp1)
 	return nil
 }
@@ -69,39 +74,24 @@ func (sc *Scanner) Valid() bool {
 		return false
 	}
 	key, _ := sc.iter.Deref()
-
-	// First check if we've reached the end of valid keys
-	if bytes.Compare(key, sc.keyEnd) > 0 {
-		return false
-	}
-
-	// Check if we're still within range
-	if bytes.Compare(key, sc.keyStart) < 0 {
-		return false
-	}
-
-	return true
+	return cmpOK(key, sc.Cmp1, sc.keyStart) && cmpOK(key, sc.Cmp2, sc.keyEnd)
 }
 
+// move towards Key2, backwards when the range is descending
 func (sc *Scanner) Next() {
 	if !sc.iter.Valid() {
 		return
 	}
-
-	currentKey, _ := sc.iter.Deref()
-	sc.iter.Next()
-
-	// If after moving Next(), we get the same key or invalid iterator,
-	// we've reached the end of valid data
-	if !sc.iter.Valid() {
-		return
+	last := len(sc.iter.path) - 1
+	moved := false
+	if sc.Cmp1 > 0 {
+		moved = iterNext(sc.iter, last)
+	} else {
+		moved = iterPrev(sc.iter, last)
 	}
-
-	nextKey, _ := sc.iter.Deref()
-	if bytes.Equal(currentKey, nextKey) {
-		// If we get the same key, invalidate iterator to stop
+	if !moved {
+		// past either end of the tree
 		sc.iter = &BIter{}
-		return
 	}
 }
 
@@ -143,6 +133,28 @@ func (sc *Scanner) Deref(rec *Record, tree *BTree) {
 	}
 }
 
+// fetch the columns of the current key without reading the row. the key of
+// an index holds the indexed columns & the primary key, the other columns
+// are left out.
+func (sc *Scanner) DerefKey(rec *Record) {
+	if !sc.Valid() {
+		return
+	}
+	if sc.indexNo < 0 {
+		sc.Deref(rec, nil) // the primary key holds the whole row
+		return
+	}
+	tdef := sc.tdef
+	key, _ := sc.iter.Deref()
+	index := tdef.Indexes[sc.indexNo]
+	rec.Cols = index
+	rec.Vals = make([]Value, len(index))
+	for i, col := range index {
+		rec.Vals[i].Type = tdef.Types[ColIndex(tdef, col)]
+	}
+	decodeValues(key[4:], rec.Vals)
+}
+
 // B-Tree Iterator
 type BIter struct {
 	tree *BTree
@@ -174,7 +186,7 @@ func (iter *BIter) Prev() {
 }
 
 func (iter *BIter) Next() {
-	iterNext(iter, 0)
+	iterNext(iter, len(iter.path)-1)
 }
 
 func (tree *BTree) Seek(key []byte, cmp int) *BIter {
@@ -225,13 +237,16 @@ func cmpOK(key []byte, cmp int, ref []byte) bool {
 	}
 }
 
-func iterPrev(iter *BIter, level int) {
+// returns false at the first key, the iterator is left unchanged
+func iterPrev(iter *BIter, level int) bool {
 	if iter.pos[level] > 0 {
 		iter.pos[level]-- // move within this node
-	} else if level > 0 { // make sure the level is not less than the `root`
-		iterPrev(iter, level-1)
+	} else if level > 0 { // move to the previous sibling through the parent
+		if !iterPrev(iter, level-1) {
+			return false
+		}
 	} else {
-		return
+		return false
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid prevNode
@@ -240,16 +255,20 @@ func iterPrev(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = kid.nKeys() - 1
 	}
+	return true
 }
 
-func iterNext(iter *BIter, level int) {
+// returns false at the last key, the iterator is left unchanged
+func iterNext(iter *BIter, level int) bool {
 	currentNode := iter.path[level]
 	if iter.pos[level] < uint16(currentNode.nKeys())-1 {
 		iter.pos[level]++ // move within this node
-	} else if level < len(iter.path)-1 {
-		iterNext(iter, level+1)
+	} else if level > 0 { // move to the next sibling through the parent
+		if !iterNext(iter, level-1) {
+			return false
+		}
 	} else {
-		return
+		return false
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid nextNode
@@ -258,4 +277,5 @@ func iterNext(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = 0
 	}
+	return true
 }
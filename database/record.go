@@ -5,14 +5,23 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 )
 
 const (
 	TYPE_ERROR = 0
 	TYPE_INT64 = 1
 	TYPE_BYTES = 2
+	// only produced by queries, never stored
+	TYPE_NULL    = 3
+	TYPE_FLOAT64 = 4
 )
 
+// the names of the column types, as shown to users
+var typeNames = map[uint32]string{TYPE_INT64: "int64", TYPE_BYTES: "bytes"}
+
 // table row
 type Record struct {
 	Cols []string
@@ -24,13 +33,24 @@ type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
+	F64  float64
 }
 
 type DB struct {
-	Path   string
-	kv     KV
-	pool   *WorkerPool
-	tables map[string]*TableDef // cached table definition
+	Path     string
+	kv       KV
+	pool     *WorkerPool
+	mu       sync.Mutex           // guards tables & the settings below
+	tables   map[string]*TableDef // cached table definition
+	timeouts TXTimeouts
+	// bytes a sort may hold in memory, 0 for DEFAULT_SORT_MEMORY
+	sortMemory int
+	// statements taking longer are logged, 0 for none
+	slowQuery time.Duration
+	logger    *slog.Logger // nil discards the logs
+	// the rows `GetRange` returns at most, 0 for DEFAULT_MAX_RANGE_ROWS
+	maxRangeRows int
+	config       *Config // the settings it was opened with, nil for the defaults
 }
 
 type TableDef struct {
@@ -87,20 +107,51 @@ func (rec *Record) Get(key string) *Value {
 	return nil
 }
 
+// the definition of a table as seen by `tree`. only the definitions read
+// from committed versions are cached, a transaction's private tree may
+// still be rolled back.
 func GetTableDef(db *DB, name string, tree *BTree) *TableDef {
+	db.mu.Lock()
 	tdef, ok := db.tables[name]
-	if !ok {
+	db.mu.Unlock()
+	if ok {
+		return tdef
+	}
+	tdef = getTableDefDB(db, name, tree)
+	if tdef != nil && tree.root < PRIVATE_PAGE_MIN {
+		db.mu.Lock()
 		if db.tables == nil {
 			db.tables = map[string]*TableDef{}
 		}
-		tdef = getTableDefDB(db, name, tree)
-		if tdef != nil {
-			db.tables[name] = tdef
-		}
+		db.tables[name] = tdef
+		db.mu.Unlock()
 	}
 	return tdef
 }
 
+// the definitions of the tables created by users, by name
+func listTables(db *DB, tree *BTree) ([]*TableDef, error) {
+	key := Record{Cols: []string{"name"}}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := dbScan(db, TDEF_TABLE, &sc, tree); err != nil {
+		return nil, err
+	}
+	var tables []*TableDef
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		if bytes.HasPrefix(rec.Get("name").Str, []byte("@")) {
+			continue // internal
+		}
+		tdef := &TableDef{}
+		if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+			return nil, fmt.Errorf("table %s: %w", rec.Get("name").Str, err)
+		}
+		tables = append(tables, tdef)
+	}
+	return tables, nil
+}
+
 func getTableDefDB(db *DB, name string, tree *BTree) *TableDef {
 	rec := (&Record{}).AddStr("name", []byte(name))
 	// get the tdef from the `BTree` using the PKey - `name`
@@ -234,10 +285,15 @@ func escapeString(in []byte) []byte {
 	zeros := bytes.Count(in, []byte{0})
 	ones := bytes.Count(in, []byte{1})
 
-	if zeros+ones == 0 {
+	// a leading 0xfe or 0xff is escaped too, it would collide with the marker
+	lead := 0
+	if len(in) > 0 && in[0] >= 0xfe {
+		lead = 1
+	}
+	if zeros+ones+lead == 0 {
 		return in
 	}
-	out := make([]byte, len(in)+zeros+ones)
+	out := make([]byte, len(in)+zeros+ones+lead)
 	pos := 0
 	if len(in) > 0 && in[0] >= 0xfe {
 		out[0] = 0xfe
@@ -0,0 +1,414 @@
+package database
+
+import (
+	"fmt"
+)
+
+// SELECT items FROM table [joins] [WHERE cond] [GROUP BY exprs] [HAVING cond]
+// [ORDER BY exprs]
+type SelectStmt struct {
+	Items   []SelectItem
+	From    TableRef
+	Joins   []JoinClause
+	Where   Expr
+	GroupBy []Expr
+	Having  Expr
+	OrderBy []OrderItem
+	info    *ScanInfo // how the FROM table is read, for the slow query log
+}
+
+type SelectItem struct {
+	Expr  Expr // nil for `*`
+	Alias string
+}
+
+// the column name of the item in the result
+func (item SelectItem) name() string {
+	if item.Alias != "" {
+		return item.Alias
+	}
+	return item.Expr.String()
+}
+
+// a table in FROM, columns are qualified by the alias if there is one
+type TableRef struct {
+	Name  string
+	Alias string
+}
+
+func (t TableRef) qualifier() string {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	return t.Name
+}
+
+func (s *SelectStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	res := &StatementResult{Records: []*Record{}}
+	err := s.Query(db, tx, func(rec *Record) error {
+		res.Records = append(res.Records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pass the resulting rows to `fn` one by one, so that a large result
+// does not have to be held in memory
+func (s *SelectStmt) Query(db *DB, tx *DBTX, fn func(rec *Record) error) error {
+	return withReader(db, tx, func(reader *KVReader) error {
+		return s.run(db, tx, reader, fn)
+	})
+}
+
+// run `fn` against the transaction's view, or a fresh snapshot outside of one
+func withReader(db *DB, tx *DBTX, fn func(reader *KVReader) error) error {
+	if tx != nil {
+		return fn(&tx.kv.KVReader)
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	return fn(&reader)
+}
+
+// a SELECT resolved against the table definitions
+type query struct {
+	db     *DB
+	tx     *DBTX
+	reader *KVReader
+	stmt   *SelectStmt
+	tables []*TableDef // the FROM table, then the joined ones
+	sch    *schema     // the columns of all the tables, in the same order
+	where  Expr
+	scan   []scanRange // the rows read from the FROM table, in key order
+	info   *ScanInfo
+}
+
+func (s *SelectStmt) prepare(db *DB, tx *DBTX, reader *KVReader) (*query, error) {
+	q := &query{db: db, tx: tx, reader: reader, stmt: s, sch: &schema{}, info: s.info}
+	refs := []TableRef{s.From}
+	for _, join := range s.Joins {
+		refs = append(refs, join.Table)
+	}
+	for _, ref := range refs {
+		tdef := lookupTable(db, ref.Name, &reader.Tree)
+		if tdef == nil {
+			return nil, fmt.Errorf("table not found: %s", ref.Name)
+		}
+		q.tables = append(q.tables, tdef)
+		t := tableSchema(ref.qualifier(), tdef)
+		q.sch.tables = append(q.sch.tables, t.tables...)
+		q.sch.cols = append(q.sch.cols, t.cols...)
+	}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if seen[ref.qualifier()] {
+			return nil, fmt.Errorf("table name %q specified more than once, use an alias", ref.qualifier())
+		}
+		seen[ref.qualifier()] = true
+	}
+	var err error
+	if q.where, err = bindWhere(s.Where, q.sch); err != nil {
+		return nil, err
+	}
+	q.scan = planRange(q.tables[0], q.where)
+	return q, nil
+}
+
+// the rows of the FROM clause, before WHERE
+func (q *query) open() (rowIter, error) {
+	base := q.tables[0]
+	var rows rowIter = &rangesSource{db: q.db, tx: q.tx, reader: q.reader, tdef: base, ranges: q.scan}
+	var err error
+	if systemTableOf(base) != nil {
+		if rows, err = q.source(base, fullRange(base)); err != nil {
+			return nil, err
+		}
+	}
+	if q.info != nil {
+		q.info.Table, q.info.Path = base.Name, q.accessPath()
+		rows = &countingIter{rows: rows, n: &q.info.Scanned}
+	}
+	width := len(base.Cols)
+	for i, join := range q.stmt.Joins {
+		inner := q.tables[i+1]
+		rows, err = q.openJoin(rows, join, inner, width)
+		if err != nil {
+			return nil, err
+		}
+		width += len(inner.Cols)
+	}
+	return rows, nil
+}
+
+func (s *SelectStmt) run(db *DB, tx *DBTX, reader *KVReader, fn func(rec *Record) error) error {
+	q, err := s.prepare(db, tx, reader)
+	if err != nil {
+		return err
+	}
+	if s.isAggregate() {
+		return q.runAggregate(fn)
+	}
+
+	names, exprs, err := bindItems(s.Items, q.sch, len(s.Joins) > 0)
+	if err != nil {
+		return err
+	}
+	keys, err := bindOrder(s.OrderBy, func(e Expr) (Expr, error) {
+		if i := s.aliasOf(e); i >= 0 {
+			e = s.Items[i].Expr
+		}
+		return bindExpr(e, q.sch)
+	})
+	if err != nil {
+		return err
+	}
+	if q.useIndexOrder(keys) {
+		keys = nil // the rows are read in order
+	}
+	q.useKeyOnly()
+	out := newOrderedOutput(db, s.OrderBy, keys, fn)
+	defer out.close()
+
+	rows, err := q.open()
+	if err != nil {
+		return err
+	}
+	for {
+		row, err := rows.next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		ok, err := matches(q.where, row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		rec, err := project(names, exprs, row)
+		if err != nil {
+			return err
+		}
+		if err := out.add(row, rec); err != nil {
+			return err
+		}
+	}
+	return out.finish()
+}
+
+func bindWhere(where Expr, sch *schema) (Expr, error) {
+	if where == nil {
+		return nil, nil
+	}
+	var err error
+	walkExpr(where, func(e Expr) {
+		if _, ok := e.(*AggregateCall); ok && err == nil {
+			err = fmt.Errorf("aggregate %s is not allowed in WHERE", e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bindExpr(where, sch)
+}
+
+// the output columns, `*` expands to every column of the schema.
+// the names are qualified when several tables are involved.
+func bindItems(items []SelectItem, sch *schema, qualified bool) ([]string, []Expr, error) {
+	var names []string
+	var exprs []Expr
+	for _, item := range items {
+		if item.Expr == nil {
+			for i, col := range sch.cols {
+				if qualified {
+					names = append(names, sch.tables[i]+"."+col)
+				} else {
+					names = append(names, col)
+				}
+				exprs = append(exprs, &ColumnRef{Table: sch.tables[i], Name: col, idx: i})
+			}
+			continue
+		}
+		e, err := bindExpr(item.Expr, sch)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, item.name())
+		exprs = append(exprs, e)
+	}
+	return names, exprs, nil
+}
+
+// the item an ORDER BY term names by its alias, -1 if none
+func (s *SelectStmt) aliasOf(e Expr) int {
+	c, ok := e.(*ColumnRef)
+	if !ok || c.Table != "" {
+		return -1
+	}
+	for i, item := range s.Items {
+		if item.Expr != nil && item.Alias == c.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+// whether the condition holds for the row, no condition always holds
+func matches(cond Expr, row []Value) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+	v, err := cond.Eval(row)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+func project(names []string, exprs []Expr, row []Value) (*Record, error) {
+	rec := &Record{Cols: names, Vals: make([]Value, len(exprs))}
+	for i, e := range exprs {
+		v, err := e.Eval(row)
+		if err != nil {
+			return nil, err
+		}
+		rec.Vals[i] = v
+	}
+	return rec, nil
+}
+
+// the scanner over a range, `findIndex` picks the key from the columns
+func rangeScanner(db *DB, tdef *TableDef, tree *BTree, r scanRange) (*Scanner, error) {
+	key := r.key
+	if key == nil {
+		key = []string{r.col}
+	}
+	// a key without values is the start or the end of the index
+	lo := Record{Cols: key, Vals: append([]Value{}, r.prefix...)}
+	hi := Record{Cols: key, Vals: append([]Value{}, r.prefix...)}
+	if r.lo != nil {
+		lo.Vals = append(lo.Vals, *r.lo)
+	}
+	if r.hi != nil {
+		hi.Vals = append(hi.Vals, *r.hi)
+	}
+	sc := &Scanner{Cmp1: r.loCmp, Cmp2: r.hiCmp, Key1: lo, Key2: hi}
+	if r.desc {
+		sc = &Scanner{Cmp1: r.hiCmp, Cmp2: r.loCmp, Key1: hi, Key2: lo}
+	}
+	if err := dbScan(db, tdef, sc, tree); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// a stream of rows
+type rowIter interface {
+	next() ([]Value, error) // nil at the end
+}
+
+// the rows of a table, read through a range of the primary key or of an index
+type tableSource struct {
+	tx      *DBTX
+	tdef    *TableDef
+	tree    *BTree
+	sc      *Scanner
+	keyOnly bool
+}
+
+func openTableSource(db *DB, tx *DBTX, reader *KVReader, tdef *TableDef, r scanRange) (*tableSource, error) {
+	sc, err := rangeScanner(db, tdef, &reader.Tree, r)
+	if err != nil {
+		return nil, err
+	}
+	src := &tableSource{tx: tx, tdef: tdef, tree: &reader.Tree, sc: sc}
+	src.keyOnly = r.keyOnly && sc.indexNo >= 0
+	return src, nil
+}
+
+// the next row, nil at the end
+func (src *tableSource) next() ([]Value, error) {
+	if src.tx != nil {
+		if err := src.tx.checkTimeout(); err != nil {
+			return nil, err
+		}
+	}
+	if !src.sc.Valid() {
+		return nil, nil
+	}
+	var rec Record
+	if src.keyOnly {
+		src.sc.DerefKey(&rec)
+		src.sc.Next()
+		row := make([]Value, len(src.tdef.Cols))
+		for i := range row {
+			row[i].Type = TYPE_NULL
+		}
+		for i, col := range rec.Cols {
+			row[ColIndex(src.tdef, col)] = rec.Vals[i]
+		}
+		return copyValues(row), nil
+	}
+	src.sc.Deref(&rec, src.tree)
+	src.sc.Next()
+	return copyValues(rec.Vals), nil
+}
+
+// the rows of `tdef` in the range, a system table is read in full
+func (q *query) source(tdef *TableDef, r scanRange) (rowIter, error) {
+	if sys := systemTableOf(tdef); sys != nil {
+		rows, err := sys.read(q.db, &q.reader.Tree)
+		return &valuesSource{rows: rows}, err
+	}
+	return openTableSource(q.db, q.tx, q.reader, tdef, r)
+}
+
+// the rows of several ranges, one after the other
+type rangesSource struct {
+	db     *DB
+	tx     *DBTX
+	reader *KVReader
+	tdef   *TableDef
+	ranges []scanRange
+	cur    *tableSource
+}
+
+func (src *rangesSource) next() ([]Value, error) {
+	for {
+		if src.cur == nil {
+			if len(src.ranges) == 0 {
+				return nil, nil
+			}
+			cur, err := openTableSource(src.db, src.tx, src.reader, src.tdef, src.ranges[0])
+			if err != nil {
+				return nil, err
+			}
+			src.cur, src.ranges = cur, src.ranges[1:]
+		}
+		row, err := src.cur.next()
+		if err != nil || row != nil {
+			return row, err
+		}
+		src.cur = nil
+	}
+}
+
+// decoded strings may point into the mapped pages, which are only
+// valid while the snapshot is held
+func copyValues(vals []Value) []Value {
+	out := make([]Value, len(vals))
+	for i, v := range vals {
+		if v.Str != nil {
+			v.Str = append([]byte{}, v.Str...)
+		}
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a parsed statement, `tx` is the session's transaction or nil
+type Statement interface {
+	Exec(db *DB, tx *DBTX) (*StatementResult, error)
+}
+
+type StatementResult struct {
+	Records      []*Record
+	Message      string
+	RowsAffected int // by INSERT, UPDATE & DELETE
+}
+
+func requireWriteTX(tx *DBTX, what string) error {
+	if tx == nil {
+		return fmt.Errorf("%s can only be used inside a transaction", what)
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	return nil
+}
+
+type SavepointStmt struct {
+	Name string
+}
+
+func (s *SavepointStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if err := requireWriteTX(tx, "SAVEPOINT"); err != nil {
+		return nil, err
+	}
+	if err := tx.Savepoint(s.Name); err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: fmt.Sprintf("Savepoint '%s' created.", s.Name)}, nil
+}
+
+type RollbackToStmt struct {
+	Name string
+}
+
+func (s *RollbackToStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if err := requireWriteTX(tx, "ROLLBACK TO"); err != nil {
+		return nil, err
+	}
+	if err := tx.RollbackTo(s.Name); err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: fmt.Sprintf("Rolled back to savepoint '%s'.", s.Name)}, nil
+}
+
+type ReleaseStmt struct {
+	Name string
+}
+
+func (s *ReleaseStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if err := requireWriteTX(tx, "RELEASE"); err != nil {
+		return nil, err
+	}
+	if err := tx.Release(s.Name); err != nil {
+		return nil, err
+	}
+	return &StatementResult{Message: fmt.Sprintf("Savepoint '%s' released.", s.Name)}, nil
+}
+
+// SET of a database setting, the timeouts take effect for new transactions
+type SetStmt struct {
+	Name  string
+	Value string
+}
+
+func (s *SetStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	if s.Name == "sort_memory" {
+		n, err := parseSize(s.Value)
+		if err != nil {
+			return nil, err
+		}
+		db.SetSortMemory(n)
+		return &StatementResult{Message: fmt.Sprintf("%s set to %d bytes.", s.Name, n)}, nil
+	}
+
+	d, err := parseTimeout(s.Value)
+	if err != nil {
+		return nil, err
+	}
+	t := db.Timeouts()
+	switch s.Name {
+	case "slow_query_threshold":
+		db.SetSlowQueryThreshold(d)
+		return &StatementResult{Message: fmt.Sprintf("%s set to %v.", s.Name, d)}, nil
+	case "statement_timeout":
+		t.Statement = d
+	case "idle_in_transaction_timeout":
+		t.Idle = d
+	default:
+		return nil, fmt.Errorf("unknown setting: %s", s.Name)
+	}
+	db.SetTimeouts(t)
+	return &StatementResult{Message: fmt.Sprintf("%s set to %v.", s.Name, d)}, nil
+}
+
+// a number of bytes, optionally with a kB, MB or GB suffix
+func parseSize(v string) (int, error) {
+	units := []struct {
+		suffix string
+		mult   int
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}}
+	num, mult := strings.ToLower(strings.TrimSpace(v)), 1
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", v)
+	}
+	return n * mult, nil
+}
+
+// a Go duration like `30s`, or a plain number of milliseconds
+func parseTimeout(v string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("invalid timeout: %s", v)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout: %s", v)
+	}
+	return d, nil
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Statistics
+// the sizes of the file & of the tables, from walking every page of the
+// tree of a snapshot. a page holding the keys of several prefixes counts
+// for each of them.
+
+type DBStats struct {
+	FileSize      int    // bytes
+	Pages         uint64 // the pages of the file in use, `page.flushed`
+	FreePages     int    // the pages of the free list
+	Height        int    // the levels of the tree, 1 for a root leaf
+	LeafPages     int
+	InternalPages int
+	Tables        []TableStats
+}
+
+type TableStats struct {
+	Name          string
+	Rows          int
+	LeafPages     int
+	InternalPages int
+	AvgKeySize    float64 // bytes, with the prefix
+	AvgValSize    float64
+	Indexes       []IndexStats
+}
+
+type IndexStats struct {
+	Columns       []string
+	Entries       int
+	LeafPages     int
+	InternalPages int
+}
+
+// the totals of the keys under a prefix
+type prefixStats struct {
+	entries  int
+	keyBytes int
+	valBytes int
+	leaves   int
+	inodes   int
+}
+
+// the statistics of the database, with the tables named in `tables` or
+// all of them
+func (db *DB) Stats(tables ...string) (*DBStats, error) {
+	stats := &DBStats{}
+	var reader KVReader
+	// the file & the free list change in commits
+	db.kv.lockWriter()
+	db.kv.BeginRead(&reader)
+	stats.FileSize = db.kv.mmap.file
+	stats.Pages = db.kv.page.flushed
+	stats.FreePages = db.kv.free.Total()
+	db.kv.writer.Unlock()
+	defer db.kv.EndRead(&reader)
+
+	var tdefs []*TableDef
+	if len(tables) == 0 {
+		var err error
+		if tdefs, err = listTables(db, &reader.Tree); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range tables {
+		tdef := GetTableDef(db, name, &reader.Tree)
+		if tdef == nil || strings.HasPrefix(name, "@") {
+			return nil, fmt.Errorf("table not found: %s", name)
+		}
+		tdefs = append(tdefs, tdef)
+	}
+
+	prefixes := map[uint32]*prefixStats{}
+	if reader.Tree.root != 0 {
+		stats.Height = walkStats(&reader.Tree, reader.Tree.root, stats, prefixes)
+	}
+	get := func(prefix uint32) prefixStats {
+		if p := prefixes[prefix]; p != nil {
+			return *p
+		}
+		return prefixStats{}
+	}
+	for _, tdef := range tdefs {
+		p := get(tdef.Prefix)
+		ts := TableStats{Name: tdef.Name, Rows: p.entries, LeafPages: p.leaves, InternalPages: p.inodes}
+		if p.entries > 0 {
+			ts.AvgKeySize = float64(p.keyBytes) / float64(p.entries)
+			ts.AvgValSize = float64(p.valBytes) / float64(p.entries)
+		}
+		for i, index := range tdef.Indexes {
+			p := get(tdef.IndexPrefix[i])
+			ts.Indexes = append(ts.Indexes, IndexStats{
+				Columns: index, Entries: p.entries, LeafPages: p.leaves, InternalPages: p.inodes,
+			})
+		}
+		stats.Tables = append(stats.Tables, ts)
+	}
+	return stats, nil
+}
+
+// add up the pages & keys under `ptr`, returns the height of the subtree
+func walkStats(tree *BTree, ptr uint64, stats *DBStats, prefixes map[uint32]*prefixStats) int {
+	node := tree.get(ptr)
+	leaf := node.bNodeType() == BNODE_LEAF
+	if leaf {
+		stats.LeafPages++
+	} else {
+		stats.InternalPages++
+	}
+	var seen []uint32 // the prefixes of the page
+	height := 0
+	for i := uint16(0); i < node.nKeys(); i++ {
+		key := node.getKey(i)
+		if len(key) >= 4 {
+			prefix := binary.BigEndian.Uint32(key)
+			p := prefixes[prefix]
+			if p == nil {
+				p = &prefixStats{}
+				prefixes[prefix] = p
+			}
+			if len(seen) == 0 || seen[len(seen)-1] != prefix {
+				seen = append(seen, prefix)
+				if leaf {
+					p.leaves++
+				} else {
+					p.inodes++
+				}
+			}
+			if leaf {
+				p.entries++
+				p.keyBytes += len(key)
+				p.valBytes += len(node.getVal(i))
+			}
+		}
+		if !leaf {
+			height = max(height, walkStats(tree, node.getPtr(i), stats, prefixes))
+		}
+	}
+	return height + 1
+}
+
+// STATS [table]
+type StatsStmt struct {
+	Table string
+}
+
+func (s *StatsStmt) Exec(db *DB, tx *DBTX) (*StatementResult, error) {
+	var tables []string
+	if s.Table != "" {
+		tables = append(tables, s.Table)
+	}
+	stats, err := db.Stats(tables...)
+	if err != nil {
+		return nil, err
+	}
+	res := &StatementResult{Records: []*Record{}}
+	cols := []string{"name", "kind", "entries", "leaf_pages", "internal_pages", "avg_key_size", "avg_val_size"}
+	for _, ts := range stats.Tables {
+		res.Records = append(res.Records, &Record{Cols: cols, Vals: []Value{
+			bytesValue(ts.Name), bytesValue("table"), intValue(ts.Rows), intValue(ts.LeafPages), intValue(ts.InternalPages),
+			roundedValue(ts.AvgKeySize), roundedValue(ts.AvgValSize),
+		}})
+		for _, is := range ts.Indexes {
+			name := fmt.Sprintf("%s (%s)", ts.Name, strings.Join(is.Columns, ", "))
+			res.Records = append(res.Records, &Record{Cols: cols, Vals: []Value{
+				bytesValue(name), bytesValue("index"), intValue(is.Entries), intValue(is.LeafPages), intValue(is.InternalPages),
+				{Type: TYPE_NULL}, {Type: TYPE_NULL},
+			}})
+		}
+	}
+	res.Message = fmt.Sprintf("File %d bytes, %d pages (%d free), tree height %d with %d leaf and %d internal pages.",
+		stats.FileSize, stats.Pages, stats.FreePages, stats.Height, stats.LeafPages, stats.InternalPages)
+	return res, nil
+}
+
+// to one decimal
+func roundedValue(f float64) Value {
+	return Value{Type: TYPE_FLOAT64, F64: math.Round(f*10) / 10}
+}
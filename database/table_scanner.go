@@ -13,24 +13,18 @@ type TableScanner struct {
 	prefix   []byte
 }
 
-func (db *DB) QueryWithFilter(table string, tdef *TableDef, filterRec *Record) ([]*Record, error) {
-	results, err := fullTableScan(db, table, tdef)
-	if err != nil {
-		return nil, err
-	}
-
-	idx := ColIndex(tdef, filterRec.Cols[0])
-	if idx == -1 {
+// the records whose column `filterRec.Cols[0]` equals one of `filterRec.Vals`
+func (db *DB) QueryWithFilter(table string, tdef *TableDef, filterRec *Record, kvReader *KVReader) ([]*Record, error) {
+	if ColIndex(tdef, filterRec.Cols[0]) == -1 {
 		return nil, fmt.Errorf("column %s not found", filterRec.Cols[0])
 	}
-	var matchingRecords []*Record
-	for _, record := range results {
-		for _, filterVal := range filterRec.Vals {
-			if compareValues(record.Vals[idx], filterVal) {
-				matchingRecords = append(matchingRecords, record)
-				break
-			}
-		}
+	in := &InExpr{Expr: &ColumnRef{Name: filterRec.Cols[0]}}
+	for _, v := range filterRec.Vals {
+		in.List = append(in.List, &Literal{Val: v})
+	}
+	matchingRecords, err := db.QueryWhere(table, in, kvReader)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(matchingRecords) == 0 {
@@ -40,6 +34,23 @@ func (db *DB) QueryWithFilter(table string, tdef *TableDef, filterRec *Record) (
 	return matchingRecords, nil
 }
 
+// the records for which `where` holds, e.g. from
+// `ParseExpr("age >= 18 AND (city = 'X' OR status != 'banned')")`.
+// the ranges of the primary key or of an index the condition implies
+// are read instead of the whole table.
+func (db *DB) QueryWhere(table string, where Expr, kvReader *KVReader) ([]*Record, error) {
+	stmt := &SelectStmt{Items: []SelectItem{{}}, From: TableRef{Name: table}, Where: where}
+	var records []*Record
+	err := stmt.run(db, nil, kvReader, func(rec *Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
 func NewTableScanner(db *DB, table string, kvReader *KVReader, tdef *TableDef) (*TableScanner, error) {
 	if tdef == nil {
 		return nil, fmt.Errorf("table definition not found")
@@ -53,38 +64,12 @@ func NewTableScanner(db *DB, table string, kvReader *KVReader, tdef *TableDef) (
 	}, nil
 }
 
-func fullTableScan(db *DB, table string, tdef *TableDef) ([]*Record, error) {
-	var kvReader KVReader
-	db.kv.BeginRead(&kvReader)
-	defer db.kv.EndRead(&kvReader)
-
-	scanner, err := NewTableScanner(db, table, &kvReader, tdef)
-	if err != nil {
-		return nil, fmt.Errorf("scanner creation failed: %v", err)
-	}
-
-	var results []*Record
-	scanner.Start()
-
-	for {
-		rec, ok, recOK := scanner.Next()
-		if !ok {
-			if recOK {
-				results = append(results, rec)
-			}
-			break
-		}
-		results = append(results, rec)
-	}
-
-	return results, nil
-}
-
 func (ts *TableScanner) Start() {
 	if ts.kvReader == nil {
 		fmt.Println("KVReader is nil")
 		return
 	}
+	ts.kvReader.Tree.trackRead(ts.prefix, encodeKey(nil, ts.tdef.Prefix+1, nil))
 	ts.iter = ts.kvReader.Tree.Seek(ts.prefix, CMP_GE)
 }
 
@@ -134,18 +119,3 @@ func (ts *TableScanner) Current() (*Record, error) {
 	decodeValues(val, rec.Vals[ts.tdef.PKeys:])
 	return rec, nil
 }
-
-func compareValues(v1, v2 Value) bool {
-	if v1.Type != v2.Type {
-		return false
-	}
-
-	switch v1.Type {
-	case TYPE_INT64:
-		return v1.I64 == v2.I64
-	case TYPE_BYTES:
-		return bytes.Equal(v1.Str, v2.Str)
-	default:
-		return false
-	}
-}
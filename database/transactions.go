@@ -1,14 +1,72 @@
 package database
 
 import (
+	"bytes"
 	"container/heap"
+	"errors"
 	"fmt"
+	"time"
 )
 
 // DB transaction
 type DBTX struct {
 	kv KVTX
 	db *DB
+	// read-only transactions only use the `KVReader` part of `kv`
+	readOnly bool
+	timer    txTimer
+	// the definitions read from the private tree, dropped when it is
+	// rolled back & moved to `DB.tables` by the commit
+	tables map[string]*TableDef
+}
+
+// the definition of a table as seen by the transaction
+func (tx *DBTX) tableDef(name string) *TableDef {
+	if tdef, ok := tx.tables[name]; ok {
+		return tdef
+	}
+	tdef := GetTableDef(tx.db, name, &tx.kv.Tree)
+	if tdef != nil && tx.kv.Tree.root >= PRIVATE_PAGE_MIN {
+		if tx.tables == nil {
+			tx.tables = map[string]*TableDef{}
+		}
+		tx.tables[name] = tdef
+	}
+	return tdef
+}
+
+var ErrReadOnlyTX = errors.New("cannot write in a read-only transaction")
+
+func (tx *DBTX) Savepoint(name string) error {
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	tx.kv.Savepoint(name)
+	return nil
+}
+
+func (tx *DBTX) RollbackTo(name string) error {
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	tx.tables = nil
+	return tx.kv.RollbackTo(name)
+}
+
+func (tx *DBTX) Release(name string) error {
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	return tx.kv.Release(name)
 }
 
 type KVReader struct {
@@ -22,9 +80,22 @@ type KVReader struct {
 }
 
 // KV Transaction
+//
+// transactions run concurrently. the writes go to a private copy-on-write
+// version of the snapshot taken at `Begin`, while the keys read & written
+// are recorded. on commit they are validated against the transactions
+// committed since the snapshot & then replayed on top of the latest tree.
 type KVTX struct {
 	KVReader
-	kv   *KV
+	kv *KV
+	// pages of the private tree, numbered from PRIVATE_PAGE_MIN
+	private struct {
+		next  uint64
+		pages map[uint64][]byte
+	}
+	reads  []keyRange // key ranges read, for conflict detection
+	writes []kvWrite  // in order, replayed at commit
+	// used when the writes are applied at commit
 	free FreeList
 	page struct {
 		nappend int // no of pages to be appended
@@ -32,8 +103,46 @@ type KVTX struct {
 		// nil value denotes a deallocated page.
 		updates map[uint64][]byte
 	}
+	savepoints []kvSavepoint
+}
+
+// private pages never collide with the pages of the file
+const PRIVATE_PAGE_MIN = uint64(1) << 63
+
+// an inclusive range of keys
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+type kvWrite struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// the keys written by a committed transaction. kept while an older
+// snapshot is active, to validate the transactions reading it.
+type commitRecord struct {
+	version uint64
+	keys    [][]byte
+	ranges  []keyRange // whole key ranges written, by a bulk load
 }
 
+// the transaction state captured by `SAVEPOINT`
+type kvSavepoint struct {
+	name    string
+	root    uint64
+	nwrites int
+	pages   map[uint64][]byte
+}
+
+var ErrNoSavepoint = errors.New("no such savepoint")
+
+// returned by `Commit` when a concurrent transaction changed the data read
+// or written by this one. the transaction is rolled back & can be retried.
+var ErrSerialization = errors.New("could not serialize access due to a concurrent update, retry the transaction")
+
 // initialising the reader from the kv
 func (kv *KV) BeginRead(tx *KVReader) {
 	kv.mu.Lock()
@@ -47,7 +156,11 @@ func (kv *KV) BeginRead(tx *KVReader) {
 
 func (kv *KV) EndRead(tx *KVReader) {
 	kv.mu.Lock()
-	heap.Remove(&kv.readers, tx.index)
+	// ending twice is a no-op
+	if tx.index >= 0 && tx.index < len(kv.readers) && kv.readers[tx.index] == tx {
+		heap.Remove(&kv.readers, tx.index)
+	}
+	tx.index = -1
 	kv.mu.Unlock()
 }
 
@@ -58,78 +171,310 @@ func (tx *KVReader) Seek(key []byte, cmp int) *BIter {
 func (db *DB) Begin(tx *DBTX) {
 	tx.db = db
 	db.kv.Begin(&tx.kv)
+	tx.startTimer()
+}
+
+// start a transaction that the engine ends within the same call, such as
+// the one of a statement run outside of BEGIN. it is never idle, so it
+// has no idle timer that could abort it in the middle of the call.
+func (db *DB) beginInternal(tx *DBTX) {
+	tx.db = db
+	db.kv.Begin(&tx.kv)
+}
+
+// start a read-only transaction. every read made through it sees the
+// snapshot taken here, while writers keep committing new versions.
+func (db *DB) BeginReadOnly() *DBTX {
+	tx := &DBTX{db: db, readOnly: true}
+	db.kv.BeginRead(&tx.kv.KVReader)
+	tx.startTimer()
+	return tx
 }
 
 func (db *DB) Commit(tx *DBTX) error {
-	return db.kv.Commit(&tx.kv)
+	if err := tx.stopTimer(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		db.kv.EndRead(&tx.kv.KVReader)
+		return nil
+	}
+	if err := db.kv.Commit(&tx.kv); err != nil {
+		tx.tables = nil
+		return err
+	}
+	// the tables created by the transaction, from the committed tree
+	if len(tx.tables) > 0 {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		for name := range tx.tables {
+			GetTableDef(db, name, &reader.Tree)
+		}
+		db.kv.EndRead(&reader)
+		tx.tables = nil
+	}
+	return nil
 }
 
 func (db *DB) Abort(tx *DBTX) {
+	tx.tables = nil
+	if tx.stopTimer() != nil {
+		return // already aborted
+	}
+	if tx.readOnly {
+		db.kv.EndRead(&tx.kv.KVReader)
+		return
+	}
 	db.kv.Abort(&tx.kv)
 }
 
+func (tx *DBTX) ReadOnly() bool {
+	return tx.readOnly
+}
+
 func (tx *DBTX) TableNew(tdef *TableDef) error {
-	return tx.db.TableNew(tdef, &tx.kv)
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTX
+	}
+	if err := tx.db.TableNew(tdef, &tx.kv); err != nil {
+		return err
+	}
+	if tx.tables == nil {
+		tx.tables = map[string]*TableDef{}
+	}
+	tx.tables[tdef.Name] = tdef
+	return nil
 }
 
 func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return false, err
+	}
+	if tx.readOnly {
+		return false, ErrReadOnlyTX
+	}
 	return tx.db.Set(table, rec, mode, &tx.kv)
 }
 
 func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return false, err
+	}
+	if tx.readOnly {
+		return false, ErrReadOnlyTX
+	}
 	return tx.db.Delete(table, rec, &tx.kv)
 }
 
+// delete the row with the primary key `pk`, returns the deleted row
+func (tx *DBTX) DeleteByKey(table string, pk ...Value) (*Record, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return nil, err
+	}
+	if tx.readOnly {
+		return nil, ErrReadOnlyTX
+	}
+	tdef := tx.tableDef(table)
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return dbDeleteByKey(tx.db, tdef, pk, &tx.kv)
+}
+
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return false, err
+	}
+	return tx.db.Get(table, rec, &tx.kv.KVReader)
+}
+
+func (tx *DBTX) GetRange(table string, start, end *Record) ([]*Record, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return nil, err
+	}
+	return tx.db.GetRange(table, start, end, &tx.kv.KVReader)
+}
+
 func (tx *DBTX) Scan(table string, req *Scanner) error {
+	if err := tx.checkTimeout(); err != nil {
+		return err
+	}
 	return tx.db.Scan(table, req, &tx.kv.Tree)
 }
 
+// full table scan against the transaction's view of the tree
+func (tx *DBTX) TableScanner(table string) (*TableScanner, error) {
+	if err := tx.checkTimeout(); err != nil {
+		return nil, err
+	}
+	tdef := tx.tableDef(table)
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return NewTableScanner(tx.db, table, &tx.kv.KVReader, tdef)
+}
+
 func (kv *KV) Begin(tx *KVTX) {
 	tx.kv = kv
-	tx.page.updates = map[uint64][]byte{}
+	// the snapshot stays registered as a reader, so that its pages
+	// are not reused by other commits until this transaction ends
+	kv.BeginRead(&tx.KVReader)
+
+	// btree
+	tx.private.next = PRIVATE_PAGE_MIN
+	tx.private.pages = map[uint64][]byte{}
+	tx.Tree.get = tx.privateGet
+	tx.Tree.new = tx.privateNew
+	tx.Tree.del = tx.privateDel
+	tx.Tree.onRead = tx.trackRead
+
+	tx.reads = nil
+	tx.writes = nil
+	tx.savepoints = nil
+}
+
+// end a transaction: commit updates
+func (kv *KV) Commit(tx *KVTX) (err error) {
+	defer kv.EndRead(&tx.KVReader)
+	if len(tx.writes) == 0 {
+		return nil // no updates, not counted as a commit
+	}
+	start := time.Now()
+	defer func() {
+		kv.metrics.commit(start, err)
+		if errors.Is(err, ErrSerialization) {
+			kv.log().Debug("commit conflict", "version", tx.version)
+		} else if err != nil {
+			kv.log().Error("commit failed", "err", err)
+		}
+	}()
+
+	kv.lockWriter()
+	defer kv.writer.Unlock()
+	if err := kv.validate(tx); err != nil {
+		return err
+	}
+	return kv.apply(tx)
+}
+
+// end a transaction: rollback
+func (kv *KV) Abort(tx *KVTX) {
+	kv.EndRead(&tx.KVReader)
+	kv.metrics.abort()
+}
+
+// check the transactions committed after the snapshot of `tx`,
+// none of them may have written a key that `tx` read or wrote.
+// the caller holds `kv.writer`.
+func (kv *KV) validate(tx *KVTX) error {
+	written := make(map[string]struct{}, len(tx.writes))
+	for _, w := range tx.writes {
+		written[string(w.key)] = struct{}{}
+	}
+	for _, rec := range kv.history {
+		if !versionBefore(tx.version, rec.version) {
+			continue // already visible in the snapshot
+		}
+		for _, key := range rec.keys {
+			if _, ok := written[string(key)]; ok {
+				return ErrSerialization
+			}
+			for _, r := range tx.reads {
+				if bytes.Compare(key, r.start) >= 0 && bytes.Compare(key, r.end) <= 0 {
+					return ErrSerialization
+				}
+			}
+		}
+		for _, r := range rec.ranges {
+			for _, w := range tx.writes {
+				if bytes.Compare(w.key, r.start) >= 0 && bytes.Compare(w.key, r.end) <= 0 {
+					return ErrSerialization
+				}
+			}
+			for _, read := range tx.reads {
+				if bytes.Compare(read.start, r.end) <= 0 && bytes.Compare(r.start, read.end) <= 0 {
+					return ErrSerialization
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// replay the writes of `tx` on top of the latest tree & persist it.
+// the caller holds `kv.writer`.
+func (kv *KV) apply(tx *KVTX) error {
+	kv.beginApply(tx)
+	keys := make([][]byte, 0, len(tx.writes))
+	for _, w := range tx.writes {
+		if w.del {
+			tx.Tree.Delete(w.key)
+		} else if err := tx.Tree.Insert(w.key, w.val); err != nil {
+			return err
+		}
+		keys = append(keys, w.key)
+	}
+	if kv.tree.root == tx.Tree.root {
+		return nil // no updates
+	}
+	return kv.publish(tx, commitRecord{keys: keys})
+}
+
+// point the tree & the free list of `tx` at the latest version, the pages
+// it changes are kept in `tx.page.updates`. the caller holds `kv.writer`.
+func (kv *KV) beginApply(tx *KVTX) {
 	tx.mmap.chunks = kv.mmap.chunks
+	tx.page.nappend = 0
+	tx.page.updates = map[uint64][]byte{}
 
-	kv.writer.Lock()
-	tx.version = kv.version
 	// btree
-	tx.Tree.root = kv.tree.root
-	tx.Tree.get = tx.pageGet
-	tx.Tree.new = tx.pageNew
-	tx.Tree.del = tx.pageDel
+	tx.Tree = BTree{
+		root: kv.tree.root,
+		get:  tx.pageGet,
+		new:  tx.pageNew,
+		del:  tx.pageDel,
+	}
 
 	// freelist
-	tx.free.FreeListData = kv.free
-	tx.free.version = kv.version
+	tx.free = FreeList{FreeListData: kv.free}
+	tx.free.version = kv.version + 1
 	tx.free.get = tx.pageGet
 	tx.free.new = tx.pageAppend
 	tx.free.use = tx.pageUse
-
-	tx.free.minReader = kv.version
 	kv.mu.Lock()
-
+	tx.free.minReader = kv.version
 	if len(kv.readers) > 0 {
 		tx.free.minReader = kv.readers[0].version
 	}
 	kv.mu.Unlock()
 }
 
-// end a transaction: commit updates
-func (kv *KV) Commit(tx *KVTX) error {
-	defer kv.writer.Unlock()
-	if kv.tree.root == tx.Tree.root {
-		return nil // no updates
+// write the pages changed by `tx` & make its tree the latest version.
+// `rec` holds what it wrote, for validating concurrent transactions.
+func (kv *KV) publish(tx *KVTX, rec commitRecord) error {
+	if kv.ReadOnly {
+		return ErrReadOnlyDB
 	}
+	// pages freed by this transaction become reusable for later ones
+	collectFreed(tx)
+	tx.free.addUnlisted()
+	tx.free.addFreed()
 
 	// phase 1: persist the page data to disk
 	if err := writePages(tx); err != nil {
-		rollbackTX(tx)
 		return err
 	}
+	if kv.metrics != nil {
+		kv.metrics.pagesPerCommit.observe(float64(len(tx.page.updates)))
+		kv.metrics.freePages.Store(int64(tx.free.Total()))
+	}
 
 	// the page data must reach disk before master page.
 	// the `fsync` serves as a barrier here
-	if err := kv.fp.Sync(); err != nil {
-		rollbackTX(tx)
+	if err := kv.sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
 
@@ -139,6 +484,9 @@ func (kv *KV) Commit(tx *KVTX) error {
 	kv.mu.Lock()
 	kv.tree.root = tx.Tree.root
 	kv.version++
+	rec.version = kv.version
+	kv.history = append(kv.history, rec)
+	kv.pruneHistory()
 	kv.mu.Unlock()
 
 	// phase 2: update the master page to point to new tree
@@ -146,15 +494,78 @@ func (kv *KV) Commit(tx *KVTX) error {
 		return err
 	}
 
-	if err := kv.fp.Sync(); err != nil {
+	if err := kv.sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
 	return nil
 }
 
-// end a transaction: rollback
-func (kv *KV) Abort(tx *KVTX) {
-	kv.writer.Unlock()
+// drop the commit records that every active snapshot already sees.
+// the caller holds `kv.mu`.
+func (kv *KV) pruneHistory() {
+	if len(kv.readers) == 0 {
+		kv.history = kv.history[:0]
+		return
+	}
+	minReader := kv.readers[0].version
+	n := 0
+	for n < len(kv.history) && !versionBefore(minReader, kv.history[n].version) {
+		n++
+	}
+	kv.history = kv.history[n:]
+}
+
+// remember the current tree state under `name`.
+// a name can be reused, the newest savepoint wins.
+func (tx *KVTX) Savepoint(name string) {
+	pages := make(map[uint64][]byte, len(tx.private.pages))
+	for ptr, page := range tx.private.pages {
+		pages[ptr] = page
+	}
+	tx.savepoints = append(tx.savepoints, kvSavepoint{
+		name:    name,
+		root:    tx.Tree.root,
+		nwrites: len(tx.writes),
+		pages:   pages,
+	})
+}
+
+// undo everything done after the savepoint, the savepoint itself is kept.
+// the keys read after it stay in the read set, the rolled back work may
+// still have influenced what the transaction does next.
+func (tx *KVTX) RollbackTo(name string) error {
+	idx := tx.findSavepoint(name)
+	if idx < 0 {
+		return fmt.Errorf("%w: %s", ErrNoSavepoint, name)
+	}
+	sp := tx.savepoints[idx]
+	tx.Tree.root = sp.root
+	tx.writes = tx.writes[:sp.nwrites]
+	tx.private.pages = make(map[uint64][]byte, len(sp.pages))
+	for ptr, page := range sp.pages {
+		tx.private.pages[ptr] = page
+	}
+	tx.savepoints = tx.savepoints[:idx+1]
+	return nil
+}
+
+// forget the savepoint & all the ones created after it, keeping the changes
+func (tx *KVTX) Release(name string) error {
+	idx := tx.findSavepoint(name)
+	if idx < 0 {
+		return fmt.Errorf("%w: %s", ErrNoSavepoint, name)
+	}
+	tx.savepoints = tx.savepoints[:idx]
+	return nil
+}
+
+func (tx *KVTX) findSavepoint(name string) int {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
 }
 
 func (tx *KVTX) Seek(key []byte, cmp int) *BIter {
@@ -162,18 +573,60 @@ func (tx *KVTX) Seek(key []byte, cmp int) *BIter {
 }
 
 func (tx *KVTX) Update(req *InsertReq) bool {
+	root := tx.Tree.root
+	tx.trackRead(req.Key, req.Key)
 	tx.Tree.InsertEx(req)
+	if tx.Tree.root != root {
+		tx.recordWrite(req.Key, req.Value, false)
+	}
 	return req.Added
 }
 
 func (tx *KVTX) Del(req *DeleteReq) bool {
-	return tx.Tree.DeleteEx(req)
+	tx.trackRead(req.Key, req.Key)
+	deleted := tx.Tree.DeleteEx(req)
+	if deleted {
+		tx.recordWrite(req.Key, nil, true)
+	}
+	return deleted
 }
 
-// rollbackTX the tree & other in-memmory data structures
-func rollbackTX(tx *KVTX) {
-	tx.kv.tree.root = tx.Tree.root
-	tx.kv.free = tx.free.FreeListData
-	tx.page.nappend = 0
-	tx.page.updates = make(map[uint64][]byte)
+// callback for the BTree, records the key range about to be read
+func (tx *KVTX) trackRead(start, end []byte) {
+	tx.reads = append(tx.reads, keyRange{
+		start: append([]byte(nil), start...),
+		end:   append([]byte(nil), end...),
+	})
+}
+
+// the callers may reuse their buffers, so the key & value are copied
+func (tx *KVTX) recordWrite(key, val []byte, del bool) {
+	tx.writes = append(tx.writes, kvWrite{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+		del: del,
+	})
+}
+
+// callbacks for the private tree
+func (tx *KVTX) privateGet(ptr uint64) BNode {
+	if ptr >= PRIVATE_PAGE_MIN {
+		return BNode{tx.private.pages[ptr]}
+	}
+	return tx.pageGetMapped(ptr)
+}
+
+func (tx *KVTX) privateNew(node BNode) uint64 {
+	assert(len(node.data) <= BTREE_PAGE_SIZE)
+	ptr := tx.private.next
+	tx.private.next++
+	tx.private.pages[ptr] = node.data
+	return ptr
+}
+
+func (tx *KVTX) privateDel(ptr uint64) {
+	// pages of the snapshot are freed when the writes are replayed
+	if ptr >= PRIVATE_PAGE_MIN {
+		delete(tx.private.pages, ptr)
+	}
 }
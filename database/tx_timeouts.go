@@ -0,0 +1,152 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// returned to the session whose transaction was aborted behind its back
+var (
+	ErrIdleTimeout      = errors.New("transaction aborted: idle in transaction timeout")
+	ErrStatementTimeout = errors.New("transaction aborted: statement timeout")
+)
+
+// a zero duration disables the timeout
+type TXTimeouts struct {
+	Statement time.Duration // the longest a single command may run in a transaction
+	Idle      time.Duration // the longest a transaction may wait for the next command
+}
+
+// an open transaction pins its snapshot in `kv.readers`, which keeps the
+// free list from reusing pages, so a forgotten `BEGIN` is reaped
+var DefaultTXTimeouts = TXTimeouts{Idle: 10 * time.Minute}
+
+// the timeout state of a `DBTX`
+type txTimer struct {
+	mu       sync.Mutex
+	timeouts TXTimeouts
+	idle     *time.Timer
+	busy     bool      // a statement is running
+	started  time.Time // start of the running statement
+	done     bool      // committed or aborted
+	aborted  error     // why the transaction was aborted by a timeout
+}
+
+func (db *DB) SetTimeouts(t TXTimeouts) {
+	db.mu.Lock()
+	db.timeouts = t
+	db.mu.Unlock()
+}
+
+func (db *DB) Timeouts() TXTimeouts {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.timeouts
+}
+
+// arm the timeouts of a transaction that was just started
+func (tx *DBTX) startTimer() {
+	tx.timer.timeouts = tx.db.Timeouts()
+	tx.timer.mu.Lock()
+	tx.armIdle()
+	tx.timer.mu.Unlock()
+}
+
+// the caller holds `timer.mu`
+func (tx *DBTX) armIdle() {
+	if tx.timer.timeouts.Idle > 0 {
+		tx.timer.idle = time.AfterFunc(tx.timer.timeouts.Idle, tx.reapIdle)
+	}
+}
+
+func (tx *DBTX) reapIdle() {
+	tx.timer.mu.Lock()
+	defer tx.timer.mu.Unlock()
+	if tx.timer.busy || tx.timer.done {
+		return
+	}
+	tx.abortLocked(ErrIdleTimeout)
+}
+
+// the caller holds `timer.mu`
+func (tx *DBTX) abortLocked(reason error) {
+	tx.timer.done = true
+	tx.timer.aborted = reason
+	tx.db.log().Info("transaction aborted", "reason", reason)
+	if tx.readOnly {
+		tx.db.kv.EndRead(&tx.kv.KVReader)
+	} else {
+		tx.db.kv.Abort(&tx.kv)
+	}
+}
+
+// called by the session before running a command in the transaction.
+// returns the error if the transaction was aborted by a timeout meanwhile.
+func (tx *DBTX) StatementStart() error {
+	tx.timer.mu.Lock()
+	defer tx.timer.mu.Unlock()
+	if tx.timer.aborted != nil {
+		return tx.timer.aborted
+	}
+	if tx.timer.idle != nil {
+		tx.timer.idle.Stop()
+		tx.timer.idle = nil
+	}
+	tx.timer.busy = true
+	tx.timer.started = time.Now()
+	return nil
+}
+
+// called by the session after the command. a command that ran past the
+// statement timeout aborts the transaction.
+func (tx *DBTX) StatementEnd() error {
+	tx.timer.mu.Lock()
+	defer tx.timer.mu.Unlock()
+	expired := tx.statementExpired()
+	tx.timer.busy = false
+	if tx.timer.done {
+		return tx.timer.aborted
+	}
+	if expired {
+		tx.abortLocked(ErrStatementTimeout)
+		return ErrStatementTimeout
+	}
+	tx.armIdle()
+	return nil
+}
+
+// checked by the operations of a transaction, so that a running statement
+// stops early & nothing runs on the snapshot of an aborted transaction
+func (tx *DBTX) checkTimeout() error {
+	tx.timer.mu.Lock()
+	defer tx.timer.mu.Unlock()
+	if tx.timer.aborted != nil {
+		return tx.timer.aborted
+	}
+	if tx.statementExpired() {
+		return ErrStatementTimeout
+	}
+	return nil
+}
+
+func (tx *DBTX) statementExpired() bool {
+	limit := tx.timer.timeouts.Statement
+	return tx.timer.busy && limit > 0 && time.Since(tx.timer.started) > limit
+}
+
+// stop the timers of a transaction that is being committed or aborted.
+// returns the error if it was already aborted by a timeout.
+func (tx *DBTX) stopTimer() error {
+	tx.timer.mu.Lock()
+	defer tx.timer.mu.Unlock()
+	if tx.timer.idle != nil {
+		tx.timer.idle.Stop()
+		tx.timer.idle = nil
+	}
+	if tx.timer.done {
+		return tx.timer.aborted
+	}
+	tx.timer.done = true
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 const (
@@ -16,6 +17,11 @@ const (
 
 const TABLE_PREFIX_MIN = 1
 
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordExists   = errors.New("record already exists")
+)
+
 type InsertReq struct {
 	tree *BTree
 	// out
@@ -112,11 +118,16 @@ func (db *DB) TableNew(tdef *TableDef, kvtx *KVTX) error {
 	return nil
 }
 
+// MODE_UPDATE_ONLY takes the primary key & the columns to change, the
+// other modes take every column
 func (db *DB) Set(table string, rec Record, mode int, kvtx *KVTX) (bool, error) {
 	tdef := GetTableDef(db, table, &kvtx.Tree)
 	if tdef == nil {
 		return false, fmt.Errorf("table not found: %s", table)
 	}
+	if mode == MODE_UPDATE_ONLY {
+		return dbUpdatePartial(db, tdef, rec, kvtx)
+	}
 	return dbUpdate(db, tdef, rec, mode, kvtx)
 }
 
@@ -135,7 +146,10 @@ func (db *DB) GetRange(table string, start, end *Record, kvReader *KVReader) ([]
 	}
 
 	var results []*Record
-	maxResults := 500 // Safety limit
+	maxResults := db.maxRangeRows // Safety limit
+	if maxResults <= 0 {
+		maxResults = DEFAULT_MAX_RANGE_ROWS
+	}
 
 	sc := Scanner{
 		Cmp1: CMP_GE,
@@ -174,6 +188,8 @@ func (db *DB) Insert(table string, rec Record, kvtx *KVTX) (bool, error) {
 	return db.Set(table, rec, MODE_INSERT_ONLY, kvtx)
 }
 
+// update the columns of `rec` in the row with its primary key,
+// the columns left out keep their values
 func (db *DB) Update(table string, rec Record, kvtx *KVTX) (bool, error) {
 	return db.Set(table, rec, MODE_UPDATE_ONLY, kvtx)
 }
@@ -182,6 +198,7 @@ func (db *DB) Upsert(table string, rec Record, kvtx *KVTX) (bool, error) {
 	return db.Set(table, rec, MODE_UPSERT, kvtx)
 }
 
+// delete the row with the primary key of `rec`, the other columns are ignored
 func (db *DB) Delete(table string, rec Record, kvtx *KVTX) (bool, error) {
 	tdef := GetTableDef(db, table, &kvtx.Tree)
 	if tdef == nil {
@@ -190,25 +207,61 @@ func (db *DB) Delete(table string, rec Record, kvtx *KVTX) (bool, error) {
 	return dbDelete(db, tdef, rec, kvtx)
 }
 
+// delete the row with the primary key `pk` in a transaction of its own,
+// returns the deleted row
+func (db *DB) DeleteByKey(table string, pk ...Value) (*Record, error) {
+	tx := &DBTX{}
+	db.beginInternal(tx)
+	rec, err := tx.DeleteByKey(table, pk...)
+	if err != nil {
+		db.Abort(tx)
+		return nil, err
+	}
+	if err := db.Commit(tx); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
 func dbDelete(db *DB, tdef *TableDef, rec Record, kvtx *KVTX) (bool, error) {
 	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
-	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	if _, err := dbDeleteByKey(db, tdef, values[:tdef.PKeys], kvtx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete the row with the primary key `pk` & its index entries. the
+// deleted row is decoded from the old value of the key.
+func dbDeleteByKey(db *DB, tdef *TableDef, pk []Value, kvtx *KVTX) (*Record, error) {
+	if len(pk) != tdef.PKeys {
+		return nil, fmt.Errorf("expected %d primary key values, got %d", tdef.PKeys, len(pk))
+	}
+	for i, v := range pk {
+		if v.Type != tdef.Types[i] {
+			return nil, fmt.Errorf("primary key %s: %w", tdef.Cols[i], ErrTypeMismatch)
+		}
+	}
+	key := encodeKey(nil, tdef.Prefix, pk)
 	req := DeleteReq{Key: key}
-	deleted, error := kvtx.Delete(&req)
-	if error != nil || !deleted || len(tdef.Indexes) == 0 {
-		return deleted, error
+	if _, err := kvtx.Delete(&req); err != nil {
+		return nil, err
 	}
-	for i := tdef.PKeys; i <= len(tdef.Cols[tdef.PKeys:]); i++ {
-		values[i] = Value{Type: tdef.Types[i]}
+	values := append([]Value{}, pk...)
+	for _, typ := range tdef.Types[tdef.PKeys:] {
+		values = append(values, Value{Type: typ})
 	}
-	if deleted {
-		decodeValues(req.Old, values[tdef.PKeys:])
-		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_DEL, kvtx)
+	decodeValues(req.Old, values[tdef.PKeys:])
+	old := Record{Cols: tdef.Cols, Vals: copyValues(values)}
+	if len(tdef.Indexes) > 0 {
+		if err := indexOp(db, tdef, old, INDEX_DEL, kvtx); err != nil {
+			return nil, err
+		}
 	}
-	return deleted, nil
+	return &old, nil
 }
 
 func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int, kvtx *KVTX) (bool, error) {
@@ -229,15 +282,87 @@ func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int, kvtx *KVTX) (bool, e
 		return added, err
 	}
 
-	if req.Updated && !req.Added {
-		//  delete the old index entries
-		decodeValues(req.Old, values[tdef.PKeys:]) // get the old row
-		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_DEL, kvtx)
+	if req.Updated && req.Old != nil {
+		old := append([]Value{}, values[:tdef.PKeys]...)
+		for _, typ := range tdef.Types[tdef.PKeys:] {
+			old = append(old, Value{Type: typ})
+		}
+		decodeValues(req.Old, old[tdef.PKeys:]) // get the old row
+		err = updateIndexes(tdef, old, values, kvtx)
+	} else if req.Updated || req.Added {
+		err = indexOp(db, tdef, rec, INDEX_ADD, kvtx)
 	}
-	if req.Updated || req.Added {
-		indexOp(db, tdef, rec, INDEX_ADD, kvtx)
+	return added, err
+}
+
+// update the row with the primary key of `rec` with the other columns of
+// `rec`, the rest of the row is kept. only the indexes on the changed
+// columns are written.
+func dbUpdatePartial(db *DB, tdef *TableDef, rec Record, kvtx *KVTX) (bool, error) {
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
 	}
-	return added, nil
+	for i, col := range rec.Cols {
+		idx := ColIndex(tdef, col)
+		if idx < 0 {
+			return false, fmt.Errorf("column %s not found", col)
+		}
+		if rec.Vals[i].Type != tdef.Types[idx] {
+			return false, fmt.Errorf("invalid type of column %s: %w", col, ErrTypeMismatch)
+		}
+	}
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	oldVal, exists, err := kvtx.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, ErrRecordNotFound
+	}
+
+	old := append([]Value{}, values[:tdef.PKeys]...)
+	for _, typ := range tdef.Types[tdef.PKeys:] {
+		old = append(old, Value{Type: typ})
+	}
+	decodeValues(oldVal, old[tdef.PKeys:])
+	merged := append([]Value{}, old...)
+	for i, col := range rec.Cols {
+		merged[ColIndex(tdef, col)] = rec.Vals[i]
+	}
+
+	req := InsertReq{Key: key, Value: encodeValues(nil, merged[tdef.PKeys:]), Mode: MODE_UPDATE_ONLY}
+	if _, err := kvtx.SetWithMode(&req); err != nil {
+		return false, err
+	}
+	if err := updateIndexes(tdef, old, merged, kvtx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// move the index entries of a row from its old to its new values,
+// skipping the indexes whose columns kept their values
+func updateIndexes(tdef *TableDef, old, new []Value, kvtx *KVTX) error {
+	for i, index := range tdef.Indexes {
+		changed := false
+		for _, col := range index {
+			idx := ColIndex(tdef, col)
+			if cmpValuesNull(old[idx], new[idx]) != 0 {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if _, err := kvtx.Delete(&DeleteReq{Key: indexKey(tdef, i, old)}); err != nil {
+			return fmt.Errorf("index (%s): %w", strings.Join(index, ", "), err)
+		}
+		if _, err := kvtx.SetWithMode(&InsertReq{Key: indexKey(tdef, i, new), Mode: MODE_UPSERT}); err != nil {
+			return fmt.Errorf("index (%s): %w", strings.Join(index, ", "), err)
+		}
+	}
+	return nil
 }
 
 func (tree *BTree) DeleteEx(req *DeleteReq) bool {
@@ -303,7 +428,7 @@ func (db *KVTX) SetWithMode(req *InsertReq) (bool, error) {
 			req.Old = old
 			return true, err
 		}
-		return false, errors.New("record not found")
+		return false, ErrRecordNotFound
 
 	case MODE_UPSERT:
 		old, exists, _ := db.Get(req.Key)
@@ -324,17 +449,29 @@ func (db *KVTX) SetWithMode(req *InsertReq) (bool, error) {
 			req.Added = true
 			return true, err
 		}
-		return false, errors.New("record already exists")
+		return false, ErrRecordExists
 
 	default:
 		return false, errors.New("invalid update mode")
 	}
 }
 
+// the tables starting with @ hold the catalog or are system tables,
+// only the engine writes them
+func writableTableCheck(name string) error {
+	if strings.HasPrefix(name, "@") {
+		return fmt.Errorf("%s is an internal table", name)
+	}
+	return nil
+}
+
 func tableDefCheck(tdef *TableDef) error {
 	if tdef.Name == "" {
 		return errors.New("table name cannot be empty")
 	}
+	if systemTables[tdef.Name] != nil {
+		return fmt.Errorf("%s is a system table", tdef.Name)
+	}
 	if len(tdef.Cols) == 0 {
 		return errors.New("table must have at least one column")
 	}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"container/list"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,18 +22,27 @@ type WorkerPool struct {
 	stopOnce     sync.Once
 	stopped      bool
 	waiting      int32
+	workers      int32
 	wait         bool
+	idleTimeout  time.Duration // an idle worker is stopped after it
+	logger       atomic.Pointer[slog.Logger]
 }
 
-var idleTimeout time.Duration = 2 * time.Second
-
 func NewPool(maxWorkers int) *WorkerPool {
+	return NewPoolTimeout(maxWorkers, DEFAULT_WORKER_IDLE)
+}
+
+func NewPoolTimeout(maxWorkers int, idleTimeout time.Duration) *WorkerPool {
 	if maxWorkers < 1 {
 		maxWorkers = 1
 	}
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_WORKER_IDLE
+	}
 
 	pool := &WorkerPool{
 		maxWorkers:  maxWorkers,
+		idleTimeout: idleTimeout,
 		taskQueue:   make(chan func()),
 		workerQueue: make(chan func()),
 		stopSignal:  make(chan struct{}),
@@ -85,7 +95,7 @@ func (p *WorkerPool) stop(wait bool) {
 
 func (p *WorkerPool) dispatch() {
 	defer close(p.stoppedChan)
-	timeout := time.NewTimer(idleTimeout)
+	timeout := time.NewTimer(p.idleTimeout)
 	var workerCount int
 	var idle bool
 	var wg sync.WaitGroup
@@ -111,6 +121,8 @@ Loop:
 					wg.Add(1)
 					go worker(task, p.workerQueue, &wg)
 					workerCount++
+					atomic.StoreInt32(&p.workers, int32(workerCount))
+					p.log().Debug("worker started", "workers", workerCount)
 				} else {
 					p.waitingQueue.PushBack(task)
 					atomic.StoreInt32(&p.waiting, int32(p.waitingQueue.Len()))
@@ -122,10 +134,12 @@ Loop:
 			if idle && workerCount > 0 {
 				if p.killIdleWorker() {
 					workerCount--
+					atomic.StoreInt32(&p.workers, int32(workerCount))
+					p.log().Debug("idle worker stopped", "workers", workerCount)
 				}
 			}
 			idle = true
-			timeout.Reset(idleTimeout)
+			timeout.Reset(p.idleTimeout)
 
 		}
 	}
@@ -136,10 +150,21 @@ Loop:
 		p.workerQueue <- nil
 		workerCount--
 	}
+	atomic.StoreInt32(&p.workers, 0)
 	wg.Wait()
 	timeout.Stop()
 }
 
+// the tasks waiting for a worker
+func (p *WorkerPool) Waiting() int {
+	return int(atomic.LoadInt32(&p.waiting))
+}
+
+// the running workers
+func (p *WorkerPool) Workers() int {
+	return int(atomic.LoadInt32(&p.workers))
+}
+
 func worker(task func(), workerQueue chan func(), wg *sync.WaitGroup) {
 	for task != nil {
 		task()
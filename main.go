@@ -2,8 +2,18 @@ package main
 
 import (
 	"atomixDB/database"
+	"errors"
+	"flag"
+	"os"
 )
 
 func main() {
-	database.StartDB()
+	opts, err := database.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(database.EXIT_OK)
+	}
+	if err != nil {
+		os.Exit(database.EXIT_USAGE)
+	}
+	os.Exit(database.StartDB(opts))
 }